@@ -7,4 +7,15 @@ path "auth/kubernetes/role/*" {
 # Create and manage ACL policies
 path "sys/policies/acl/*" {
   capabilities = ["create", "read", "update", "delete", "list", "sudo"]
-}
\ No newline at end of file
+}
+
+# Required when running with --configure-auth-mount
+# path "sys/auth" {
+#   capabilities = ["read"]
+# }
+# path "sys/auth/kubernetes" {
+#   capabilities = ["create", "update", "sudo"]
+# }
+# path "auth/kubernetes/config" {
+#   capabilities = ["create", "update"]
+# }
@@ -19,26 +19,96 @@ const (
 	VaultRoleNameAnnotation = "vault.hashicorp.com/role-name"
 	// VaultRoleConfigMapAnnotation instructs the controller to use the given configmap for the
 	// parameters of the connection role in Vault. Any annotations on the rolebinding or serviceaccount
-	// will override those parameters found in the configmap.
+	// will override those parameters found in the configmap. Keys are the role parameters below,
+	// with either dashes or underscores, and unknown keys or keys managed by the controller, such
+	// as policies and bound_service_account_names, are rejected.
 	VaultRoleConfigMapAnnotation = "vault.hashicorp.com/configmap"
+	// VaultRoleSecretAnnotation instructs the controller to use the given secret for the
+	// parameters of the connection role in Vault, with the same keys as VaultRoleConfigMapAnnotation.
+	// Parameters in the secret override those in the configmap, and annotations on the rolebinding
+	// or serviceaccount override both.
+	VaultRoleSecretAnnotation = "vault.hashicorp.com/secret"
 	// VaultPolicyNameAnnotation instructs the controller to create a Vault policy with
 	// the name of the annotation value. This policy will be bound to the role or serviceaccount.
 	// If left unset the controller will use the default format of "${namespace}-${resource_name}".
 	VaultPolicyNameAnnotation = "vault.hashicorp.com/policy-name"
+	// VaultAuthMountsAnnotation instructs the controller to write the role for the
+	// service account or rolebinding to each of the given comma-separated auth mounts.
+	// If left unset the controller will use the auth mounts it was configured with.
+	VaultAuthMountsAnnotation = "vault.hashicorp.com/auth-mounts"
+	// VaultNamespaceSelectorAnnotation instructs the controller to bind the role to service
+	// accounts in every namespace matching the given label selector, instead of the namespaces
+	// of the resource or its subjects. The value is either a selector string such as
+	// "team=payments" or a JSON or YAML LabelSelector. Requires a Vault version supporting
+	// bound_service_account_namespace_selector and is rejected for JWT auth mounts.
+	VaultNamespaceSelectorAnnotation = "vault.hashicorp.com/namespace-selector"
+	// VaultAttachPoliciesAnnotation instructs the controller to attach the given comma-separated
+	// existing Vault policies to the role alongside the generated policy. Each policy must be
+	// allowed by the controller's attachable policies.
+	VaultAttachPoliciesAnnotation = "vault.hashicorp.com/attach-policies"
+
+	// VaultConnectionAnnotation instructs the controller to write the policies and roles
+	// for the resource to the named Vault connection from the controller's configuration.
+	// It may also be set on a Namespace to apply to all resources within it. Resources
+	// without the annotation use the default connection.
+	VaultConnectionAnnotation = "vault.hashicorp.com/connection"
+	// VaultDeletionProtectionAnnotation instructs the controller to keep the Vault policy and
+	// role of the resource when it is deleted, when set to "true". It may also be set on a
+	// Namespace to protect all resources within it.
+	VaultDeletionProtectionAnnotation = "vault.hashicorp.com/deletion-protection"
+
+	// VaultSharedPolicyAnnotation instructs the controller to include the shared policy
+	// template of the given name in the policy for the serviceaccount or role. Shared
+	// policies are ConfigMaps in the controller's policy template namespace and are
+	// always rendered as templates of the resource referencing them.
+	VaultSharedPolicyAnnotation = "vault.hashicorp.com/shared-policy"
+
+	// Namespace Annotations
+
+	// VaultNamespaceAnnotation instructs the controller to write the policies and roles
+	// for resources in the Kubernetes namespace to the given Vault Enterprise namespace.
+	// This annotation takes precedence over the namespace template the controller was
+	// configured with. Without a template, resources in namespaces without it are
+	// written to the namespace of the Vault client.
+	VaultNamespaceAnnotation = "vault.hashicorp.com/namespace"
 
 	// ServiceAccount Annotations
 
 	// VaultInlinePolicyAnnotation instructs the controller to create a Vault policy with
 	// the contents of the annotation value. This policy will be bound to the service
-	// account. If both this and VaultConfigMapPolicyAnnotation are set, the controller
-	// will use the value of this annotation.
+	// account. When a policy is composed from several sources, this annotation takes
+	// precedence over all others.
 	VaultInlinePolicyAnnotation = "vault.hashicorp.com/inline-policy"
 	// VaultConfigMapPolicyAnnotation instructs the controller to create a Vault policy
-	// with the contents of the configmap referenced by the annotation value. This policy
-	// will be bound to the service account.
+	// with the contents of the comma-separated configmaps referenced by the annotation
+	// value. The VaultPolicyKey and every other key ending in ".hcl" of each configmap
+	// are merged into the policy bound to the service account.
 	VaultConfigMapPolicyAnnotation = "vault.hashicorp.com/configmap-policy"
+	// VaultSecretPolicyAnnotation instructs the controller to create a Vault policy with
+	// the contents of the comma-separated secrets referenced by the annotation value, with
+	// the same keys as VaultConfigMapPolicyAnnotation. Configmap policies take precedence
+	// over secret policies.
+	VaultSecretPolicyAnnotation = "vault.hashicorp.com/secret-policy"
+	// VaultPolicyRolesAnnotation instructs the controller to merge the Vault rules of the
+	// comma-separated Roles in the service account's namespace into its policy. Roles
+	// have the lowest precedence of all policy sources.
+	VaultPolicyRolesAnnotation = "vault.hashicorp.com/policy-roles"
+	// VaultPolicyTemplateAnnotation instructs the controller to render the inline or
+	// configmap or secret policy as a Go template when set to "true". It may also be set on
+	// the referenced configmap or secret so that its policy is always rendered as a template.
+	// See vault.RenderPolicyTemplate for the available data and functions.
+	VaultPolicyTemplateAnnotation = "vault.hashicorp.com/policy-template"
+
+	// Role Annotations
+
+	// VaultPathOptionsAnnotation provides the policy settings for paths in the role's rules
+	// that cannot be expressed as a PolicyRule. The value is a JSON or YAML object keyed by
+	// path with any of the keys allowed_parameters, denied_parameters, required_parameters,
+	// min_wrapping_ttl, and max_wrapping_ttl.
+	VaultPathOptionsAnnotation = "vault.hashicorp.com/path-options"
 
 	// Annotations that can be applied to rolebindings/serviceaccounts for configuring auth roles.
+	// They may also be set on a Namespace to provide defaults for every role in it.
 	// See the API documentation for details:
 	// https://developer.hashicorp.com/vault/api-docs/auth/kubernetes#create-role
 
@@ -52,6 +122,12 @@ const (
 	VaultRoleTokenNumUsesAnnotation         = "vault.hashicorp.com/token-num-uses"
 	VaultRoleTokenPeriodAnnotation          = "vault.hashicorp.com/token-period"
 	VaultRoleTokenTypeAnnotation            = "vault.hashicorp.com/token-type"
+
+	// Annotations that only apply to roles written to JWT auth mounts.
+	// See the API documentation for details:
+	// https://developer.hashicorp.com/vault/api-docs/auth/jwt#create-update-role
+
+	VaultRoleUserClaimAnnotation = "vault.hashicorp.com/user-claim"
 )
 
 var RoleConfigAnnotations = map[string]string{
@@ -65,4 +141,5 @@ var RoleConfigAnnotations = map[string]string{
 	VaultRoleTokenNumUsesAnnotation:         "token_num_uses",
 	VaultRoleTokenPeriodAnnotation:          "token_period",
 	VaultRoleTokenTypeAnnotation:            "token_type",
+	VaultRoleUserClaimAnnotation:            "user_claim",
 }
@@ -9,10 +9,54 @@ package api
 const (
 	// VaultRBACControllerFinalizer is the finalizer added to resources managed by the controller.
 	ResourceFinalizer = "vault-rbac-controller/finalizer"
-	// VaultPolicyKey is the key in configmaps that contains the Vault policy.
+	// ManagedAuthMountsAnnotation is set by the controller to record the auth mounts
+	// a role was last written to. It is used to clean up mounts that are no longer
+	// targeted by the resource.
+	ManagedAuthMountsAnnotation = "vault-rbac-controller/auth-mounts"
+	// ManagedRoleNamespacesAnnotation is set by the controller to record the namespaces
+	// a Kubernetes auth role was last split into a role per namespace for, when a
+	// RoleBinding binds different ServiceAccounts in each namespace. It is used to
+	// clean up the roles of namespaces that are no longer bound.
+	ManagedRoleNamespacesAnnotation = "vault-rbac-controller/role-namespaces"
+	// ManagedPolicyAnnotation is set by the controller to record the name of the policy
+	// last written for a ServiceAccount. It is used to delete the policy even if the
+	// resource no longer defines it.
+	ManagedPolicyAnnotation = "vault-rbac-controller/policy"
+	// ManagedPolicySourcesAnnotation is set by the controller to record the sources the
+	// policy of a ServiceAccount was last composed from. It is used to only report the
+	// sources when they change.
+	ManagedPolicySourcesAnnotation = "vault-rbac-controller/policy-sources"
+	// ManagedPolicyConflictsAnnotation is set by the controller to record the conflicts
+	// between the rules of a Role that were last reported. It is used to only report
+	// the conflicts when they change.
+	ManagedPolicyConflictsAnnotation = "vault-rbac-controller/policy-conflicts"
+	// ManagedVaultNamespaceAnnotation is set by the controller to record the Vault
+	// namespace the policy and role of a resource were last written to. It is used to
+	// clean up the old namespace when the mapping changes, and to delete them once the
+	// Kubernetes namespace is gone.
+	ManagedVaultNamespaceAnnotation = "vault-rbac-controller/vault-namespace"
+	// ManagedConnectionAnnotation is set by the controller to record the Vault connection
+	// the policy and role of a resource were last written through, alongside the
+	// ManagedVaultNamespaceAnnotation.
+	ManagedConnectionAnnotation = "vault-rbac-controller/connection"
+	// VaultPolicyKey is the key in configmaps and secrets that contains the Vault policy.
 	VaultPolicyKey = "policy.hcl"
 
 	EventReasonIgnored = "Ignored"
 	EventReasonSynced  = "Synced"
 	EventReasonError   = "Error"
+	// EventReasonConflict is used for warnings about Role rules that had to be merged.
+	EventReasonConflict = "Conflict"
+	// EventReasonRestricted is used when a RoleBinding subject is bound more narrowly
+	// in Vault than in Kubernetes.
+	EventReasonRestricted = "Restricted"
+	// EventReasonComposed is used to report the sources a policy was composed from.
+	EventReasonComposed = "Composed"
+	// EventReasonRetained is used when the Vault objects of a deleted resource are kept.
+	EventReasonRetained = "Retained"
+	// EventReasonCleanedUp is used when the Vault objects of a deleted Namespace are removed.
+	EventReasonCleanedUp = "CleanedUp"
+	// EventReasonTombstoneFailed is used when a Vault object is deleted without keeping
+	// its tombstone.
+	EventReasonTombstoneFailed = "TombstoneFailed"
 )
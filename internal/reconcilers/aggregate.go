@@ -0,0 +1,259 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/util"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+// reconcileAggregated writes a single auth role for the serviceaccount bound to its
+// own policy and the policies of every Role bound to it by a RoleBinding.
+func (r *ServiceAccountReconciler) reconcileAggregated(ctx context.Context, sa *corev1.ServiceAccount) error {
+	var policies []string
+	if !util.IsIgnoredServiceAccount(sa) {
+		attached, err := attachedPolicies(sa, r.attachablePolicies)
+		if err != nil {
+			return err
+		}
+		if vault.HasACLs(sa) {
+			if err := r.writePolicy(ctx, sa); err != nil {
+				return err
+			}
+			policies = append(policies, r.policies.PolicyName(sa))
+		}
+		policies = append(policies, attached...)
+	}
+	bound, err := r.boundPolicies(ctx, sa)
+	if err != nil {
+		return err
+	}
+	policies = dedupe(append(policies, bound...))
+
+	if len(policies) == 0 {
+		// Remove a role written while the serviceaccount was still bound to policies
+		if err := removeRole(ctx, r.Client, r.roles, sa); err != nil {
+			return fmt.Errorf("unable to remove auth role: %w", err)
+		}
+		if err := removePolicy(ctx, r.Client, r.policies, sa); err != nil {
+			return err
+		}
+		if err := r.ownership.Forget(ctx, sa); err != nil {
+			return fmt.Errorf("unable to forget ownership of vault objects: %w", err)
+		}
+		ctrl.LoggerFrom(ctx).Info("no policies found for serviceaccount, skipping")
+		r.recorder.Event(sa, corev1.EventTypeNormal, api.EventReasonIgnored, "ServiceAccount is not bound to any Vault policies")
+		return nil
+	}
+
+	params, err := buildAuthRoleParameters(ctx, r.Client, sa, policies, r.roleDefaults)
+	if err != nil {
+		return fmt.Errorf("unable to build auth role parameters: %w", err)
+	}
+	if err := r.roles.WriteRole(ctx, sa, params); err != nil {
+		return fmt.Errorf("unable to put auth role in vault: %w", err)
+	}
+	if err := recordAuthMounts(ctx, r.Client, sa, r.roles.AuthMounts(sa)); err != nil {
+		return fmt.Errorf("unable to record auth mounts on serviceaccount: %w", err)
+	}
+	if err := r.recordLocation(ctx, sa); err != nil {
+		return err
+	}
+	// Remove the policy written before the serviceaccount stopped defining one
+	if util.IsIgnoredServiceAccount(sa) || !vault.HasACLs(sa) {
+		if err := removePolicy(ctx, r.Client, r.policies, sa); err != nil {
+			return err
+		}
+	}
+	if err := r.ownership.Record(ctx, sa, util.HasAnnotation(sa, api.ManagedPolicyAnnotation), true); err != nil {
+		return fmt.Errorf("unable to record ownership of vault objects: %w", err)
+	}
+	if err := syncFinalizer(ctx, r.Client, sa, r.useFinalizers); err != nil {
+		return fmt.Errorf("unable to update serviceaccount finalizer: %w", err)
+	}
+	r.recorder.Event(sa, corev1.EventTypeNormal, api.EventReasonSynced, "ServiceAccount synced to Vault")
+	return nil
+}
+
+// boundPolicies returns the policies of the Roles bound to the serviceaccount, along
+// with the policies attached by the RoleBindings binding them.
+func (r *ServiceAccountReconciler) boundPolicies(ctx context.Context, sa *corev1.ServiceAccount) ([]string, error) {
+	rbs, err := r.bindingsOf(ctx, sa)
+	if err != nil {
+		return nil, err
+	}
+	var policies []string
+	for _, rb := range rbs {
+		if util.IsIgnoredRoleBinding(rb) || rb.GetDeletionTimestamp() != nil || rb.RoleRef.Kind != "Role" {
+			continue
+		}
+		if !bindsServiceAccount(rb, sa) {
+			continue
+		}
+		var role rbacv1.Role
+		if err := r.Get(ctx, client.ObjectKey{Namespace: rb.GetNamespace(), Name: rb.RoleRef.Name}, &role); err != nil {
+			if client.IgnoreNotFound(err) != nil {
+				return nil, fmt.Errorf("unable to fetch role: %w", err)
+			}
+			continue
+		}
+		if !vault.HasACLs(&role) {
+			continue
+		}
+		attached, err := attachedPolicies(rb, r.attachablePolicies)
+		if err != nil {
+			return nil, fmt.Errorf("rolebinding %s/%s: %w", rb.GetNamespace(), rb.GetName(), err)
+		}
+		policies = append(policies, r.policies.PolicyName(&role))
+		policies = append(policies, attached...)
+	}
+	return policies, nil
+}
+
+// boundServiceAccountIndex is the field index of rolebindings by the serviceaccounts
+// they bind, as namespace/name keys where the name may be a wildcard.
+const boundServiceAccountIndex = "vault-rbac-controller.boundServiceAccounts"
+
+// indexBoundServiceAccounts returns the boundServiceAccountIndex keys of a rolebinding.
+func indexBoundServiceAccounts(obj client.Object) []string {
+	rb, ok := obj.(*rbacv1.RoleBinding)
+	if !ok {
+		return nil
+	}
+	var keys []string
+	for _, sub := range rb.Subjects {
+		single := rb.DeepCopy()
+		single.Subjects = []rbacv1.Subject{sub}
+		names, namespaces, _ := boundServiceAccounts(single)
+		if len(names) == 0 {
+			continue
+		}
+		keys = append(keys, namespaces[0]+"/"+names[0])
+	}
+	return dedupe(keys)
+}
+
+// bindingsOf returns the rolebindings that may bind the serviceaccount, looked up
+// through the boundServiceAccountIndex, ordered by namespace and name.
+func (r *ServiceAccountReconciler) bindingsOf(ctx context.Context, sa *corev1.ServiceAccount) ([]*rbacv1.RoleBinding, error) {
+	seen := make(map[client.ObjectKey]*rbacv1.RoleBinding)
+	for _, key := range []string{
+		sa.GetNamespace() + "/" + sa.GetName(),
+		sa.GetNamespace() + "/*",
+	} {
+		var rbs rbacv1.RoleBindingList
+		if err := r.List(ctx, &rbs, client.MatchingFields{boundServiceAccountIndex: key}); err != nil {
+			return nil, fmt.Errorf("unable to list rolebindings: %w", err)
+		}
+		for i := range rbs.Items {
+			seen[client.ObjectKeyFromObject(&rbs.Items[i])] = &rbs.Items[i]
+		}
+	}
+	out := make([]*rbacv1.RoleBinding, 0, len(seen))
+	for _, rb := range seen {
+		out = append(out, rb)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].GetNamespace() != out[j].GetNamespace() {
+			return out[i].GetNamespace() < out[j].GetNamespace()
+		}
+		return out[i].GetName() < out[j].GetName()
+	})
+	return out, nil
+}
+
+// bindsServiceAccount returns true if the serviceaccount is a subject of the rolebinding,
+// either directly or through the group of serviceaccounts it belongs to.
+func bindsServiceAccount(rb *rbacv1.RoleBinding, sa *corev1.ServiceAccount) bool {
+	names, namespaces, pairs := boundServiceAccounts(rb)
+	if pairs != nil {
+		return contains(pairs, sa.GetNamespace()+":"+sa.GetName()) || contains(pairs, sa.GetNamespace()+":*")
+	}
+	if len(names) == 0 {
+		return false
+	}
+	return (contains(names, "*") || contains(names, sa.GetName())) && contains(namespaces, sa.GetNamespace())
+}
+
+// serviceAccountsForRoleBinding returns a map function mapping a rolebinding to the
+// serviceaccounts it binds.
+func serviceAccountsForRoleBinding(reader client.Reader) func(client.Object) []reconcile.Request {
+	return func(obj client.Object) []reconcile.Request {
+		rb, ok := obj.(*rbacv1.RoleBinding)
+		if !ok {
+			return nil
+		}
+		var requests []reconcile.Request
+		for _, sub := range rb.Subjects {
+			single := rb.DeepCopy()
+			single.Subjects = []rbacv1.Subject{sub}
+			names, namespaces, _ := boundServiceAccounts(single)
+			if len(names) == 0 {
+				continue
+			}
+			if names[0] != "*" {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKey{Namespace: namespaces[0], Name: names[0]}})
+				continue
+			}
+			var sas corev1.ServiceAccountList
+			if err := reader.List(context.Background(), &sas, client.InNamespace(namespaces[0])); err != nil {
+				ctrl.Log.Error(err, "unable to list serviceaccounts for rolebinding", "namespace", rb.GetNamespace(), "name", rb.GetName())
+				continue
+			}
+			for i := range sas.Items {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&sas.Items[i])})
+			}
+		}
+		return requests
+	}
+}
+
+// serviceAccountsForRole returns a map function mapping a role to the serviceaccounts
+// bound to it by any rolebinding in its namespace.
+func serviceAccountsForRole(reader client.Reader) func(client.Object) []reconcile.Request {
+	forRoleBinding := serviceAccountsForRoleBinding(reader)
+	return func(obj client.Object) []reconcile.Request {
+		var rbs rbacv1.RoleBindingList
+		if err := reader.List(context.Background(), &rbs, client.InNamespace(obj.GetNamespace())); err != nil {
+			ctrl.Log.Error(err, "unable to list rolebindings for role", "namespace", obj.GetNamespace(), "name", obj.GetName())
+			return nil
+		}
+		var requests []reconcile.Request
+		for i := range rbs.Items {
+			rb := &rbs.Items[i]
+			if rb.RoleRef.Kind == "Role" && rb.RoleRef.Name == obj.GetName() {
+				requests = append(requests, forRoleBinding(rb)...)
+			}
+		}
+		return requests
+	}
+}
+
+// dedupe returns the strings in their original order without duplicates.
+func dedupe(in []string) []string {
+	var out []string
+	seen := make(map[string]struct{}, len(in))
+	for _, s := range in {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		out = append(out, s)
+	}
+	return out
+}
@@ -0,0 +1,129 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+func TestBoundPolicies(t *testing.T) {
+	vaultRole := func(namespace, name string) *rbacv1.Role {
+		return &rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{"vault.hashicorp.com"}, Resources: []string{"secret/*"}, Verbs: []string{"read"}}},
+		}
+	}
+	binding := func(namespace, name, role string, annotations map[string]string, subjects ...rbacv1.Subject) *rbacv1.RoleBinding {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[api.VaultRoleBindAnnotation] = "true"
+		return &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+			RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: role},
+			Subjects:   subjects,
+		}
+	}
+	app := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "app"}
+	cli := fake.NewClientBuilder().WithObjects(
+		vaultRole("team-a", "reader"),
+		vaultRole("team-a", "writer"),
+		vaultRole("team-b", "shared"),
+		vaultRole("team-a", "group-reader"),
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "kube-only"}},
+		binding("team-a", "reader", "reader", map[string]string{api.VaultAttachPoliciesAnnotation: "default"}, app),
+		binding("team-a", "writer", "writer", nil, rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "other"}, app),
+		binding("team-a", "kube-only", "kube-only", nil, app),
+		binding("team-a", "group", "group-reader", nil, rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "system:serviceaccounts:team-a"}),
+		binding("team-b", "shared", "shared", nil, rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "app", Namespace: "team-a"}),
+		binding("team-b", "same-name", "shared", nil, app),
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "unbound"},
+			RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: "reader"},
+			Subjects:   []rbacv1.Subject{app},
+		},
+	).WithIndex(&rbacv1.RoleBinding{}, boundServiceAccountIndex, indexBoundServiceAccounts).Build()
+	r := &ServiceAccountReconciler{
+		Client:             cli,
+		policies:           vault.NewPolicyManager(&vault.PolicyManagerOptions{}),
+		attachablePolicies: []string{"default"},
+	}
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app"}}
+	policies, err := r.boundPolicies(context.Background(), sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"team-a-group-reader", "team-a-reader", "default", "team-a-writer", "team-b-shared"}
+	if !reflect.DeepEqual(dedupe(policies), expected) {
+		t.Errorf("Expected policies %v, got %v", expected, policies)
+	}
+
+	r.attachablePolicies = nil
+	if _, err := r.boundPolicies(context.Background(), sa); err == nil {
+		t.Error("Expected error for a rolebinding attaching a policy that is not allowed, got nil")
+	}
+
+	keys := indexBoundServiceAccounts(binding("team-a", "mixed", "reader", nil, app,
+		rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "system:serviceaccounts:team-b"},
+		rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "system:serviceaccounts"}))
+	if expected := []string{"team-a/app", "team-b/*", "team-a/*"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected index keys %v, got %v", expected, keys)
+	}
+
+	requests := serviceAccountsForRole(cli)(vaultRole("team-b", "shared"))
+	expectedRequests := []reconcile.Request{
+		{NamespacedName: client.ObjectKey{Namespace: "team-b", Name: "app"}},
+		{NamespacedName: client.ObjectKey{Namespace: "team-a", Name: "app"}},
+	}
+	if !sameRequests(requests, expectedRequests) {
+		t.Errorf("Expected requests %v, got %v", expectedRequests, requests)
+	}
+
+	requests = serviceAccountsForRole(cli)(vaultRole("team-a", "group-reader"))
+	if len(requests) != 0 {
+		t.Errorf("Expected no requests without serviceaccounts in the group, got %v", requests)
+	}
+	if err := cli.Create(context.Background(), sa); err != nil {
+		t.Fatal(err)
+	}
+	requests = serviceAccountsForRole(cli)(vaultRole("team-a", "group-reader"))
+	expectedRequests = []reconcile.Request{{NamespacedName: client.ObjectKey{Namespace: "team-a", Name: "app"}}}
+	if !sameRequests(requests, expectedRequests) {
+		t.Errorf("Expected requests %v, got %v", expectedRequests, requests)
+	}
+}
+
+func sameRequests(a, b []reconcile.Request) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[reconcile.Request]int)
+	for _, req := range a {
+		seen[req]++
+	}
+	for _, req := range b {
+		seen[req]--
+	}
+	for _, count := range seen {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,157 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+// DefaultAuthMountSyncInterval is the default interval at which the auth mount
+// configuration is re-applied to Vault.
+const DefaultAuthMountSyncInterval = 10 * time.Minute
+
+// AuthMountOptions are the options for automatically configuring the Kubernetes
+// auth mount.
+type AuthMountOptions struct {
+	// KubernetesHost overrides the API server address written to the mount.
+	// Defaults to the host the controller is connected to.
+	KubernetesHost string
+	// Issuer is the expected issuer of service account tokens.
+	Issuer string
+	// UseTokenReviewerJWT instructs the controller to provide its own token
+	// for Vault to use against the TokenReview API.
+	UseTokenReviewerJWT bool
+	// SyncInterval is the interval at which the configuration is re-applied.
+	SyncInterval time.Duration
+}
+
+// authMountSyncer keeps a Kubernetes auth mount enabled and configured for the
+// cluster the controller is running in, in every Vault connection and namespace
+// the watched namespaces are mapped to.
+type authMountSyncer struct {
+	client     client.Reader
+	mounts     vault.AuthMountManager
+	mount      string
+	restConfig *rest.Config
+	opts       *AuthMountOptions
+	// watched returns true for objects in the namespaces watched by the controller.
+	watched func(client.Object) bool
+}
+
+func (s *authMountSyncer) Start(ctx context.Context) error {
+	interval := s.opts.SyncInterval
+	if interval <= 0 {
+		interval = DefaultAuthMountSyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.sync(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *authMountSyncer) sync(ctx context.Context) {
+	log := ctrl.LoggerFrom(ctx).WithName("auth-mount").WithValues("mount", s.mount)
+	config, err := buildKubernetesAuthConfig(s.restConfig, s.opts)
+	if err != nil {
+		log.Error(err, "unable to build auth mount configuration")
+		return
+	}
+	locations, err := s.locations(ctx)
+	if err != nil {
+		log.Error(err, "unable to resolve auth mount locations")
+		return
+	}
+	for _, loc := range locations {
+		log := log.WithValues("connection", loc.Connection, "namespace", loc.Namespace)
+		if err := s.mounts.ConfigureAuthMount(ctx, loc, s.mount, config); err != nil {
+			log.Error(err, "unable to configure auth mount")
+			continue
+		}
+		log.Info("auth mount synced to vault")
+	}
+}
+
+// locations returns the distinct locations the watched namespaces are mapped to. The
+// location of a namespace is the one of its default ServiceAccount.
+func (s *authMountSyncer) locations(ctx context.Context) ([]vault.Location, error) {
+	var namespaces corev1.NamespaceList
+	if err := s.client.List(ctx, &namespaces); err != nil {
+		return nil, fmt.Errorf("unable to list namespaces: %w", err)
+	}
+	var locations []vault.Location
+	seen := make(map[vault.Location]struct{})
+	for _, ns := range namespaces.Items {
+		sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: ns.GetName(), Name: "default"}}
+		if !s.watched(sa) {
+			continue
+		}
+		loc, err := s.mounts.Location(ctx, sa)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %s: %w", ns.GetName(), err)
+		}
+		if _, ok := seen[loc]; ok {
+			continue
+		}
+		seen[loc] = struct{}{}
+		locations = append(locations, loc)
+	}
+	return locations, nil
+}
+
+func buildKubernetesAuthConfig(cfg *rest.Config, opts *AuthMountOptions) (*vault.KubernetesAuthConfig, error) {
+	config := &vault.KubernetesAuthConfig{
+		Host:   cfg.Host,
+		CACert: string(cfg.CAData),
+		Issuer: opts.Issuer,
+		// The controller owns the configuration, don't let Vault fall back
+		// to the cluster it may be running in.
+		DisableLocalCAJWT: true,
+	}
+	if opts.KubernetesHost != "" {
+		config.Host = opts.KubernetesHost
+	}
+	if config.CACert == "" && cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+		config.CACert = string(ca)
+	}
+	if opts.UseTokenReviewerJWT {
+		// Read the token file on every sync so rotated tokens are picked up
+		config.TokenReviewerJWT = cfg.BearerToken
+		if cfg.BearerTokenFile != "" {
+			token, err := os.ReadFile(cfg.BearerTokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read token file: %w", err)
+			}
+			config.TokenReviewerJWT = string(token)
+		}
+		if config.TokenReviewerJWT == "" {
+			return nil, errors.New("no token available to use as the token reviewer JWT")
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,137 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+func TestBuildKubernetesAuthConfig(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(caFile, []byte("file-ca"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tokenFile, []byte("file-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name      string
+		cfg       *rest.Config
+		opts      *AuthMountOptions
+		host      string
+		ca        string
+		token     string
+		shouldErr bool
+	}{
+		{
+			name: "inline data",
+			cfg:  &rest.Config{Host: "https://10.0.0.1:443", TLSClientConfig: rest.TLSClientConfig{CAData: []byte("inline-ca")}},
+			opts: &AuthMountOptions{},
+			host: "https://10.0.0.1:443",
+			ca:   "inline-ca",
+		},
+		{
+			name: "files and host override",
+			cfg: &rest.Config{
+				Host:            "https://10.0.0.1:443",
+				BearerTokenFile: tokenFile,
+				TLSClientConfig: rest.TLSClientConfig{CAFile: caFile},
+			},
+			opts:  &AuthMountOptions{KubernetesHost: "https://kubernetes.example.com", UseTokenReviewerJWT: true},
+			host:  "https://kubernetes.example.com",
+			ca:    "file-ca",
+			token: "file-token",
+		},
+		{
+			name:      "missing token",
+			cfg:       &rest.Config{Host: "https://10.0.0.1:443"},
+			opts:      &AuthMountOptions{UseTokenReviewerJWT: true},
+			shouldErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := buildKubernetesAuthConfig(tc.cfg, tc.opts)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatal("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if config.Host != tc.host {
+				t.Errorf("Expected host %s, got %s", tc.host, config.Host)
+			}
+			if config.CACert != tc.ca {
+				t.Errorf("Expected CA %s, got %s", tc.ca, config.CACert)
+			}
+			if config.TokenReviewerJWT != tc.token {
+				t.Errorf("Expected token %s, got %s", tc.token, config.TokenReviewerJWT)
+			}
+		})
+	}
+}
+
+// recordingMountManager maps namespaces to locations by name and records the
+// locations mounts are configured in.
+type recordingMountManager struct {
+	configured []vault.Location
+}
+
+func (m *recordingMountManager) Location(_ context.Context, obj client.Object) (vault.Location, error) {
+	if obj.GetNamespace() == "payments" {
+		return vault.Location{Connection: "prod", Namespace: "payments"}, nil
+	}
+	return vault.Location{Connection: "prod"}, nil
+}
+
+func (m *recordingMountManager) ConfigureAuthMount(_ context.Context, loc vault.Location, _ string, _ *vault.KubernetesAuthConfig) error {
+	m.configured = append(m.configured, loc)
+	return nil
+}
+
+func TestAuthMountSyncerLocations(t *testing.T) {
+	cli := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "example"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}},
+	).Build()
+	mounts := &recordingMountManager{}
+	syncer := &authMountSyncer{
+		client:     cli,
+		mounts:     mounts,
+		mount:      "kubernetes",
+		restConfig: &rest.Config{Host: "https://10.0.0.1:443"},
+		opts:       &AuthMountOptions{},
+		watched: func(obj client.Object) bool {
+			return checkObject(obj, nil, nil, false)
+		},
+	}
+	syncer.sync(context.Background())
+	expected := []vault.Location{{Connection: "prod"}, {Connection: "prod", Namespace: "payments"}}
+	if !reflect.DeepEqual(mounts.configured, expected) {
+		t.Errorf("Expected the mount to be configured in %v, got %v", expected, mounts.configured)
+	}
+}
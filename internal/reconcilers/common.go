@@ -8,16 +8,22 @@ package reconcilers
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"path"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/yaml"
 
 	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/util"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
 )
 
 func addFinalizer(ctx context.Context, cli client.Client, obj client.Object) error {
@@ -30,29 +36,234 @@ func removeFinalizer(ctx context.Context, cli client.Client, obj client.Object)
 	return cli.Update(ctx, obj)
 }
 
-func buildAuthRoleParameters(ctx context.Context, cli client.Client, obj client.Object, policies []string) (map[string]interface{}, error) {
-	var saNames []string
+// recordAuthMounts records the auth mounts a role was written to on the object.
+func recordAuthMounts(ctx context.Context, cli client.Client, obj client.Object, mounts []string) error {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	recorded := strings.Join(mounts, ",")
+	if current, ok := annotations[api.ManagedAuthMountsAnnotation]; ok && current == recorded {
+		return nil
+	}
+	annotations[api.ManagedAuthMountsAnnotation] = recorded
+	obj.SetAnnotations(annotations)
+	return cli.Update(ctx, obj)
+}
+
+// recordRoleNamespaces records the namespaces a role was split into a role per
+// namespace for on the object, or clears the record if it was written as one role.
+func recordRoleNamespaces(ctx context.Context, cli client.Client, obj client.Object, namespaces []string) error {
+	annotations := obj.GetAnnotations()
+	current, ok := annotations[api.ManagedRoleNamespacesAnnotation]
+	recorded := strings.Join(namespaces, ",")
+	if len(namespaces) == 0 {
+		if !ok {
+			return nil
+		}
+		delete(annotations, api.ManagedRoleNamespacesAnnotation)
+	} else {
+		if ok && current == recorded {
+			return nil
+		}
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[api.ManagedRoleNamespacesAnnotation] = recorded
+	}
+	obj.SetAnnotations(annotations)
+	return cli.Update(ctx, obj)
+}
+
+// recordLocation records the location in Vault the policy and role of the object were
+// written to on it.
+func recordLocation(ctx context.Context, cli client.Client, obj client.Object, loc vault.Location) error {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	changed := false
+	for k, v := range loc.Annotations() {
+		if current, ok := annotations[k]; !ok || current != v {
+			annotations[k] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	obj.SetAnnotations(annotations)
+	return cli.Update(ctx, obj)
+}
+
+// recordPolicy records the name of the policy written for the object on it.
+func recordPolicy(ctx context.Context, cli client.Client, obj client.Object, name string) error {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	if current, ok := annotations[api.ManagedPolicyAnnotation]; ok && current == name {
+		return nil
+	}
+	annotations[api.ManagedPolicyAnnotation] = name
+	obj.SetAnnotations(annotations)
+	return cli.Update(ctx, obj)
+}
+
+// recordPolicyConflicts records the conflicts between the rules of the object on it,
+// and returns whether they changed since they were last recorded.
+func recordPolicyConflicts(ctx context.Context, cli client.Client, obj client.Object, conflicts []string) (bool, error) {
+	annotations := obj.GetAnnotations()
+	current, ok := annotations[api.ManagedPolicyConflictsAnnotation]
+	if len(conflicts) == 0 {
+		if !ok {
+			return false, nil
+		}
+		delete(annotations, api.ManagedPolicyConflictsAnnotation)
+		obj.SetAnnotations(annotations)
+		return true, cli.Update(ctx, obj)
+	}
+	recorded := strings.Join(conflicts, "\n")
+	if ok && current == recorded {
+		return false, nil
+	}
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[api.ManagedPolicyConflictsAnnotation] = recorded
+	obj.SetAnnotations(annotations)
+	return true, cli.Update(ctx, obj)
+}
+
+// recordPolicySources records the sources the policy of the object was composed from
+// on it, and returns whether they changed. Policies with a single source are not
+// recorded.
+func recordPolicySources(ctx context.Context, cli client.Client, obj client.Object, sources []string) (bool, error) {
+	annotations := obj.GetAnnotations()
+	current, ok := annotations[api.ManagedPolicySourcesAnnotation]
+	if len(sources) < 2 {
+		if !ok {
+			return false, nil
+		}
+		delete(annotations, api.ManagedPolicySourcesAnnotation)
+		obj.SetAnnotations(annotations)
+		return true, cli.Update(ctx, obj)
+	}
+	recorded := strings.Join(sources, ", ")
+	if ok && current == recorded {
+		return false, nil
+	}
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[api.ManagedPolicySourcesAnnotation] = recorded
+	obj.SetAnnotations(annotations)
+	return true, cli.Update(ctx, obj)
+}
+
+// managedPolicyObject returns the object named after the policy recorded for it, if
+// any, so that the policy last written is deleted even if the object changed since.
+func managedPolicyObject(obj client.Object) client.Object {
+	name, ok := obj.GetAnnotations()[api.ManagedPolicyAnnotation]
+	if !ok {
+		return obj
+	}
+	out := obj.DeepCopyObject().(client.Object)
+	annotations := out.GetAnnotations()
+	annotations[api.VaultPolicyNameAnnotation] = name
+	out.SetAnnotations(annotations)
+	return out
+}
+
+// removePolicy deletes the policy recorded for the object once it no longer defines
+// one, and clears the record.
+func removePolicy(ctx context.Context, cli client.Client, policies vault.PolicyManager, obj client.Object) error {
+	if !util.HasAnnotation(obj, api.ManagedPolicyAnnotation) {
+		return nil
+	}
+	if err := policies.DeletePolicy(ctx, managedPolicyObject(obj)); err != nil {
+		return fmt.Errorf("unable to delete policy in vault: %w", err)
+	}
+	annotations := obj.GetAnnotations()
+	delete(annotations, api.ManagedPolicyAnnotation)
+	delete(annotations, api.ManagedPolicySourcesAnnotation)
+	obj.SetAnnotations(annotations)
+	return cli.Update(ctx, obj)
+}
+
+// removeRole deletes the role written for the object, if any, and clears the
+// finalizer and auth mounts recorded for it.
+func removeRole(ctx context.Context, cli client.Client, roles vault.RoleManager, obj client.Object) error {
+	if !util.HasAnnotation(obj, api.ManagedAuthMountsAnnotation) && !controllerutil.ContainsFinalizer(obj, api.ResourceFinalizer) {
+		return nil
+	}
+	if err := roles.DeleteRole(ctx, obj); err != nil {
+		return fmt.Errorf("unable to delete auth role in vault: %w", err)
+	}
+	annotations := obj.GetAnnotations()
+	delete(annotations, api.ManagedAuthMountsAnnotation)
+	delete(annotations, api.ManagedRoleNamespacesAnnotation)
+	obj.SetAnnotations(annotations)
+	controllerutil.RemoveFinalizer(obj, api.ResourceFinalizer)
+	return cli.Update(ctx, obj)
+}
+
+// attachedPolicies returns the existing Vault policies the object attaches to its
+// role. Every policy must match one of the allowed names or glob patterns.
+func attachedPolicies(obj client.Object, allowed []string) ([]string, error) {
+	policies := util.SplitList(obj.GetAnnotations()[api.VaultAttachPoliciesAnnotation])
+	for _, policy := range policies {
+		if !policyAllowed(policy, allowed) {
+			return nil, fmt.Errorf("policy %q is not allowed to be attached", policy)
+		}
+	}
+	return policies, nil
+}
+
+func policyAllowed(policy string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if ok, _ := path.Match(pattern, policy); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// buildAuthRoleParameters returns the parameters of the auth role for the object. The
+// parameters are resolved from the controller defaults, the annotations on the object's
+// namespace, the referenced configmap and secret and the annotations on the object, each
+// overriding the last, before the maximums of the defaults are enforced.
+func buildAuthRoleParameters(ctx context.Context, cli client.Client, obj client.Object, policies []string, defaults *vault.RoleDefaultsConfig) (map[string]interface{}, error) {
+	var saNames, saNamespaces, saPairs []string
 	switch obj := obj.(type) {
 	case *rbacv1.RoleBinding:
-		for _, sub := range obj.Subjects {
-			if sub.Kind == "ServiceAccount" {
-				saNames = append(saNames, sub.Name)
-			}
-		}
+		saNames, saNamespaces, saPairs = boundServiceAccounts(obj)
 	case *corev1.ServiceAccount:
 		saNames = []string{obj.GetName()}
+		saNamespaces = []string{obj.GetNamespace()}
 	default:
 		return nil, errors.New("unknown object type")
 	}
-	params := map[string]interface{}{
-		"bound_service_account_names":      saNames,
-		"bound_service_account_namespaces": []string{obj.GetNamespace()},
-		"policies":                         policies,
+	params, err := defaults.DefaultsFor(obj.GetNamespace())
+	if err != nil {
+		return nil, fmt.Errorf("invalid role defaults: %w", err)
 	}
-	annotations := obj.GetAnnotations()
-	if annotations == nil {
-		return params, nil
+	if saPairs != nil {
+		params[vault.BoundServiceAccountsParameter] = saPairs
+	} else {
+		params["bound_service_account_names"] = saNames
+		params["bound_service_account_namespaces"] = saNamespaces
+	}
+	params["policies"] = policies
+	// Apply the defaults of the namespace
+	var ns corev1.Namespace
+	if err := cli.Get(ctx, client.ObjectKey{Name: obj.GetNamespace()}, &ns); client.IgnoreNotFound(err) != nil {
+		return nil, fmt.Errorf("unable to fetch namespace: %w", err)
+	}
+	if err := applyRoleAnnotations(params, &ns); err != nil {
+		return nil, fmt.Errorf("namespace %q: %w", ns.GetName(), err)
 	}
+	annotations := obj.GetAnnotations()
 	// Check if a configmap is specified
 	if configmap, ok := annotations[api.VaultRoleConfigMapAnnotation]; ok {
 		var cm corev1.ConfigMap
@@ -60,15 +271,194 @@ func buildAuthRoleParameters(ctx context.Context, cli client.Client, obj client.
 			return nil, fmt.Errorf("unable to fetch configmap: %w", err)
 		}
 		for k, v := range cm.Data {
+			if isPolicyKey(k) {
+				// Policies may be kept alongside the role parameters
+				continue
+			}
+			param := strings.Replace(k, "-", "_", -1)
+			val, err := vault.ParseRoleParameter(param, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %q in configmap %q: %w", k, configmap, err)
+			}
+			params[param] = val
+		}
+	}
+	// Check if a secret is specified
+	if name, ok := annotations[api.VaultRoleSecretAnnotation]; ok {
+		var secret corev1.Secret
+		if err := cli.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: name}, &secret); err != nil {
+			return nil, fmt.Errorf("unable to fetch secret: %w", err)
+		}
+		for k, v := range secret.Data {
+			if isPolicyKey(k) {
+				// Policies may be kept alongside the role parameters
+				continue
+			}
 			param := strings.Replace(k, "-", "_", -1)
-			params[param] = v
+			val, err := vault.ParseRoleParameter(param, string(v))
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %q in secret %q: %w", k, name, err)
+			}
+			params[param] = val
 		}
 	}
 	// Check other annotations
+	if err := applyRoleAnnotations(params, obj); err != nil {
+		return nil, err
+	}
+	// A namespace selector replaces the literal list of namespaces
+	if selector, ok := annotations[api.VaultNamespaceSelectorAnnotation]; ok {
+		sel, err := namespaceSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		params[vault.NamespaceSelectorParameter] = sel
+		delete(params, "bound_service_account_namespaces")
+	}
+	if err := defaults.Enforce(obj.GetNamespace(), params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// isPolicyKey returns true for the keys of configmaps and secrets holding policies
+// rather than auth role parameters.
+func isPolicyKey(key string) bool {
+	return key == api.VaultPolicyKey || strings.HasSuffix(key, ".hcl")
+}
+
+// applyRoleAnnotations sets the auth role parameters given by the annotations on the object.
+func applyRoleAnnotations(params map[string]interface{}, obj client.Object) error {
+	annotations := obj.GetAnnotations()
 	for toCheck, param := range api.RoleConfigAnnotations {
-		if val, ok := annotations[toCheck]; ok {
+		if raw, ok := annotations[toCheck]; ok {
+			val, err := vault.ParseRoleParameter(param, raw)
+			if err != nil {
+				return fmt.Errorf("invalid annotation %q: %w", toCheck, err)
+			}
 			params[param] = val
 		}
 	}
-	return params, nil
+	return nil
+}
+
+// namespaceSelector parses a label selector given either as a selector string or as
+// a JSON or YAML LabelSelector, and returns it as the JSON expected by Vault.
+func namespaceSelector(raw string) (string, error) {
+	var selector *metav1.LabelSelector
+	trimmed := strings.TrimSpace(raw)
+	if strings.HasPrefix(trimmed, "{") || strings.Contains(trimmed, "matchLabels:") || strings.Contains(trimmed, "matchExpressions:") {
+		selector = &metav1.LabelSelector{}
+		if err := yaml.UnmarshalStrict([]byte(trimmed), selector); err != nil {
+			return "", fmt.Errorf("invalid namespace selector: %w", err)
+		}
+	} else {
+		var err error
+		selector, err = metav1.ParseToLabelSelector(trimmed)
+		if err != nil {
+			return "", fmt.Errorf("invalid namespace selector: %w", err)
+		}
+	}
+	if len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0 {
+		return "", errors.New("namespace selector must not be empty")
+	}
+	if _, err := metav1.LabelSelectorAsSelector(selector); err != nil {
+		return "", fmt.Errorf("invalid namespace selector: %w", err)
+	}
+	out, err := json.Marshal(selector)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal namespace selector: %w", err)
+	}
+	return string(out), nil
+}
+
+// serviceAccountGroupPrefix is the prefix of the groups of all serviceaccounts in a namespace,
+// and the group of all serviceaccounts in the cluster.
+const serviceAccountGroupPrefix = "system:serviceaccounts"
+
+// serviceAccountUserPrefix is the prefix of the username of a serviceaccount.
+const serviceAccountUserPrefix = "system:serviceaccount:"
+
+// boundServiceAccounts returns the serviceaccount names and namespaces bound by the
+// rolebinding. Subjects without a namespace are in the namespace of the rolebinding.
+// Groups of serviceaccounts in a namespace are bound with a wildcard name. The group
+// of all serviceaccounts is only bound in the namespace of the rolebinding, see
+// bindsAllServiceAccounts. Vault binds every name in every namespace, so if the subjects do not
+// bind the same names in each of their namespaces, no names or namespaces are returned
+// and the serviceaccounts are returned as namespace:name pairs instead.
+func boundServiceAccounts(rb *rbacv1.RoleBinding) (names, namespaces, pairs []string) {
+	bound := make(map[string][]string)
+	add := func(namespace, name string) {
+		if _, ok := bound[namespace]; !ok {
+			namespaces = append(namespaces, namespace)
+		}
+		if !contains(bound[namespace], name) {
+			bound[namespace] = append(bound[namespace], name)
+		}
+	}
+	for _, sub := range rb.Subjects {
+		switch sub.Kind {
+		case rbacv1.ServiceAccountKind:
+			namespace := sub.Namespace
+			if namespace == "" {
+				namespace = rb.GetNamespace()
+			}
+			add(namespace, sub.Name)
+		case rbacv1.GroupKind:
+			if sub.Name == serviceAccountGroupPrefix {
+				add(rb.GetNamespace(), "*")
+			} else if namespace := strings.TrimPrefix(sub.Name, serviceAccountGroupPrefix+":"); namespace != sub.Name && namespace != "" && namespace != "*" {
+				add(namespace, "*")
+			}
+		case rbacv1.UserKind:
+			parts := strings.Split(strings.TrimPrefix(sub.Name, serviceAccountUserPrefix), ":")
+			if strings.HasPrefix(sub.Name, serviceAccountUserPrefix) && len(parts) == 2 && !contains(parts, "*") {
+				add(parts[0], parts[1])
+			}
+		}
+	}
+	if len(namespaces) == 0 {
+		return nil, []string{rb.GetNamespace()}, nil
+	}
+	// A wildcard name covers every other name in the namespace
+	for namespace, names := range bound {
+		if contains(names, "*") {
+			bound[namespace] = []string{"*"}
+		}
+	}
+	first := bound[namespaces[0]]
+	for _, namespace := range namespaces[1:] {
+		if !sameElements(bound[namespace], first) {
+			for _, namespace := range namespaces {
+				for _, name := range bound[namespace] {
+					pairs = append(pairs, namespace+":"+name)
+				}
+			}
+			return nil, nil, pairs
+		}
+	}
+	return first, namespaces, nil
+}
+
+// bindsAllServiceAccounts returns true if the rolebinding has the group of all
+// serviceaccounts in the cluster as a subject, which is only bound in its namespace.
+func bindsAllServiceAccounts(rb *rbacv1.RoleBinding) bool {
+	for _, sub := range rb.Subjects {
+		if sub.Kind == rbacv1.GroupKind && sub.Name == serviceAccountGroupPrefix {
+			return true
+		}
+	}
+	return false
+}
+
+func sameElements(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, s := range a {
+		if !contains(b, s) {
+			return false
+		}
+	}
+	return true
 }
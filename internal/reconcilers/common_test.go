@@ -0,0 +1,342 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+func TestAttachedPolicies(t *testing.T) {
+	allowed := []string{"default-secrets-reader", "shared-*"}
+	tt := []struct {
+		annotation string
+		want       []string
+		shouldErr  bool
+	}{
+		{annotation: "", want: nil},
+		{annotation: "default-secrets-reader", want: []string{"default-secrets-reader"}},
+		{annotation: "default-secrets-reader, shared-pki", want: []string{"default-secrets-reader", "shared-pki"}},
+		{annotation: "root", shouldErr: true},
+		{annotation: "shared-pki,admin", shouldErr: true},
+	}
+	for _, tc := range tt {
+		sa := &corev1.ServiceAccount{}
+		if tc.annotation != "" {
+			sa.SetAnnotations(map[string]string{api.VaultAttachPoliciesAnnotation: tc.annotation})
+		}
+		policies, err := attachedPolicies(sa, allowed)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Expected error for %q, got nil", tc.annotation)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error for %q, got %s", tc.annotation, err)
+			continue
+		}
+		if !reflect.DeepEqual(policies, tc.want) {
+			t.Errorf("Expected %v for %q, got %v", tc.want, tc.annotation, policies)
+		}
+	}
+
+	sa := &corev1.ServiceAccount{}
+	sa.SetAnnotations(map[string]string{api.VaultAttachPoliciesAnnotation: "default-secrets-reader"})
+	if _, err := attachedPolicies(sa, nil); err == nil {
+		t.Error("Expected error when no policies are attachable, got nil")
+	}
+}
+
+func TestBoundServiceAccounts(t *testing.T) {
+	sa := func(namespace, name string) rbacv1.Subject {
+		return rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: namespace, Name: name}
+	}
+	group := func(name string) rbacv1.Subject {
+		return rbacv1.Subject{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: name}
+	}
+	tt := []struct {
+		name           string
+		subjects       []rbacv1.Subject
+		wantNames      []string
+		wantNamespaces []string
+		wantPairs      []string
+	}{
+		{name: "no subjects", wantNamespaces: []string{"default"}},
+		{name: "local serviceaccounts", subjects: []rbacv1.Subject{sa("", "foo"), sa("default", "bar")},
+			wantNames: []string{"foo", "bar"}, wantNamespaces: []string{"default"}},
+		{name: "cross-namespace serviceaccount", subjects: []rbacv1.Subject{sa("other", "foo")},
+			wantNames: []string{"foo"}, wantNamespaces: []string{"other"}},
+		{name: "same name in multiple namespaces", subjects: []rbacv1.Subject{sa("", "foo"), sa("other", "foo")},
+			wantNames: []string{"foo"}, wantNamespaces: []string{"default", "other"}},
+		{name: "serviceaccount user", subjects: []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "system:serviceaccount:other:foo"}},
+			wantNames: []string{"foo"}, wantNamespaces: []string{"other"}},
+		{name: "namespace group", subjects: []rbacv1.Subject{group("system:serviceaccounts:other"), sa("other", "foo")},
+			wantNames: []string{"*"}, wantNamespaces: []string{"other"}},
+		{name: "all serviceaccounts group", subjects: []rbacv1.Subject{sa("", "foo"), group("system:serviceaccounts")},
+			wantNames: []string{"*"}, wantNamespaces: []string{"default"}},
+		{name: "wildcard namespace group", subjects: []rbacv1.Subject{group("system:serviceaccounts:*")},
+			wantNamespaces: []string{"default"}},
+		{name: "wildcard serviceaccount user", subjects: []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "system:serviceaccount:*:*"}},
+			wantNamespaces: []string{"default"}},
+		{name: "unrelated subjects", subjects: []rbacv1.Subject{group("system:authenticated"), {Kind: rbacv1.UserKind, Name: "jane"}},
+			wantNamespaces: []string{"default"}},
+		{name: "different names per namespace", subjects: []rbacv1.Subject{sa("", "foo"), sa("other", "bar")},
+			wantPairs: []string{"default:foo", "other:bar"}},
+		{name: "group and serviceaccount in different namespaces",
+			subjects:  []rbacv1.Subject{group("system:serviceaccounts:other"), sa("", "foo"), sa("other", "bar")},
+			wantPairs: []string{"other:*", "default:foo"}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			rb := &rbacv1.RoleBinding{Subjects: tc.subjects}
+			rb.SetNamespace("default")
+			names, namespaces, pairs := boundServiceAccounts(rb)
+			if !reflect.DeepEqual(pairs, tc.wantPairs) {
+				t.Errorf("Expected pairs %v, got %v", tc.wantPairs, pairs)
+			}
+			if !reflect.DeepEqual(names, tc.wantNames) || !reflect.DeepEqual(namespaces, tc.wantNamespaces) {
+				t.Errorf("Expected %v in %v, got %v in %v", tc.wantNames, tc.wantNamespaces, names, namespaces)
+			}
+		})
+	}
+	rb := &rbacv1.RoleBinding{Subjects: []rbacv1.Subject{group("system:serviceaccounts:default")}}
+	if bindsAllServiceAccounts(rb) {
+		t.Error("Expected the group of a namespace not to bind all serviceaccounts")
+	}
+	rb.Subjects = append(rb.Subjects, group("system:serviceaccounts"))
+	if !bindsAllServiceAccounts(rb) {
+		t.Error("Expected the group of all serviceaccounts to be reported")
+	}
+}
+
+func TestNamespaceSelector(t *testing.T) {
+	tt := []struct {
+		selector  string
+		want      string
+		shouldErr bool
+	}{
+		{selector: "team=payments", want: `{"matchLabels":{"team":"payments"}}`},
+		{selector: "team in (payments, billing)", want: `{"matchExpressions":[{"key":"team","operator":"In","values":["billing","payments"]}]}`},
+		{selector: `{"matchLabels": {"team": "payments"}}`, want: `{"matchLabels":{"team":"payments"}}`},
+		{selector: "matchLabels:\n  team: payments\n", want: `{"matchLabels":{"team":"payments"}}`},
+		{selector: "", shouldErr: true},
+		{selector: "{}", shouldErr: true},
+		{selector: "team in (", shouldErr: true},
+		{selector: `{"matchLabels": {"team": "payments"}, "unknown": true}`, shouldErr: true},
+	}
+	for _, tc := range tt {
+		out, err := namespaceSelector(tc.selector)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Expected error for %q, got %s", tc.selector, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error for %q, got %s", tc.selector, err)
+			continue
+		}
+		if out != tc.want {
+			t.Errorf("Expected %s for %q, got %s", tc.want, tc.selector, out)
+		}
+	}
+}
+
+func TestBuildAuthRoleParametersWithNamespaceSelector(t *testing.T) {
+	rb := &rbacv1.RoleBinding{Subjects: []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "app"}}}
+	rb.SetNamespace("platform")
+	rb.SetAnnotations(map[string]string{api.VaultNamespaceSelectorAnnotation: "team=payments"})
+	params, err := buildAuthRoleParameters(context.Background(), fake.NewClientBuilder().Build(), rb, []string{"policy"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := params["bound_service_account_namespaces"]; ok {
+		t.Errorf("Expected the namespace list to be replaced by the selector, got %v", params)
+	}
+	if params[vault.NamespaceSelectorParameter] != `{"matchLabels":{"team":"payments"}}` {
+		t.Errorf("Expected the namespace selector to be set, got %v", params)
+	}
+}
+
+func TestBuildAuthRoleParametersWithServiceAccountPairs(t *testing.T) {
+	rb := &rbacv1.RoleBinding{Subjects: []rbacv1.Subject{
+		{Kind: rbacv1.ServiceAccountKind, Name: "app"},
+		{Kind: rbacv1.ServiceAccountKind, Namespace: "other", Name: "worker"},
+	}}
+	rb.SetNamespace("platform")
+	params, err := buildAuthRoleParameters(context.Background(), fake.NewClientBuilder().Build(), rb, []string{"policy"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"platform:app", "other:worker"}; !reflect.DeepEqual(params[vault.BoundServiceAccountsParameter], expected) {
+		t.Errorf("Expected serviceaccount pairs %v, got %v", expected, params)
+	}
+	if _, ok := params["bound_service_account_names"]; ok {
+		t.Errorf("Expected no list of names with serviceaccount pairs, got %v", params)
+	}
+	if expected := []string{"platform", "other"}; !reflect.DeepEqual(vault.RoleNamespaces(params), expected) {
+		t.Errorf("Expected role namespaces %v, got %v", expected, vault.RoleNamespaces(params))
+	}
+}
+
+func TestBuildAuthRoleParametersFromConfigMap(t *testing.T) {
+	configMap := func(name string, data map[string]string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}, Data: data}
+	}
+	cli := fake.NewClientBuilder().WithObjects(
+		configMap("valid", map[string]string{"token-ttl": "1h", "token_bound_cidrs": "10.0.0.0/8", "token-no-default-policy": "true"}),
+		configMap("owned", map[string]string{"policies": "root"}),
+		configMap("unknown", map[string]string{"token-tll": "1h"}),
+		configMap("shared", map[string]string{"token-ttl": "1h", api.VaultPolicyKey: `path "secret/*" {}`, "extra.hcl": `path "kv/*" {}`}),
+	).Build()
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"}}
+
+	sa.SetAnnotations(map[string]string{api.VaultRoleConfigMapAnnotation: "valid", api.VaultRoleTokenTTLAnnotation: "30m"})
+	params, err := buildAuthRoleParameters(context.Background(), cli, sa, []string{"policy"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"bound_service_account_names":      []string{"app"},
+		"bound_service_account_namespaces": []string{"default"},
+		"policies":                         []string{"policy"},
+		"token_ttl":                        1800,
+		"token_bound_cidrs":                []string{"10.0.0.0/8"},
+		"token_no_default_policy":          true,
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("Expected %v, got %v", expected, params)
+	}
+
+	// Policy keys of a configmap shared with the policy are not role parameters
+	sa.SetAnnotations(map[string]string{api.VaultRoleConfigMapAnnotation: "shared"})
+	params, err = buildAuthRoleParameters(context.Background(), cli, sa, []string{"policy"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["token_ttl"] != 3600 {
+		t.Errorf("Expected token_ttl from the shared configmap, got %v", params)
+	}
+
+	for _, name := range []string{"owned", "unknown"} {
+		sa.SetAnnotations(map[string]string{api.VaultRoleConfigMapAnnotation: name})
+		if _, err := buildAuthRoleParameters(context.Background(), cli, sa, []string{"policy"}, nil); err == nil {
+			t.Errorf("Expected error for configmap %q, got nil", name)
+		}
+	}
+
+	sa.SetAnnotations(map[string]string{api.VaultRoleTokenNumUsesAnnotation: "many"})
+	if _, err := buildAuthRoleParameters(context.Background(), cli, sa, []string{"policy"}, nil); err == nil {
+		t.Error("Expected error for an invalid annotation, got nil")
+	}
+}
+
+func TestBuildAuthRoleParametersWithDefaults(t *testing.T) {
+	defaults := &vault.RoleDefaultsConfig{
+		Defaults: map[string]string{"token_ttl": "1h", "token_type": "service", "token_num_uses": "10"},
+		Maximums: map[string]string{"token_max_ttl": "24h"},
+		Namespaces: map[string]*vault.RoleNamespaceDefaults{
+			"payments": {
+				Defaults: map[string]string{"token_type": "batch"},
+				Maximums: map[string]string{"token_max_ttl": "12h", "token_ttl": "2h"},
+			},
+		},
+	}
+	cli := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Annotations: map[string]string{
+			api.VaultRoleTokenTTLAnnotation:     "30m",
+			api.VaultRoleTokenNumUsesAnnotation: "5",
+		}}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "payments", Name: "params"}, Data: map[string]string{"token-num-uses": "3"}},
+	).Build()
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "payments", Name: "app", Annotations: map[string]string{
+		api.VaultRoleConfigMapAnnotation:   "params",
+		api.VaultRoleTokenMaxTTLAnnotation: "6h",
+	}}}
+	params, err := buildAuthRoleParameters(context.Background(), cli, sa, []string{"policy"}, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for param, want := range map[string]interface{}{
+		"token_type":     "batch",
+		"token_ttl":      1800,
+		"token_num_uses": 3,
+		"token_max_ttl":  21600,
+	} {
+		if params[param] != want {
+			t.Errorf("Expected %s to be %v, got %v", param, want, params[param])
+		}
+	}
+
+	// Unset maximums are enforced as the maximum
+	sa.SetAnnotations(nil)
+	params, err = buildAuthRoleParameters(context.Background(), cli, sa, []string{"policy"}, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["token_max_ttl"] != 43200 {
+		t.Errorf("Expected token_max_ttl to default to the namespace maximum, got %v", params["token_max_ttl"])
+	}
+
+	// Overrides exceeding the maximum are rejected unless clamped
+	sa.SetAnnotations(map[string]string{api.VaultRoleTokenMaxTTLAnnotation: "48h"})
+	if _, err := buildAuthRoleParameters(context.Background(), cli, sa, []string{"policy"}, defaults); err == nil {
+		t.Error("Expected error for a parameter exceeding the maximum, got nil")
+	}
+	defaults.Clamp = true
+	params, err = buildAuthRoleParameters(context.Background(), cli, sa, []string{"policy"}, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["token_max_ttl"] != 43200 {
+		t.Errorf("Expected token_max_ttl to be clamped to the namespace maximum, got %v", params["token_max_ttl"])
+	}
+
+	// Other namespaces only use the cluster-wide defaults and maximums
+	sa.SetNamespace("default")
+	params, err = buildAuthRoleParameters(context.Background(), cli, sa, []string{"policy"}, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["token_type"] != "service" || params["token_ttl"] != 3600 || params["token_max_ttl"] != 86400 {
+		t.Errorf("Expected cluster-wide defaults, got %v", params)
+	}
+}
+
+func TestRecordPolicySources(t *testing.T) {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"}}
+	cli := fake.NewClientBuilder().WithObjects(sa).Build()
+	sources := []string{"annotation", "ConfigMap policies key policy.hcl"}
+	for i, expected := range []bool{true, false} {
+		changed, err := recordPolicySources(context.Background(), cli, sa, sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != expected {
+			t.Errorf("Expected changed to be %v on record %d, got %v", expected, i, changed)
+		}
+	}
+	if changed, err := recordPolicySources(context.Background(), cli, sa, sources[:1]); err != nil || !changed {
+		t.Errorf("Expected a single source to clear the record, got %v, %v", changed, err)
+	}
+	if _, ok := sa.GetAnnotations()[api.ManagedPolicySourcesAnnotation]; ok {
+		t.Errorf("Expected no recorded sources, got %v", sa.GetAnnotations())
+	}
+	if changed, err := recordPolicySources(context.Background(), cli, sa, sources[:1]); err != nil || changed {
+		t.Errorf("Expected no change for a single source, got %v, %v", changed, err)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+// PendingDeletionsConfigMap is the name of the ConfigMap in the controller namespace
+// recording the Vault objects of deleted resources awaiting the end of their grace period.
+const PendingDeletionsConfigMap = "vault-rbac-controller-pending-deletions"
+
+// pendingDeletionSweepInterval is the interval at which expired deletions are processed.
+const pendingDeletionSweepInterval = time.Minute
+
+// deletionProtected returns true if the object or its namespace has deletion protection
+// enabled.
+func deletionProtected(ctx context.Context, reader client.Reader, obj client.Object) (bool, error) {
+	if protected, ok := parseBoolAnnotation(obj, api.VaultDeletionProtectionAnnotation); ok {
+		return protected, nil
+	}
+	var ns corev1.Namespace
+	if err := reader.Get(ctx, client.ObjectKey{Name: obj.GetNamespace()}, &ns); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	protected, _ := parseBoolAnnotation(&ns, api.VaultDeletionProtectionAnnotation)
+	return protected, nil
+}
+
+// parseBoolAnnotation returns the boolean value of the annotation and whether it is set.
+func parseBoolAnnotation(obj client.Object, annotation string) (bool, bool) {
+	value, ok := obj.GetAnnotations()[annotation]
+	if !ok {
+		return false, false
+	}
+	b, err := strconv.ParseBool(value)
+	return b && err == nil, true
+}
+
+// retainVaultObjects decides whether the Vault policy and role of a deleted object are
+// kept, because the object is protected or because their deletion is deferred until the
+// end of the grace period. It returns true if they were kept.
+func retainVaultObjects(ctx context.Context, reader client.Reader, recorder record.EventRecorder, pending *pendingDeletions, obj client.Object, deletePolicy, deleteRole bool) (bool, error) {
+	protected, err := deletionProtected(ctx, reader, obj)
+	if err != nil {
+		return false, fmt.Errorf("unable to check deletion protection: %w", err)
+	}
+	if protected {
+		ctrl.LoggerFrom(ctx).Info("deletion protection is enabled, keeping vault objects")
+		recorder.Event(obj, corev1.EventTypeNormal, api.EventReasonRetained, "Vault objects kept due to deletion protection")
+		return true, nil
+	}
+	if pending == nil {
+		return false, nil
+	}
+	if err := pending.Schedule(ctx, obj, deletePolicy, deleteRole); err != nil {
+		return false, fmt.Errorf("unable to schedule deletion of vault objects: %w", err)
+	}
+	recorder.Event(obj, corev1.EventTypeNormal, api.EventReasonRetained,
+		fmt.Sprintf("Vault objects will be deleted after a grace period of %s", pending.gracePeriod))
+	return true, nil
+}
+
+// pendingDeletion is a deleted object whose Vault objects are deleted once the grace
+// period has passed, unless the object is recreated in the meantime.
+type pendingDeletion struct {
+	vault.ObjectReference `json:",inline"`
+	Policy                bool        `json:"policy,omitempty"`
+	Role                  bool        `json:"role,omitempty"`
+	DeleteAfter           metav1.Time `json:"deleteAfter"`
+}
+
+// pendingDeletions defers the deletion of the Vault objects of deleted resources for a
+// grace period, recording them in a ConfigMap so they survive restarts.
+type pendingDeletions struct {
+	client      client.Client
+	namespace   string
+	gracePeriod time.Duration
+	policies    vault.PolicyManager
+	roles       vault.RoleManager
+}
+
+// Schedule records the Vault objects of the deleted object for deletion after the grace period.
+func (p *pendingDeletions) Schedule(ctx context.Context, obj client.Object, deletePolicy, deleteRole bool) error {
+	entry := &pendingDeletion{
+		ObjectReference: vault.NewObjectReference(obj),
+		Policy:          deletePolicy,
+		Role:            deleteRole,
+		DeleteAfter:     metav1.NewTime(time.Now().Add(p.gracePeriod)),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return p.update(ctx, func(cm *corev1.ConfigMap) {
+		cm.Data[entry.Key()] = string(data)
+	})
+}
+
+// Start processes expired deletions until the context is cancelled.
+func (p *pendingDeletions) Start(ctx context.Context) error {
+	ticker := time.NewTicker(pendingDeletionSweepInterval)
+	defer ticker.Stop()
+	for {
+		if err := p.sweep(ctx, time.Now()); err != nil {
+			ctrl.LoggerFrom(ctx).Error(err, "unable to process pending deletions")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep deletes the Vault objects of every entry whose grace period has passed. Entries
+// for objects that have been recreated are dropped, since their Vault objects are in use.
+func (p *pendingDeletions) sweep(ctx context.Context, now time.Time) error {
+	var cm corev1.ConfigMap
+	if err := p.client.Get(ctx, client.ObjectKey{Namespace: p.namespace, Name: PendingDeletionsConfigMap}, &cm); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	done := make(map[string]string)
+	for key, data := range cm.Data {
+		var entry pendingDeletion
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			ctrl.LoggerFrom(ctx).Error(err, "dropping invalid pending deletion", "key", key)
+			done[key] = data
+			continue
+		}
+		if now.Before(entry.DeleteAfter.Time) {
+			continue
+		}
+		if err := p.delete(ctx, &entry); err != nil {
+			// Retry on the next sweep
+			ctrl.LoggerFrom(ctx).Error(err, "unable to delete vault objects", "kind", entry.Kind, "namespace", entry.Namespace, "name", entry.Name)
+			continue
+		}
+		done[key] = data
+	}
+	if len(done) == 0 {
+		return nil
+	}
+	return p.update(ctx, func(cm *corev1.ConfigMap) {
+		for key, data := range done {
+			// Keep entries scheduled again since they were processed
+			if cm.Data[key] == data {
+				delete(cm.Data, key)
+			}
+		}
+	})
+}
+
+func (p *pendingDeletions) delete(ctx context.Context, entry *pendingDeletion) error {
+	obj, err := entry.Object()
+	if err != nil {
+		return err
+	}
+	current := obj.DeepCopyObject().(client.Object)
+	err = p.client.Get(ctx, client.ObjectKeyFromObject(obj), current)
+	if err == nil && current.GetDeletionTimestamp() == nil {
+		ctrl.LoggerFrom(ctx).Info("object was recreated, keeping vault objects", "kind", entry.Kind, "namespace", entry.Namespace, "name", entry.Name)
+		return nil
+	}
+	if client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	if entry.Role {
+		if err := p.roles.DeleteRole(ctx, obj); err != nil {
+			return fmt.Errorf("unable to delete auth role in vault: %w", err)
+		}
+	}
+	if entry.Policy {
+		if err := p.policies.DeletePolicy(ctx, managedPolicyObject(obj)); err != nil {
+			return fmt.Errorf("unable to delete policy in vault: %w", err)
+		}
+	}
+	return nil
+}
+
+// update applies the change to the pending deletions ConfigMap, creating it if needed.
+func (p *pendingDeletions) update(ctx context.Context, change func(*corev1.ConfigMap)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var cm corev1.ConfigMap
+		err := p.client.Get(ctx, client.ObjectKey{Namespace: p.namespace, Name: PendingDeletionsConfigMap}, &cm)
+		if apierrors.IsNotFound(err) {
+			cm = corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: p.namespace, Name: PendingDeletionsConfigMap}, Data: map[string]string{}}
+			change(&cm)
+			return p.client.Create(ctx, &cm)
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		change(&cm)
+		return p.client.Update(ctx, &cm)
+	})
+}
@@ -0,0 +1,294 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/util"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+// recordingManager records the vault objects deleted through it.
+type recordingManager struct {
+	deleted []string
+}
+
+func (m *recordingManager) PolicyName(obj client.Object) string {
+	if name, ok := obj.GetAnnotations()[api.VaultPolicyNameAnnotation]; ok {
+		return name
+	}
+	return util.DefaultResourceFormat(obj.GetNamespace(), obj.GetName())
+}
+
+func (m *recordingManager) Location(context.Context, client.Object) (vault.Location, error) {
+	return vault.Location{}, nil
+}
+
+func (m *recordingManager) WritePolicy(context.Context, client.Object, string) error { return nil }
+
+func (m *recordingManager) DeletePolicy(_ context.Context, obj client.Object) error {
+	m.deleted = append(m.deleted, "policy/"+m.PolicyName(obj))
+	return nil
+}
+
+func (m *recordingManager) RoleName(obj client.Object) string {
+	return util.DefaultResourceFormat(obj.GetNamespace(), obj.GetName())
+}
+
+func (m *recordingManager) AuthMounts(client.Object) []string { return []string{"kubernetes"} }
+
+func (m *recordingManager) WriteRole(context.Context, client.Object, map[string]any) error {
+	return nil
+}
+
+func (m *recordingManager) DeleteRole(_ context.Context, obj client.Object) error {
+	m.deleted = append(m.deleted, "role/"+m.RoleName(obj))
+	return nil
+}
+
+func TestDeletionProtected(t *testing.T) {
+	cli := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "protected", Annotations: map[string]string{api.VaultDeletionProtectionAnnotation: "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+	).Build()
+	tt := []struct {
+		namespace  string
+		annotation string
+		want       bool
+	}{
+		{namespace: "default", want: false},
+		{namespace: "default", annotation: "true", want: true},
+		{namespace: "protected", want: true},
+		{namespace: "protected", annotation: "false", want: false},
+		{namespace: "missing", want: false},
+	}
+	for _, tc := range tt {
+		sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: tc.namespace, Name: "app"}}
+		if tc.annotation != "" {
+			sa.SetAnnotations(map[string]string{api.VaultDeletionProtectionAnnotation: tc.annotation})
+		}
+		protected, err := deletionProtected(context.Background(), cli, sa)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if protected != tc.want {
+			t.Errorf("Expected protection %v in %q with annotation %q, got %v", tc.want, tc.namespace, tc.annotation, protected)
+		}
+	}
+}
+
+func TestPendingDeletions(t *testing.T) {
+	ctx := context.Background()
+	recreated := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "recreated"}}
+	cli := fake.NewClientBuilder().WithObjects(recreated).Build()
+	manager := &recordingManager{}
+	pending := &pendingDeletions{
+		client:      cli,
+		namespace:   "vault",
+		gracePeriod: time.Hour,
+		policies:    manager,
+		roles:       manager,
+	}
+	deleted := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deleted", Annotations: map[string]string{
+		api.VaultInlinePolicyAnnotation:             `path "secret/*" { capabilities = ["read"] }`,
+		"kubectl.kubernetes.io/last-applied-config": "{}",
+	}}}
+	role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "reader"}}
+	recorder := record.NewFakeRecorder(10)
+	for _, tc := range []struct {
+		obj          client.Object
+		policy, role bool
+	}{{deleted, true, true}, {recreated, true, true}, {role, true, false}} {
+		retained, err := retainVaultObjects(ctx, cli, recorder, pending, tc.obj, tc.policy, tc.role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !retained {
+			t.Fatalf("Expected the vault objects of %s to be retained", tc.obj.GetName())
+		}
+	}
+
+	var cm corev1.ConfigMap
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: "vault", Name: PendingDeletionsConfigMap}, &cm); err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Data) != 3 {
+		t.Fatalf("Expected 3 pending deletions, got %v", cm.Data)
+	}
+	var entry pendingDeletion
+	if err := json.Unmarshal([]byte(cm.Data["serviceaccount.default.deleted"]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entry.Annotations["kubectl.kubernetes.io/last-applied-config"]; ok {
+		t.Errorf("Expected only controller annotations to be recorded, got %v", entry.Annotations)
+	}
+
+	// Nothing is deleted before the grace period has passed
+	if err := pending.sweep(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(manager.deleted) != 0 {
+		t.Fatalf("Expected nothing to be deleted, got %v", manager.deleted)
+	}
+
+	if err := pending.sweep(ctx, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"role/default-deleted", "policy/default-deleted", "policy/default-reader"}
+	if !sameElements(manager.deleted, expected) {
+		t.Errorf("Expected %v to be deleted, got %v", expected, manager.deleted)
+	}
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: "vault", Name: PendingDeletionsConfigMap}, &cm); err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Data) != 0 {
+		t.Errorf("Expected no pending deletions, got %v", cm.Data)
+	}
+
+	// Protected objects are retained without scheduling a deletion
+	protected := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "protected", Annotations: map[string]string{
+		api.VaultDeletionProtectionAnnotation: "true",
+	}}}
+	retained, err := retainVaultObjects(ctx, cli, recorder, nil, protected, true, true)
+	if err != nil || !retained {
+		t.Errorf("Expected a protected object to be retained, got %v, %v", retained, err)
+	}
+	retained, err = retainVaultObjects(ctx, cli, recorder, nil, deleted, true, true)
+	if err != nil || retained {
+		t.Errorf("Expected an object to be deleted without a grace period, got %v, %v", retained, err)
+	}
+}
+
+func TestPendingDeletionsOfDeletedNamespace(t *testing.T) {
+	ctx := context.Background()
+	requests := standInVault(t)
+	cli := fake.NewClientBuilder().Build()
+	namespaces, err := vault.NewNamespaceMapper(cli, "tenants/{{ .Namespace }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := &pendingDeletions{
+		client:      cli,
+		namespace:   "vault",
+		gracePeriod: time.Hour,
+		policies:    vault.NewPolicyManager(&vault.PolicyManagerOptions{Namespaces: namespaces}),
+		roles:       vault.NewRoleManager(&vault.RoleManagerOptions{AuthMounts: []string{"kubernetes"}, Namespaces: namespaces}),
+	}
+	// The namespace was mapped by its annotation, which is gone along with it
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app", Annotations: map[string]string{
+		api.ManagedAuthMountsAnnotation:     "kubernetes",
+		api.ManagedPolicyAnnotation:         "team-a-app",
+		api.ManagedVaultNamespaceAnnotation: "tenants/annotated",
+	}}}
+	if err := pending.Schedule(ctx, sa, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := pending.sweep(ctx, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	got := requests()
+	for _, req := range []string{
+		"DELETE /v1/auth/kubernetes/role/team-a-app",
+		"DELETE /v1/sys/policies/acl/team-a-app",
+	} {
+		if ns, ok := got[req]; !ok || ns != "tenants/annotated" {
+			t.Errorf("Expected %q in the recorded vault namespace, got %q (made: %v)", req, ns, ok)
+		}
+	}
+	var cm corev1.ConfigMap
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: "vault", Name: PendingDeletionsConfigMap}, &cm); err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Data) != 0 {
+		t.Errorf("Expected the pending deletion to be processed, got %v", cm.Data)
+	}
+}
+
+func TestDeleteUnannotatedServiceAccount(t *testing.T) {
+	ctx := context.Background()
+	// The policy annotations were removed after the vault objects were written
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Namespace:         "default",
+		Name:              "app",
+		DeletionTimestamp: &metav1.Time{Time: time.Now()},
+		Finalizers:        []string{api.ResourceFinalizer},
+		Annotations: map[string]string{
+			api.ManagedAuthMountsAnnotation: "kubernetes",
+			api.ManagedPolicyAnnotation:     "custom-app",
+		},
+	}}
+	cli := fake.NewClientBuilder().WithObjects(sa).Build()
+	manager := &recordingManager{}
+	reconciler := &ServiceAccountReconciler{
+		Client:        cli,
+		recorder:      record.NewFakeRecorder(10),
+		policies:      manager,
+		roles:         manager,
+		useFinalizers: true,
+	}
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(sa)}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"policy/custom-app", "role/default-app"}
+	if !reflect.DeepEqual(manager.deleted, expected) {
+		t.Errorf("Expected %v to be deleted, got %v", expected, manager.deleted)
+	}
+	// The serviceaccount is gone once its finalizer is removed
+	if err := cli.Get(ctx, client.ObjectKeyFromObject(sa), sa); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the finalizer to be removed, got %v", err)
+	}
+}
+
+func TestRemovePolicyOfAttachOnlyServiceAccount(t *testing.T) {
+	ctx := context.Background()
+	// The policy annotations were removed, only an attached policy is left
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "app",
+		Annotations: map[string]string{
+			api.VaultAttachPoliciesAnnotation: "shared-read",
+			api.ManagedAuthMountsAnnotation:   "kubernetes",
+			api.ManagedPolicyAnnotation:       "custom-app",
+		},
+	}}
+	cli := fake.NewClientBuilder().WithObjects(sa).Build()
+	manager := &recordingManager{}
+	reconciler := &ServiceAccountReconciler{
+		Client:             cli,
+		recorder:           record.NewFakeRecorder(10),
+		policies:           manager,
+		roles:              manager,
+		attachablePolicies: []string{"shared-*"},
+	}
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(sa)}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"policy/custom-app"}; !reflect.DeepEqual(manager.deleted, expected) {
+		t.Errorf("Expected %v to be deleted, got %v", expected, manager.deleted)
+	}
+	if err := cli.Get(ctx, client.ObjectKeyFromObject(sa), sa); err != nil {
+		t.Fatal(err)
+	}
+	if util.HasAnnotation(sa, api.ManagedPolicyAnnotation) {
+		t.Error("Expected the recorded policy to be cleared")
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/util"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+// syncFinalizer adds the finalizer to the object if finalizers are enabled and removes
+// it otherwise, so objects managed before the configuration changed follow it.
+func syncFinalizer(ctx context.Context, cli client.Client, obj client.Object, useFinalizers bool) error {
+	switch has := controllerutil.ContainsFinalizer(obj, api.ResourceFinalizer); {
+	case useFinalizers && !has:
+		return addFinalizer(ctx, cli, obj)
+	case !useFinalizers && has:
+		return removeFinalizer(ctx, cli, obj)
+	}
+	return nil
+}
+
+// finalizerSync brings the finalizers of all existing resources in line with the
+// configuration when the controller starts, including resources the reconcilers
+// skip. In uninstall mode the finalizer is removed from every resource in the
+// cluster, so the controller can be removed without blocking deletions, and the
+// manager is stopped once they are.
+type finalizerSync struct {
+	client        client.Client
+	useFinalizers bool
+	uninstall     bool
+	// stop shuts down the manager once the finalizers are removed in uninstall mode.
+	stop func()
+	// watched returns true for objects in the namespaces watched by the controller.
+	watched func(client.Object) bool
+}
+
+func (f *finalizerSync) Start(ctx context.Context) error {
+	log := ctrl.LoggerFrom(ctx).WithName("finalizers")
+	added, removed, err := f.sync(ctx)
+	log.Info("finalizers synced", "added", added, "removed", removed)
+	if err != nil {
+		if f.uninstall {
+			log.Error(err, "unable to remove all finalizers, the controller cannot be uninstalled yet")
+			return err
+		}
+		log.Error(err, "unable to sync finalizers")
+	}
+	if f.uninstall {
+		log.Info("all finalizers removed, the controller can be uninstalled")
+		if f.stop != nil {
+			f.stop()
+		}
+	}
+	return nil
+}
+
+// sync adds or removes the finalizer on every resource as configured. Failures are
+// collected so that a single resource does not prevent the others from being updated.
+func (f *finalizerSync) sync(ctx context.Context) (added, removed int, err error) {
+	var errs []error
+	for _, list := range []client.ObjectList{&corev1.ServiceAccountList{}, &rbacv1.RoleBindingList{}, &rbacv1.RoleList{}} {
+		if err := f.client.List(ctx, list); err != nil {
+			return added, removed, fmt.Errorf("unable to list resources: %w", err)
+		}
+		if err := meta.EachListItem(list, func(o runtime.Object) error {
+			obj := o.(client.Object)
+			want, ok := f.wantFinalizer(obj)
+			if !ok {
+				return nil
+			}
+			switch has := controllerutil.ContainsFinalizer(obj, api.ResourceFinalizer); {
+			case want && !has:
+				if err := addFinalizer(ctx, f.client, obj); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", vault.NewObjectReference(obj), err))
+					return nil
+				}
+				added++
+			case !want && has:
+				if err := removeFinalizer(ctx, f.client, obj); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", vault.NewObjectReference(obj), err))
+					return nil
+				}
+				removed++
+			}
+			return nil
+		}); err != nil {
+			return added, removed, err
+		}
+	}
+	return added, removed, errors.Join(errs...)
+}
+
+// wantFinalizer returns whether the object should carry the finalizer, and false if
+// the object is left alone.
+func (f *finalizerSync) wantFinalizer(obj client.Object) (want, ok bool) {
+	if f.uninstall {
+		return false, true
+	}
+	// Objects outside the watched namespaces are never reconciled, so a finalizer
+	// left on them would block their deletion
+	if !f.watched(obj) || !f.useFinalizers {
+		return false, true
+	}
+	// Objects being deleted can no longer be given finalizers
+	if obj.GetDeletionTimestamp() != nil {
+		return false, false
+	}
+	// Only objects with vault objects written for them are finalized
+	managed := util.HasAnnotation(obj, api.ManagedAuthMountsAnnotation)
+	if role, isRole := obj.(*rbacv1.Role); isRole {
+		managed = vault.HasACLs(role)
+	}
+	// Ignored objects keep the finalizer only while vault objects are recorded for
+	// them, which are cleaned up once they are deleted
+	if isIgnored(obj) && !managed {
+		return false, true
+	}
+	return true, managed
+}
+
+// isIgnored returns true for serviceaccounts and rolebindings the reconcilers skip.
+func isIgnored(obj client.Object) bool {
+	switch o := obj.(type) {
+	case *corev1.ServiceAccount:
+		return util.IsIgnoredServiceAccount(o)
+	case *rbacv1.RoleBinding:
+		return util.IsIgnoredRoleBinding(o)
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+)
+
+func TestFinalizerSync(t *testing.T) {
+	objects := func() []client.Object {
+		return []client.Object{
+			// Managed, without a finalizer
+			&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "managed", Annotations: map[string]string{
+				api.ManagedAuthMountsAnnotation: "kubernetes",
+			}}},
+			// Finalized while finalizers were enabled
+			&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "finalized", Finalizers: []string{api.ResourceFinalizer}}},
+			// A role with vault rules, without a finalizer
+			&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "reader"}, Rules: []rbacv1.PolicyRule{{
+				APIGroups: []string{"vault.hashicorp.com"}, Resources: []string{"secret/*"}, Verbs: []string{"read"},
+			}}},
+			// Not managed by the controller
+			&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unmanaged"}},
+			// Ignored, without vault objects recorded for it
+			&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ignored", Finalizers: []string{api.ResourceFinalizer}}},
+			// Ignored, with the role written before its bind annotation was removed
+			&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unbound", Annotations: map[string]string{
+				api.ManagedAuthMountsAnnotation: "kubernetes",
+			}}},
+			// Outside the watched namespaces
+			&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "excluded", Name: "finalized", Finalizers: []string{api.ResourceFinalizer}}},
+		}
+	}
+	watched := func(obj client.Object) bool {
+		return checkObject(obj, nil, []string{"excluded"}, false)
+	}
+	tt := []struct {
+		name          string
+		useFinalizers bool
+		uninstall     bool
+		finalized     []string
+	}{
+		{
+			name:          "finalizers enabled",
+			useFinalizers: true,
+			finalized:     []string{"ServiceAccount/default/managed", "Role/default/reader", "RoleBinding/default/unbound"},
+		},
+		{
+			name: "finalizers disabled",
+		},
+		{
+			name:          "uninstall",
+			useFinalizers: true,
+			uninstall:     true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			objs := objects()
+			cli := fake.NewClientBuilder().WithObjects(objs...).Build()
+			var stopped bool
+			sync := &finalizerSync{client: cli, useFinalizers: tc.useFinalizers, uninstall: tc.uninstall, watched: watched, stop: func() { stopped = true }}
+			if err := sync.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			// The manager is only stopped once the controller can be uninstalled
+			if stopped != tc.uninstall {
+				t.Errorf("Expected the manager to be stopped: %v, got %v", tc.uninstall, stopped)
+			}
+			var finalized []string
+			for _, obj := range objs {
+				if err := cli.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+					t.Fatal(err)
+				}
+				if controllerutil.ContainsFinalizer(obj, api.ResourceFinalizer) {
+					finalized = append(finalized, obj.GetObjectKind().GroupVersionKind().Kind+"/"+obj.GetNamespace()+"/"+obj.GetName())
+				}
+			}
+			if !sameElements(finalized, tc.finalized) {
+				t.Errorf("Expected %v to be finalized, got %v", tc.finalized, finalized)
+			}
+		})
+	}
+}
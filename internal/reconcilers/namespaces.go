@@ -0,0 +1,329 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+// OwnershipConfigMapPrefix is the prefix of the ConfigMaps in the controller namespace
+// recording the objects of a Kubernetes namespace that Vault objects were written for.
+const OwnershipConfigMapPrefix = "vault-rbac-controller-owned-"
+
+// OwnedNamespaceLabel is set on ownership ConfigMaps to the namespace they are for.
+const OwnedNamespaceLabel = "vault-rbac-controller/owned-namespace"
+
+// OwnedNamespaceProtectedAnnotation is set on ownership ConfigMaps to the deletion
+// protection of the namespace they are for, so that it still applies once the
+// namespace is gone.
+const OwnedNamespaceProtectedAnnotation = "vault-rbac-controller/deletion-protection"
+
+// ownedObject is an object the controller wrote a Vault policy or role for.
+type ownedObject struct {
+	vault.ObjectReference `json:",inline"`
+	Policy                bool `json:"policy,omitempty"`
+	Role                  bool `json:"role,omitempty"`
+}
+
+// ownershipRecords keeps track of the objects of every namespace that Vault objects
+// were written for, so they can be removed when the namespace is deleted, even once
+// the objects themselves are gone. A nil ownershipRecords records nothing.
+type ownershipRecords struct {
+	client    client.Client
+	namespace string
+}
+
+// Record records the Vault objects written for the object.
+func (o *ownershipRecords) Record(ctx context.Context, obj client.Object, policy, role bool) error {
+	if o == nil {
+		return nil
+	}
+	data, err := json.Marshal(&ownedObject{ObjectReference: vault.NewObjectReference(obj), Policy: policy, Role: role})
+	if err != nil {
+		return err
+	}
+	key := vault.NewObjectReference(obj).Key()
+	var cm corev1.ConfigMap
+	err = o.client.Get(ctx, client.ObjectKey{Namespace: o.namespace, Name: OwnershipConfigMapPrefix + obj.GetNamespace()}, &cm)
+	if err == nil && cm.Data[key] == string(data) {
+		return nil
+	}
+	if client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	return o.update(ctx, obj.GetNamespace(), func(cm *corev1.ConfigMap) {
+		cm.Data[key] = string(data)
+	})
+}
+
+// Forget removes the record of the object once its Vault objects are deleted or no
+// longer managed.
+func (o *ownershipRecords) Forget(ctx context.Context, obj client.Object) error {
+	if o == nil {
+		return nil
+	}
+	key := vault.NewObjectReference(obj).Key()
+	var cm corev1.ConfigMap
+	if err := o.client.Get(ctx, client.ObjectKey{Namespace: o.namespace, Name: OwnershipConfigMapPrefix + obj.GetNamespace()}, &cm); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if _, ok := cm.Data[key]; !ok {
+		return nil
+	}
+	return o.update(ctx, obj.GetNamespace(), func(cm *corev1.ConfigMap) {
+		delete(cm.Data, key)
+	})
+}
+
+// owned returns the recorded objects of the namespace, ordered by key.
+func (o *ownershipRecords) owned(ctx context.Context, namespace string) ([]*ownedObject, error) {
+	var cm corev1.ConfigMap
+	if err := o.client.Get(ctx, client.ObjectKey{Namespace: o.namespace, Name: OwnershipConfigMapPrefix + namespace}, &cm); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	owned := make([]*ownedObject, 0, len(keys))
+	for _, key := range keys {
+		var entry ownedObject
+		if err := json.Unmarshal([]byte(cm.Data[key]), &entry); err != nil {
+			ctrl.LoggerFrom(ctx).Error(err, "ignoring invalid ownership record", "key", key)
+			continue
+		}
+		owned = append(owned, &entry)
+	}
+	return owned, nil
+}
+
+// recordProtection records the deletion protection of the namespace on its records,
+// if there are any.
+func (o *ownershipRecords) recordProtection(ctx context.Context, ns *corev1.Namespace) error {
+	protected, _ := parseBoolAnnotation(ns, api.VaultDeletionProtectionAnnotation)
+	value := strconv.FormatBool(protected)
+	var cm corev1.ConfigMap
+	if err := o.client.Get(ctx, client.ObjectKey{Namespace: o.namespace, Name: OwnershipConfigMapPrefix + ns.GetName()}, &cm); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if cm.GetAnnotations()[OwnedNamespaceProtectedAnnotation] == value {
+		return nil
+	}
+	return o.update(ctx, ns.GetName(), func(cm *corev1.ConfigMap) {
+		annotations := cm.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[OwnedNamespaceProtectedAnnotation] = value
+		cm.SetAnnotations(annotations)
+	})
+}
+
+// protected returns the deletion protection last recorded for the namespace.
+func (o *ownershipRecords) protected(ctx context.Context, namespace string) (bool, error) {
+	var cm corev1.ConfigMap
+	if err := o.client.Get(ctx, client.ObjectKey{Namespace: o.namespace, Name: OwnershipConfigMapPrefix + namespace}, &cm); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	protected, _ := parseBoolAnnotation(&cm, OwnedNamespaceProtectedAnnotation)
+	return protected, nil
+}
+
+// release deletes the records of the namespace.
+func (o *ownershipRecords) release(ctx context.Context, namespace string) error {
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: o.namespace, Name: OwnershipConfigMapPrefix + namespace}}
+	return client.IgnoreNotFound(o.client.Delete(ctx, cm))
+}
+
+// update applies the change to the records of the namespace, creating them if needed.
+func (o *ownershipRecords) update(ctx context.Context, namespace string, change func(*corev1.ConfigMap)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var cm corev1.ConfigMap
+		err := o.client.Get(ctx, client.ObjectKey{Namespace: o.namespace, Name: OwnershipConfigMapPrefix + namespace}, &cm)
+		if apierrors.IsNotFound(err) {
+			cm = corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: o.namespace,
+					Name:      OwnershipConfigMapPrefix + namespace,
+					Labels:    map[string]string{OwnedNamespaceLabel: namespace},
+				},
+				Data: map[string]string{},
+			}
+			change(&cm)
+			return o.client.Create(ctx, &cm)
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		change(&cm)
+		return o.client.Update(ctx, &cm)
+	})
+}
+
+// ownedNamespace returns a map function enqueueing the namespace an ownership
+// ConfigMap is for, so that the records of namespaces deleted while the controller
+// was not running are processed on startup.
+func (o *ownershipRecords) ownedNamespace(obj client.Object) []reconcile.Request {
+	if obj.GetNamespace() != o.namespace {
+		return nil
+	}
+	namespace, ok := obj.GetLabels()[OwnedNamespaceLabel]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: namespace}}}
+}
+
+// skipCleanup returns true if the finalizer of a deleted object is released without
+// deleting its Vault objects, because finalizers were disabled since it was added or
+// because its namespace is being deleted and the NamespaceReconciler cleans it up.
+func skipCleanup(ctx context.Context, reader client.Reader, useFinalizers bool, ownership *ownershipRecords, obj client.Object) (bool, error) {
+	if !useFinalizers {
+		return true, nil
+	}
+	if ownership == nil {
+		return false, nil
+	}
+	var ns corev1.Namespace
+	if err := reader.Get(ctx, client.ObjectKey{Name: obj.GetNamespace()}, &ns); err != nil {
+		return apierrors.IsNotFound(err), client.IgnoreNotFound(err)
+	}
+	return ns.GetDeletionTimestamp() != nil, nil
+}
+
+// NamespaceReconciler removes the Vault policies and roles of every object recorded
+// for a namespace once it is deleted, in a single pass deleting all roles before
+// any of the policies they reference.
+type NamespaceReconciler struct {
+	client.Client
+
+	recorder  record.EventRecorder
+	policies  vault.PolicyManager
+	roles     vault.RoleManager
+	ownership *ownershipRecords
+	// pendingDeletions defers the deletion of vault objects for a grace period.
+	pendingDeletions *pendingDeletions
+}
+
+func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: req.Name}}
+	err := r.Get(ctx, req.NamespacedName, ns)
+	if client.IgnoreNotFound(err) != nil {
+		log.Error(err, "unable to fetch namespace")
+		return ctrl.Result{}, err
+	}
+	if err == nil {
+		// The protection of the namespace is kept for when it is gone
+		if err := r.ownership.recordProtection(ctx, ns); err != nil {
+			log.Error(err, "unable to record deletion protection of namespace")
+			return ctrl.Result{}, err
+		}
+		if ns.GetDeletionTimestamp() == nil {
+			return ctrl.Result{}, nil
+		}
+	}
+	// The namespace is being deleted or already gone
+	owned, err := r.ownership.owned(ctx, req.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(owned) == 0 {
+		return ctrl.Result{}, r.ownership.release(ctx, req.Name)
+	}
+	protected, err := r.ownership.protected(ctx, req.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	log.Info("namespace deleted, removing vault objects", "objects", len(owned))
+	deleted, retained, err := r.cleanup(ctx, owned, protected)
+	if err != nil {
+		r.recorder.Event(ns, corev1.EventTypeWarning, api.EventReasonError, err.Error())
+		return ctrl.Result{}, err
+	}
+	if err := r.ownership.release(ctx, req.Name); err != nil {
+		return ctrl.Result{}, err
+	}
+	log.Info("vault objects of namespace removed", "deleted", deleted, "retained", retained)
+	r.recorder.Event(ns, corev1.EventTypeNormal, api.EventReasonCleanedUp,
+		fmt.Sprintf("Vault objects of %d resources deleted, %d retained", deleted, retained))
+	return ctrl.Result{}, nil
+}
+
+// cleanup deletes the Vault objects of the owned objects, roles first, unless they are
+// protected, by their own annotation or the recorded protection of the namespace, or
+// deferred for the grace period. It returns the number of objects whose Vault objects
+// were deleted and retained.
+func (r *NamespaceReconciler) cleanup(ctx context.Context, owned []*ownedObject, namespaceProtected bool) (deleted, retained int, err error) {
+	var deletions []*ownedObject
+	objects := make(map[*ownedObject]client.Object, len(owned))
+	for _, entry := range owned {
+		obj, err := entry.Object()
+		if err != nil {
+			ctrl.LoggerFrom(ctx).Error(err, "ignoring invalid ownership record", "key", entry.Key())
+			continue
+		}
+		protected, ok := parseBoolAnnotation(obj, api.VaultDeletionProtectionAnnotation)
+		if !ok {
+			protected = namespaceProtected
+		}
+		switch {
+		case protected:
+			retained++
+		case r.pendingDeletions != nil:
+			if err := r.pendingDeletions.Schedule(ctx, obj, entry.Policy, entry.Role); err != nil {
+				return 0, 0, fmt.Errorf("unable to schedule deletion of vault objects: %w", err)
+			}
+			retained++
+		default:
+			deletions = append(deletions, entry)
+			objects[entry] = obj
+		}
+	}
+	var errs []error
+	for _, entry := range deletions {
+		if entry.Role {
+			if err := r.roles.DeleteRole(ctx, objects[entry]); err != nil {
+				errs = append(errs, fmt.Errorf("unable to delete auth role of %s: %w", entry.ObjectReference, err))
+			}
+		}
+	}
+	// Policies are only deleted once no role references them
+	if len(errs) > 0 {
+		return 0, 0, errors.Join(errs...)
+	}
+	for _, entry := range deletions {
+		if entry.Policy {
+			if err := r.policies.DeletePolicy(ctx, managedPolicyObject(objects[entry])); err != nil {
+				errs = append(errs, fmt.Errorf("unable to delete policy of %s: %w", entry.ObjectReference, err))
+			}
+		}
+	}
+	return len(deletions), retained, errors.Join(errs...)
+}
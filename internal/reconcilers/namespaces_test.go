@@ -0,0 +1,295 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+func TestNamespaceCleanup(t *testing.T) {
+	ctx := context.Background()
+	cli := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "active"}},
+	).Build()
+	ownership := &ownershipRecords{client: cli, namespace: "vault"}
+	manager := &recordingManager{}
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &NamespaceReconciler{
+		Client:    cli,
+		recorder:  recorder,
+		policies:  manager,
+		roles:     manager,
+		ownership: ownership,
+	}
+
+	for _, tc := range []struct {
+		obj          client.Object
+		policy, role bool
+	}{
+		{&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "deleted", Name: "reader"}}, true, false},
+		{&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "deleted", Name: "reader"}}, false, true},
+		{&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "deleted", Name: "app"}}, true, true},
+		{&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "deleted", Name: "protected", Annotations: map[string]string{
+			api.VaultDeletionProtectionAnnotation: "true",
+		}}}, true, true},
+		{&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "active", Name: "app"}}, true, true},
+	} {
+		if err := ownership.Record(ctx, tc.obj, tc.policy, tc.role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Recording again leaves the records unchanged
+	var before, after corev1.ConfigMap
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: "vault", Name: OwnershipConfigMapPrefix + "deleted"}, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := ownership.Record(ctx, &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "deleted", Name: "reader"}}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: "vault", Name: OwnershipConfigMapPrefix + "deleted"}, &after); err != nil {
+		t.Fatal(err)
+	}
+	if before.ResourceVersion != after.ResourceVersion {
+		t.Errorf("Expected unchanged records not to be updated")
+	}
+	if requests := ownership.ownedNamespace(&after); len(requests) != 1 || requests[0].Name != "deleted" {
+		t.Errorf("Expected the ownership configmap to enqueue its namespace, got %v", requests)
+	}
+
+	// Active namespaces are left alone
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Name: "active"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(manager.deleted) != 0 {
+		t.Fatalf("Expected nothing to be deleted, got %v", manager.deleted)
+	}
+
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Name: "deleted"}}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"role/deleted-reader", "role/deleted-app", "policy/deleted-reader", "policy/deleted-app"}
+	if !reflect.DeepEqual(manager.deleted, expected) {
+		t.Errorf("Expected %v to be deleted in order, got %v", expected, manager.deleted)
+	}
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: "vault", Name: OwnershipConfigMapPrefix + "deleted"}, &after); client.IgnoreNotFound(err) != nil || err == nil {
+		t.Errorf("Expected the records of the namespace to be removed, got %v", err)
+	}
+	select {
+	case event := <-recorder.Events:
+		if event != "Normal CleanedUp Vault objects of 3 resources deleted, 1 retained" {
+			t.Errorf("Unexpected event %q", event)
+		}
+	default:
+		t.Error("Expected an event reporting the cleanup")
+	}
+
+	// Forgotten objects are not cleaned up
+	app := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "active", Name: "app"}}
+	if err := ownership.Forget(ctx, app); err != nil {
+		t.Fatal(err)
+	}
+	owned, err := ownership.owned(ctx, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owned) != 0 {
+		t.Errorf("Expected no records, got %v", owned)
+	}
+}
+
+func TestNamespaceCleanupProtection(t *testing.T) {
+	ctx := context.Background()
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "protected", Annotations: map[string]string{
+		api.VaultDeletionProtectionAnnotation: "true",
+	}}}
+	cli := fake.NewClientBuilder().WithObjects(ns).Build()
+	ownership := &ownershipRecords{client: cli, namespace: "vault"}
+	manager := &recordingManager{}
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &NamespaceReconciler{
+		Client:    cli,
+		recorder:  recorder,
+		policies:  manager,
+		roles:     manager,
+		ownership: ownership,
+	}
+	for _, sa := range []*corev1.ServiceAccount{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "protected", Name: "app"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "protected", Name: "unprotected", Annotations: map[string]string{
+			api.VaultDeletionProtectionAnnotation: "false",
+		}}},
+	} {
+		if err := ownership.Record(ctx, sa, true, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Name: "protected"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The protection of the namespace still applies once it is gone
+	if err := cli.Delete(ctx, ns); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Name: "protected"}}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"role/protected-unprotected", "policy/protected-unprotected"}
+	if !reflect.DeepEqual(manager.deleted, expected) {
+		t.Errorf("Expected only %v to be deleted, got %v", expected, manager.deleted)
+	}
+	select {
+	case event := <-recorder.Events:
+		if event != "Normal CleanedUp Vault objects of 1 resources deleted, 1 retained" {
+			t.Errorf("Unexpected event %q", event)
+		}
+	default:
+		t.Error("Expected an event reporting the cleanup")
+	}
+}
+
+func TestNamespaceCleanupWithVault(t *testing.T) {
+	ctx := context.Background()
+	requests := standInVault(t)
+	cli := fake.NewClientBuilder().Build()
+	namespaces, err := vault.NewNamespaceMapper(cli, "tenants/{{ .Namespace }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownership := &ownershipRecords{client: cli, namespace: "vault"}
+	reconciler := &NamespaceReconciler{
+		Client:    cli,
+		recorder:  record.NewFakeRecorder(10),
+		policies:  vault.NewPolicyManager(&vault.PolicyManagerOptions{Namespaces: namespaces}),
+		roles:     vault.NewRoleManager(&vault.RoleManagerOptions{AuthMounts: []string{"kubernetes"}, Namespaces: namespaces}),
+		ownership: ownership,
+	}
+	// The objects were mapped by the annotation of their namespace, which is already gone
+	for _, tc := range []struct {
+		obj          client.Object
+		policy, role bool
+	}{
+		{&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "reader", Annotations: map[string]string{
+			api.ManagedVaultNamespaceAnnotation: "tenants/annotated",
+		}}}, true, false},
+		{&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app", Annotations: map[string]string{
+			api.ManagedAuthMountsAnnotation:     "kubernetes",
+			api.ManagedPolicyAnnotation:         "team-a-app",
+			api.ManagedVaultNamespaceAnnotation: "tenants/annotated",
+		}}}, true, true},
+	} {
+		if err := ownership.Record(ctx, tc.obj, tc.policy, tc.role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Name: "team-a"}}); err != nil {
+		t.Fatal(err)
+	}
+	got := requests()
+	for _, req := range []string{
+		"DELETE /v1/auth/kubernetes/role/team-a-app",
+		"DELETE /v1/sys/policies/acl/team-a-app",
+		"DELETE /v1/sys/policies/acl/team-a-reader",
+	} {
+		if ns, ok := got[req]; !ok || ns != "tenants/annotated" {
+			t.Errorf("Expected %q in the recorded vault namespace, got %q (made: %v)", req, ns, ok)
+		}
+	}
+	owned, err := ownership.owned(ctx, "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owned) != 0 {
+		t.Errorf("Expected the records of the namespace to be released, got %v", owned)
+	}
+}
+
+// standInVault points the Vault client at a server answering every request, and
+// returns a function reporting the Vault namespace of each request by method and path.
+func standInVault(t *testing.T) func() map[string]string {
+	var (
+		mu       sync.Mutex
+		requests = make(map[string]string)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests[r.Method+" "+r.URL.Path] = r.Header.Get("X-Vault-Namespace")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	newClient := vault.NewClient
+	t.Cleanup(func() { vault.NewClient = newClient })
+	vault.NewClient = func() (*vaultapi.Client, error) {
+		cfg := vaultapi.DefaultConfig()
+		cfg.Address = srv.URL
+		cli, err := vaultapi.NewClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cli.SetToken("test")
+		return cli, nil
+	}
+	return func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		out := make(map[string]string, len(requests))
+		for k, v := range requests {
+			out[k] = v
+		}
+		return out
+	}
+}
+
+func TestSkipCleanup(t *testing.T) {
+	ctx := context.Background()
+	cli := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "active"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "terminating", DeletionTimestamp: &metav1.Time{Time: time.Now()}, Finalizers: []string{"kubernetes"}}},
+	).Build()
+	ownership := &ownershipRecords{client: cli, namespace: "vault"}
+	tt := []struct {
+		namespace     string
+		useFinalizers bool
+		ownership     *ownershipRecords
+		want          bool
+	}{
+		{namespace: "active", useFinalizers: false, want: true},
+		{namespace: "active", useFinalizers: true, ownership: ownership, want: false},
+		{namespace: "terminating", useFinalizers: true, ownership: ownership, want: true},
+		{namespace: "terminating", useFinalizers: true, want: false},
+		{namespace: "missing", useFinalizers: true, ownership: ownership, want: true},
+	}
+	for _, tc := range tt {
+		sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: tc.namespace, Name: "app"}}
+		skip, err := skipCleanup(ctx, cli, tc.useFinalizers, tc.ownership, sa)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if skip != tc.want {
+			t.Errorf("Expected skip %v in %q with finalizers %v and ownership %v, got %v", tc.want, tc.namespace, tc.useFinalizers, tc.ownership != nil, skip)
+		}
+	}
+}
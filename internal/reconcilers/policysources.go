@@ -0,0 +1,158 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/util"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+// policySource is a part of the policy of a serviceaccount.
+type policySource struct {
+	// description is where the policy came from, as shown in events.
+	description string
+	// policy is the policy document, if the source is one.
+	policy string
+	// parsed is the policy of sources that are not documents, such as Role rules.
+	parsed *vault.Policy
+}
+
+// policySources returns the sources of the policy of the serviceaccount in order of
+// precedence: the inline annotation, configmaps, secrets, the shared policy and the
+// rules of Roles.
+func (r *ServiceAccountReconciler) policySources(ctx context.Context, sa *corev1.ServiceAccount) ([]*policySource, error) {
+	var sources []*policySource
+	annotations := sa.GetAnnotations()
+	if policy, ok := annotations[api.VaultInlinePolicyAnnotation]; ok {
+		if isPolicyTemplate(sa) {
+			var err error
+			if policy, err = vault.RenderPolicyTemplate(policy, sa); err != nil {
+				return nil, err
+			}
+		}
+		sources = append(sources, &policySource{description: "inline annotation", policy: policy})
+	}
+	for _, name := range util.SplitList(annotations[api.VaultConfigMapPolicyAnnotation]) {
+		var cm corev1.ConfigMap
+		if err := r.Get(ctx, client.ObjectKey{Namespace: sa.GetNamespace(), Name: name}, &cm); err != nil {
+			return nil, fmt.Errorf("failed to get configmap: %w", err)
+		}
+		cmSources, err := documentSources(sa, &cm, "configmap", cm.Data)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, cmSources...)
+	}
+	for _, name := range util.SplitList(annotations[api.VaultSecretPolicyAnnotation]) {
+		var secret corev1.Secret
+		if err := r.Get(ctx, client.ObjectKey{Namespace: sa.GetNamespace(), Name: name}, &secret); err != nil {
+			return nil, fmt.Errorf("failed to get secret: %w", err)
+		}
+		data := make(map[string]string, len(secret.Data))
+		for k, v := range secret.Data {
+			data[k] = string(v)
+		}
+		secretSources, err := documentSources(sa, &secret, "secret", data)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, secretSources...)
+	}
+	shared, ok, err := r.sharedPolicies.Render(ctx, sa)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		sources = append(sources, &policySource{
+			description: fmt.Sprintf("shared policy %s", annotations[api.VaultSharedPolicyAnnotation]),
+			policy:      shared,
+		})
+	}
+	for _, name := range util.SplitList(annotations[api.VaultPolicyRolesAnnotation]) {
+		var role rbacv1.Role
+		if err := r.Get(ctx, client.ObjectKey{Namespace: sa.GetNamespace(), Name: name}, &role); err != nil {
+			return nil, fmt.Errorf("failed to get role: %w", err)
+		}
+		if !vault.HasACLs(&role) {
+			return nil, fmt.Errorf("role %q does not contain any Vault ACLs", name)
+		}
+		pol, _, err := rolePolicy(ctx, &role, r.translateVerbs, r.sharedPolicies)
+		if err != nil {
+			return nil, fmt.Errorf("role %q: %w", name, err)
+		}
+		sources = append(sources, &policySource{description: fmt.Sprintf("role %s", name), parsed: pol})
+	}
+	return sources, nil
+}
+
+// documentSources returns the policies in the keys of a configmap or secret. The
+// VaultPolicyKey takes precedence over the other keys ending in ".hcl", which are
+// ordered by name.
+func documentSources(sa *corev1.ServiceAccount, obj client.Object, kind string, data map[string]string) ([]*policySource, error) {
+	var keys []string
+	for key := range data {
+		if key != api.VaultPolicyKey && strings.HasSuffix(key, ".hcl") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := data[api.VaultPolicyKey]; ok {
+		keys = append([]string{api.VaultPolicyKey}, keys...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s %q does not have a policy key", kind, obj.GetName())
+	}
+	sources := make([]*policySource, 0, len(keys))
+	for _, key := range keys {
+		policy := data[key]
+		if isPolicyTemplate(sa) || isPolicyTemplate(obj) {
+			var err error
+			if policy, err = vault.RenderPolicyTemplate(policy, sa); err != nil {
+				return nil, fmt.Errorf("%s %q key %q: %w", kind, obj.GetName(), key, err)
+			}
+		}
+		sources = append(sources, &policySource{
+			description: fmt.Sprintf("%s %s key %s", kind, obj.GetName(), key),
+			policy:      policy,
+		})
+	}
+	return sources, nil
+}
+
+// composePolicy merges the sources into a single policy, each taking precedence over
+// those after it. A single policy document is returned as is.
+func composePolicy(sources []*policySource) (string, error) {
+	if len(sources) == 0 {
+		return "", errors.New("no policy sources found")
+	}
+	if len(sources) == 1 && sources[0].parsed == nil {
+		return sources[0].policy, nil
+	}
+	composed := &vault.Policy{Path: make(map[string]*vault.PolicyPath)}
+	for _, source := range sources {
+		pol := source.parsed
+		if pol == nil {
+			var err error
+			if pol, err = vault.ParsePolicy(source.policy); err != nil {
+				return "", fmt.Errorf("unable to parse policy from %s: %w", source.description, err)
+			}
+		}
+		composed.Underlay(pol)
+	}
+	return composed.HCL(), nil
+}
@@ -0,0 +1,111 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+)
+
+func TestComposeServiceAccountPolicy(t *testing.T) {
+	cli := fake.NewClientBuilder().WithObjects(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+			Data: map[string]string{
+				api.VaultPolicyKey: `path "secret/data/app" {
+  capabilities = ["update"]
+  max_wrapping_ttl = "24h"
+}`,
+				"pki.hcl":   `path "pki/issue/app" { capabilities = ["create", "update"] }`,
+				"README.md": "not a policy",
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "empty"},
+			Data:       map[string]string{"README.md": "not a policy"},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Data:       map[string][]byte{"database.hcl": []byte(`path "database/creds/app" { capabilities = ["read"] }`)},
+		},
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "reader"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{"vault.hashicorp.com"}, Resources: []string{"secret/data/shared"}, Verbs: []string{"read"}}},
+		},
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kube-only"}},
+	).Build()
+	r := &ServiceAccountReconciler{Client: cli}
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app", Annotations: map[string]string{
+		api.VaultInlinePolicyAnnotation: `path "secret/data/app" {
+  capabilities = ["read"]
+  max_wrapping_ttl = "1h"
+}`,
+		api.VaultConfigMapPolicyAnnotation: "app",
+		api.VaultSecretPolicyAnnotation:    "db",
+		api.VaultPolicyRolesAnnotation:     "reader",
+	}}}
+	policy, sources, err := r.getServiceAccountPolicy(context.Background(), sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `path "database/creds/app" {
+  capabilities = ["read"]
+}
+
+path "pki/issue/app" {
+  capabilities = ["create", "update"]
+}
+
+path "secret/data/app" {
+  capabilities = ["read", "update"]
+  max_wrapping_ttl = "1h"
+}
+
+path "secret/data/shared" {
+  capabilities = ["read"]
+}
+`
+	if policy != expected {
+		t.Errorf("Expected policy %s, got %s", expected, policy)
+	}
+	expectedSources := []string{
+		"inline annotation",
+		"configmap app key policy.hcl",
+		"configmap app key pki.hcl",
+		"secret db key database.hcl",
+		"role reader",
+	}
+	if !reflect.DeepEqual(sources, expectedSources) {
+		t.Errorf("Expected sources %v, got %v", expectedSources, sources)
+	}
+
+	// A single document is written as is
+	sa.SetAnnotations(map[string]string{api.VaultInlinePolicyAnnotation: `path "secret/*" { capabilities = ["read"] }`})
+	if policy, _, err := r.getServiceAccountPolicy(context.Background(), sa); err != nil || policy != `path "secret/*" { capabilities = ["read"] }` {
+		t.Errorf("Expected the inline policy unchanged, got %q, %v", policy, err)
+	}
+
+	for _, annotations := range []map[string]string{
+		{api.VaultConfigMapPolicyAnnotation: "empty"},
+		{api.VaultPolicyRolesAnnotation: "kube-only"},
+		{api.VaultPolicyRolesAnnotation: "missing"},
+		{api.VaultInlinePolicyAnnotation: "not hcl {", api.VaultPolicyRolesAnnotation: "reader"},
+	} {
+		sa.SetAnnotations(annotations)
+		if _, _, err := r.getServiceAccountPolicy(context.Background(), sa); err == nil {
+			t.Errorf("Expected error for %v, got nil", annotations)
+		}
+	}
+}
@@ -29,6 +29,17 @@ type RoleBindingReconciler struct {
 	policies      vault.PolicyManager
 	roles         vault.RoleManager
 	useFinalizers bool
+	// attachablePolicies are the existing policies that may be attached to roles.
+	attachablePolicies []string
+	// aggregateRoles disables writing roles for rolebindings in favour of a single
+	// role per serviceaccount written by the ServiceAccountReconciler.
+	aggregateRoles bool
+	// roleDefaults are the auth role parameter defaults and maximums.
+	roleDefaults *vault.RoleDefaultsConfig
+	// pendingDeletions defers the deletion of vault objects for a grace period.
+	pendingDeletions *pendingDeletions
+	// ownership records the objects vault objects were written for by namespace.
+	ownership *ownershipRecords
 }
 
 func (r *RoleBindingReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -44,17 +55,38 @@ func (r *RoleBindingReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{}, nil
 	}
 
+	// Deletion relies on the state recorded on the rolebinding rather than its
+	// current annotations, which may no longer bind it to a vault role
+	if rb.GetDeletionTimestamp() != nil {
+		if err := r.reconcileDelete(ctx, &rb); err != nil {
+			r.recorder.Event(&rb, corev1.EventTypeWarning, api.EventReasonError, err.Error())
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
 	if util.IsIgnoredRoleBinding(&rb) {
 		log.Info("rolebinding is ignored, skipping")
 		r.recorder.Event(&rb, corev1.EventTypeNormal, api.EventReasonIgnored, "RoleBinding is ignored by the controller")
 		return ctrl.Result{}, nil
 	}
 
-	if rb.GetDeletionTimestamp() != nil {
-		if err := r.reconcileDelete(ctx, &rb); err != nil {
+	if bindsAllServiceAccounts(&rb) {
+		r.recorder.Event(&rb, corev1.EventTypeWarning, api.EventReasonRestricted,
+			"The group of all ServiceAccounts is only bound in the namespace of the RoleBinding")
+	}
+
+	if r.aggregateRoles {
+		// Remove any role written for the rolebinding before roles were aggregated
+		if err := removeRole(ctx, r.Client, r.roles, &rb); err != nil {
+			r.recorder.Event(&rb, corev1.EventTypeWarning, api.EventReasonError, err.Error())
+			return ctrl.Result{}, err
+		}
+		if err := r.ownership.Forget(ctx, &rb); err != nil {
 			r.recorder.Event(&rb, corev1.EventTypeWarning, api.EventReasonError, err.Error())
 			return ctrl.Result{}, err
 		}
+		r.recorder.Event(&rb, corev1.EventTypeNormal, api.EventReasonIgnored, "RoleBinding is aggregated into the roles of its ServiceAccounts")
 		return ctrl.Result{}, nil
 	}
 
@@ -78,7 +110,11 @@ func (r *RoleBindingReconciler) reconcileCreateUpdate(ctx context.Context, rb *r
 		return nil
 	}
 
-	params, err := buildAuthRoleParameters(ctx, r.Client, rb, []string{r.policies.PolicyName(&role)})
+	attached, err := attachedPolicies(rb, r.attachablePolicies)
+	if err != nil {
+		return err
+	}
+	params, err := buildAuthRoleParameters(ctx, r.Client, rb, append([]string{r.policies.PolicyName(&role)}, attached...), r.roleDefaults)
 	if err != nil {
 		return fmt.Errorf("unable to build auth role parameters: %w", err)
 	}
@@ -87,12 +123,26 @@ func (r *RoleBindingReconciler) reconcileCreateUpdate(ctx context.Context, rb *r
 	if err := r.roles.WriteRole(ctx, rb, params); err != nil {
 		return fmt.Errorf("unable to write role binding to vault: %w", err)
 	}
+	if err := recordAuthMounts(ctx, r.Client, rb, r.roles.AuthMounts(rb)); err != nil {
+		return fmt.Errorf("unable to record auth mounts on rolebinding: %w", err)
+	}
+	if err := recordRoleNamespaces(ctx, r.Client, rb, vault.RoleNamespaces(params)); err != nil {
+		return fmt.Errorf("unable to record role namespaces on rolebinding: %w", err)
+	}
+	loc, err := r.roles.Location(ctx, rb)
+	if err != nil {
+		return err
+	}
+	if err := recordLocation(ctx, r.Client, rb, loc); err != nil {
+		return fmt.Errorf("unable to record vault location on rolebinding: %w", err)
+	}
+	if err := r.ownership.Record(ctx, rb, false, true); err != nil {
+		return fmt.Errorf("unable to record ownership of vault objects: %w", err)
+	}
 
-	// Add finalizer if not present
-	if r.useFinalizers && !controllerutil.ContainsFinalizer(rb, api.ResourceFinalizer) {
-		if err := addFinalizer(ctx, r.Client, rb); err != nil {
-			return fmt.Errorf("unable to update rolebinding with finalizer: %w", err)
-		}
+	// Add or remove the finalizer as configured
+	if err := syncFinalizer(ctx, r.Client, rb, r.useFinalizers); err != nil {
+		return fmt.Errorf("unable to update rolebinding finalizer: %w", err)
 	}
 	r.recorder.Event(rb, corev1.EventTypeNormal, api.EventReasonSynced, "RoleBinding synced to Vault")
 	return nil
@@ -102,9 +152,28 @@ func (r *RoleBindingReconciler) reconcileDelete(ctx context.Context, rb *rbacv1.
 	if !controllerutil.ContainsFinalizer(rb, api.ResourceFinalizer) {
 		return nil
 	}
+	skip, err := skipCleanup(ctx, r.Client, r.useFinalizers, r.ownership, rb)
+	if err != nil {
+		return err
+	}
+	if skip {
+		if err := removeFinalizer(ctx, r.Client, rb); err != nil {
+			return fmt.Errorf("unable to remove finalizer from rolebinding: %w", err)
+		}
+		return nil
+	}
+	retained, err := retainVaultObjects(ctx, r.Client, r.recorder, r.pendingDeletions, rb, false, true)
+	if err != nil {
+		return err
+	}
 	// Delete the role binding from vault
-	if err := r.roles.DeleteRole(ctx, rb); err != nil {
-		return fmt.Errorf("unable to delete role binding from vault: %w", err)
+	if !retained {
+		if err := r.roles.DeleteRole(ctx, rb); err != nil {
+			return fmt.Errorf("unable to delete role binding from vault: %w", err)
+		}
+	}
+	if err := r.ownership.Forget(ctx, rb); err != nil {
+		return fmt.Errorf("unable to forget ownership of vault objects: %w", err)
 	}
 	if err := removeFinalizer(ctx, r.Client, rb); err != nil {
 		return fmt.Errorf("unable to remove finalizer from rolebinding: %w", err)
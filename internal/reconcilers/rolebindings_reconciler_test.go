@@ -136,5 +136,22 @@ var _ = Describe("RoleBindings Reconciler", func() {
 			})
 		})
 
+		When("the bind annotation is removed before the rolebinding is deleted", func() {
+
+			JustBeforeEach(func(ctx SpecContext) {
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(rb), rb)).To(Succeed())
+				annotations := rb.GetAnnotations()
+				delete(annotations, api.VaultRoleBindAnnotation)
+				rb.SetAnnotations(annotations)
+				Expect(k8sClient.Update(ctx, rb)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, rb)).To(Succeed())
+				Eventually(ObjectDeleted(ctx, rb), timeout, interval).Should(BeTrue())
+			})
+
+			It("should remove the role from vault", func(ctx SpecContext) {
+				Expect(VaultRole(ctx, vaultRoleBindingName)).To(BeNil())
+			})
+		})
+
 	})
 })
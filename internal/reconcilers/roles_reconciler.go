@@ -24,9 +24,16 @@ import (
 type RoleReconciler struct {
 	client.Client
 
-	recorder      record.EventRecorder
-	policies      vault.PolicyManager
-	useFinalizers bool
+	recorder       record.EventRecorder
+	policies       vault.PolicyManager
+	useFinalizers  bool
+	translateVerbs bool
+	policyFormat   vault.PolicyFormat
+	sharedPolicies *sharedPolicies
+	// pendingDeletions defers the deletion of vault objects for a grace period.
+	pendingDeletions *pendingDeletions
+	// ownership records the objects vault objects were written for by namespace.
+	ownership *ownershipRecords
 }
 
 func (r *RoleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -63,15 +70,40 @@ func (r *RoleReconciler) reconcileCreateUpdate(ctx context.Context, role *rbacv1
 		r.recorder.Event(role, corev1.EventTypeNormal, api.EventReasonIgnored, "Role does not contain any Vault ACLs")
 		return nil
 	}
-	policy := vault.ToJSONPolicyString(vault.FilterACLs(role.Rules))
+	pol, rules, err := rolePolicy(ctx, role, r.translateVerbs, r.sharedPolicies)
+	if err != nil {
+		return err
+	}
+	policy, err := pol.Format(r.policyFormat)
+	if err != nil {
+		return fmt.Errorf("unable to render policy: %w", err)
+	}
 	if err := r.policies.WritePolicy(ctx, role, policy); err != nil {
 		return fmt.Errorf("unable to put policy in vault: %w", err)
 	}
-	if r.useFinalizers && !controllerutil.ContainsFinalizer(role, api.ResourceFinalizer) {
-		if err := addFinalizer(ctx, r.Client, role); err != nil {
-			return fmt.Errorf("unable to update rolebinding with finalizer: %w", err)
+	loc, err := r.policies.Location(ctx, role)
+	if err != nil {
+		return err
+	}
+	if err := recordLocation(ctx, r.Client, role, loc); err != nil {
+		return fmt.Errorf("unable to record vault location on role: %w", err)
+	}
+	if err := r.ownership.Record(ctx, role, true, false); err != nil {
+		return fmt.Errorf("unable to record ownership of vault objects: %w", err)
+	}
+	conflicts := vault.FindPolicyConflicts(rules)
+	changed, err := recordPolicyConflicts(ctx, r.Client, role, conflicts)
+	if err != nil {
+		return fmt.Errorf("unable to record policy conflicts on role: %w", err)
+	}
+	if changed {
+		for _, conflict := range conflicts {
+			r.recorder.Event(role, corev1.EventTypeWarning, api.EventReasonConflict, conflict)
 		}
 	}
+	if err := syncFinalizer(ctx, r.Client, role, r.useFinalizers); err != nil {
+		return fmt.Errorf("unable to update role finalizer: %w", err)
+	}
 	r.recorder.Event(role, corev1.EventTypeNormal, api.EventReasonSynced, "Role policy synced to Vault")
 	return nil
 }
@@ -80,9 +112,28 @@ func (r *RoleReconciler) reconcileDelete(ctx context.Context, role *rbacv1.Role)
 	if !controllerutil.ContainsFinalizer(role, api.ResourceFinalizer) {
 		return nil
 	}
+	skip, err := skipCleanup(ctx, r.Client, r.useFinalizers, r.ownership, role)
+	if err != nil {
+		return err
+	}
+	if skip {
+		if err := removeFinalizer(ctx, r.Client, role); err != nil {
+			return fmt.Errorf("unable to remove finalizer from role: %w", err)
+		}
+		return nil
+	}
+	retained, err := retainVaultObjects(ctx, r.Client, r.recorder, r.pendingDeletions, role, true, false)
+	if err != nil {
+		return err
+	}
 	// Ensure the policy is deleted in vault
-	if err := r.policies.DeletePolicy(ctx, role); err != nil {
-		return fmt.Errorf("unable to delete policy in vault: %w", err)
+	if !retained {
+		if err := r.policies.DeletePolicy(ctx, role); err != nil {
+			return fmt.Errorf("unable to delete policy in vault: %w", err)
+		}
+	}
+	if err := r.ownership.Forget(ctx, role); err != nil {
+		return fmt.Errorf("unable to forget ownership of vault objects: %w", err)
 	}
 	// Remove the finalizer
 	if err := removeFinalizer(ctx, r.Client, role); err != nil {
@@ -90,3 +141,38 @@ func (r *RoleReconciler) reconcileDelete(ctx context.Context, role *rbacv1.Role)
 	}
 	return nil
 }
+
+// rolePolicy builds the policy for the Vault rules of the role, merged with the shared
+// policy it references. The rules the policy was built from are returned alongside it.
+func rolePolicy(ctx context.Context, role *rbacv1.Role, translateVerbs bool, shared *sharedPolicies) (*vault.Policy, []rbacv1.PolicyRule, error) {
+	rules := vault.FilterACLs(role.Rules)
+	if translateVerbs {
+		var err error
+		rules, err = vault.TranslateVerbs(rules)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to translate verbs: %w", err)
+		}
+	}
+	options, err := vault.ParsePathOptions(role)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse path options: %w", err)
+	}
+	pol, err := vault.PolicyFromRules(rules, options)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to build policy: %w", err)
+	}
+	sharedPolicy, ok, err := shared.Render(ctx, role)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		sharedPol, err := vault.ParsePolicy(sharedPolicy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse shared policy: %w", err)
+		}
+		if err := pol.Merge(sharedPol); err != nil {
+			return nil, nil, fmt.Errorf("unable to merge shared policy: %w", err)
+		}
+	}
+	return pol, rules, nil
+}
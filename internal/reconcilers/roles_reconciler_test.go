@@ -88,6 +88,37 @@ var _ = Describe("Roles Reconciler", func() {
 
 		})
 
+		Context("a Role that has conflicting Vault ACLs", func() {
+
+			BeforeEach(func() {
+				role.Rules = append(role.Rules, rbacv1.PolicyRule{
+					APIGroups: []string{"vault.hashicorp.com"},
+					Resources: []string{"secret/*"},
+					Verbs:     []string{"deny"},
+				})
+			})
+
+			It("should emit a Conflict event", func(ctx SpecContext) {
+				Eventually(func() ([]string, error) {
+					return EventReasons(ctx, role)
+				}, timeout, interval).Should(ContainElement(api.EventReasonConflict))
+			})
+
+			It("should record the reported conflicts on the role", func(ctx SpecContext) {
+				Eventually(func() (map[string]string, error) {
+					err := k8sClient.Get(ctx, client.ObjectKeyFromObject(role), role)
+					return role.GetAnnotations(), err
+				}, timeout, interval).Should(HaveKeyWithValue(api.ManagedPolicyConflictsAnnotation, ContainSubstring(`"secret/*"`)))
+			})
+
+			It("should create a merged policy in vault", func(ctx SpecContext) {
+				Eventually(func() (string, error) {
+					return VaultPolicy(ctx, vaultPolicyName)
+				}, timeout, interval).Should(ContainSubstring(`"deny"`))
+			})
+
+		})
+
 	})
 
 	When("cleaning up a Role", func() {
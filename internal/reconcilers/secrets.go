@@ -0,0 +1,51 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/util"
+)
+
+// referencingObjects returns a map function that enqueues every object of the listed
+// kind in the namespace of the changed object that references it by name in one of
+// the given annotations, which may hold a comma-separated list of names.
+func referencingObjects(reader client.Reader, newList func() client.ObjectList, annotations ...string) handler.MapFunc {
+	return func(obj client.Object) []reconcile.Request {
+		list := newList()
+		if err := reader.List(context.Background(), list, client.InNamespace(obj.GetNamespace())); err != nil {
+			ctrl.Log.Error(err, "unable to list objects referencing changed object", "namespace", obj.GetNamespace(), "name", obj.GetName())
+			return nil
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			ctrl.Log.Error(err, "unable to extract objects referencing changed object", "namespace", obj.GetNamespace(), "name", obj.GetName())
+			return nil
+		}
+		var requests []reconcile.Request
+		for _, item := range items {
+			ref, ok := item.(client.Object)
+			if !ok {
+				continue
+			}
+			for _, annotation := range annotations {
+				if contains(util.SplitList(ref.GetAnnotations()[annotation]), obj.GetName()) {
+					requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ref)})
+					break
+				}
+			}
+		}
+		return requests
+	}
+}
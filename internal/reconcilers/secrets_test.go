@@ -0,0 +1,92 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+)
+
+func TestSecretSources(t *testing.T) {
+	serviceAccount := func(namespace, name string, annotations map[string]string) *corev1.ServiceAccount {
+		return &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations}}
+	}
+	cli := fake.NewClientBuilder().WithObjects(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "confidential"},
+			Data: map[string][]byte{
+				api.VaultPolicyKey:  []byte(`path "secret/data/{{ .Name }}" { capabilities = ["read"] }`),
+				"token-bound-cidrs": []byte("10.0.0.0/8"),
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "params"},
+			Data:       map[string]string{"token_bound_cidrs": "0.0.0.0/0", "token_ttl": "1h"},
+		},
+		serviceAccount("default", "policy", map[string]string{api.VaultSecretPolicyAnnotation: "confidential"}),
+		serviceAccount("default", "params", map[string]string{api.VaultRoleSecretAnnotation: "confidential"}),
+		serviceAccount("default", "other", map[string]string{api.VaultRoleSecretAnnotation: "other"}),
+		serviceAccount("other", "params", map[string]string{api.VaultRoleSecretAnnotation: "confidential"}),
+	).Build()
+
+	r := &ServiceAccountReconciler{Client: cli}
+	sa := serviceAccount("default", "app", map[string]string{
+		api.VaultSecretPolicyAnnotation:   "confidential",
+		api.VaultPolicyTemplateAnnotation: "true",
+	})
+	policy, _, err := r.getServiceAccountPolicy(context.Background(), sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `path "secret/data/app" { capabilities = ["read"] }`; policy != expected {
+		t.Errorf("Expected policy %q, got %q", expected, policy)
+	}
+	sa.Annotations[api.VaultSecretPolicyAnnotation] = "missing"
+	if _, _, err := r.getServiceAccountPolicy(context.Background(), sa); err == nil {
+		t.Error("Expected error for a missing secret, got nil")
+	}
+
+	sa = serviceAccount("default", "app", map[string]string{
+		api.VaultRoleConfigMapAnnotation: "params",
+		api.VaultRoleSecretAnnotation:    "confidential",
+	})
+	params, err := buildAuthRoleParameters(context.Background(), cli, sa, []string{"policy"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cidrs, ok := params["token_bound_cidrs"].([]string); !ok || len(cidrs) != 1 || cidrs[0] != "10.0.0.0/8" {
+		t.Errorf("Expected the secret to override the configmap, got %v", params["token_bound_cidrs"])
+	}
+	if params["token_ttl"] != 3600 {
+		t.Errorf("Expected the configmap parameters to be kept, got %v", params["token_ttl"])
+	}
+
+	// Secrets are only watched by their metadata
+	secret := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "confidential"}}
+	referencing := referencingObjects(cli, func() client.ObjectList { return &corev1.ServiceAccountList{} },
+		api.VaultSecretPolicyAnnotation, api.VaultRoleSecretAnnotation)
+	requests := referencing(secret)
+	expected := []reconcile.Request{
+		{NamespacedName: client.ObjectKey{Namespace: "default", Name: "policy"}},
+		{NamespacedName: client.ObjectKey{Namespace: "default", Name: "params"}},
+	}
+	if !sameRequests(requests, expected) {
+		t.Errorf("Expected requests %v, got %v", expected, requests)
+	}
+	watched := func(obj client.Object) bool { return checkObject(obj, nil, []string{"default"}, false) }
+	if requests := watchedRequests(watched, referencing)(secret); len(requests) != 0 {
+		t.Errorf("Expected no requests for objects in excluded namespaces, got %v", requests)
+	}
+}
@@ -8,8 +8,9 @@ package reconcilers
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/record"
@@ -25,10 +26,26 @@ import (
 type ServiceAccountReconciler struct {
 	client.Client
 
-	recorder      record.EventRecorder
-	policies      vault.PolicyManager
-	roles         vault.RoleManager
-	useFinalizers bool
+	recorder       record.EventRecorder
+	policies       vault.PolicyManager
+	roles          vault.RoleManager
+	useFinalizers  bool
+	policyFormat   vault.PolicyFormat
+	sharedPolicies *sharedPolicies
+	// attachablePolicies are the existing policies that may be attached to roles.
+	attachablePolicies []string
+	// aggregateRoles writes a single role per serviceaccount bound to the policies
+	// of all Roles bound to it.
+	aggregateRoles bool
+	// translateVerbs maps Kubernetes verbs in the rules of Roles merged into
+	// serviceaccount policies to Vault capabilities.
+	translateVerbs bool
+	// roleDefaults are the auth role parameter defaults and maximums.
+	roleDefaults *vault.RoleDefaultsConfig
+	// pendingDeletions defers the deletion of vault objects for a grace period.
+	pendingDeletions *pendingDeletions
+	// ownership records the objects vault objects were written for by namespace.
+	ownership *ownershipRecords
 }
 
 func (r *ServiceAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -44,26 +61,36 @@ func (r *ServiceAccountReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		return ctrl.Result{}, nil
 	}
 
-	if util.IsIgnoredServiceAccount(&sa) {
-		log.Info("serviceaccount is ignored, skipping")
-		r.recorder.Event(&sa, corev1.EventTypeNormal, api.EventReasonIgnored, "ServiceAccount is ignored by the controller")
-		return ctrl.Result{}, nil
-	}
-
-	if !vault.HasACLs(&sa) {
-		log.Info("no vault rules found in serviceaccount, skipping")
-		r.recorder.Event(&sa, corev1.EventTypeNormal, api.EventReasonIgnored, "ServiceAccount does not define any Vault ACLs")
+	// Deletion relies on the state recorded on the serviceaccount rather than its
+	// current annotations, which may no longer define any vault objects
+	if sa.GetDeletionTimestamp() != nil {
+		if err := r.reconcileDelete(ctx, &sa); err != nil {
+			r.recorder.Event(&sa, corev1.EventTypeWarning, api.EventReasonError, err.Error())
+			return ctrl.Result{}, err
+		}
 		return ctrl.Result{}, nil
 	}
 
-	if sa.GetDeletionTimestamp() != nil {
-		if err := r.reconcileDelete(ctx, &sa); err != nil {
+	if r.aggregateRoles {
+		if err := r.reconcileAggregated(ctx, &sa); err != nil {
 			r.recorder.Event(&sa, corev1.EventTypeWarning, api.EventReasonError, err.Error())
 			return ctrl.Result{}, err
 		}
 		return ctrl.Result{}, nil
 	}
 
+	if util.IsIgnoredServiceAccount(&sa) {
+		log.Info("serviceaccount is ignored, skipping")
+		r.recorder.Event(&sa, corev1.EventTypeNormal, api.EventReasonIgnored, "ServiceAccount is ignored by the controller")
+		return ctrl.Result{}, nil
+	}
+
+	if !vault.HasACLs(&sa) && !util.HasAnnotation(&sa, api.VaultAttachPoliciesAnnotation) {
+		log.Info("no vault rules or attached policies found in serviceaccount, skipping")
+		r.recorder.Event(&sa, corev1.EventTypeNormal, api.EventReasonIgnored, "ServiceAccount does not define any Vault ACLs or attached policies")
+		return ctrl.Result{}, nil
+	}
+
 	if err := r.reconcileCreateUpdate(ctx, &sa); err != nil {
 		r.recorder.Event(&sa, corev1.EventTypeWarning, api.EventReasonError, err.Error())
 		return ctrl.Result{}, err
@@ -72,15 +99,18 @@ func (r *ServiceAccountReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 }
 
 func (r *ServiceAccountReconciler) reconcileCreateUpdate(ctx context.Context, sa *corev1.ServiceAccount) error {
-	// Create the policy in vault
-	policy, err := r.getServiceAccountPolicy(ctx, sa)
+	policies, err := attachedPolicies(sa, r.attachablePolicies)
 	if err != nil {
-		return fmt.Errorf("unable to get serviceaccount policy: %w", err)
+		return err
 	}
-	if err := r.policies.WritePolicy(ctx, sa, policy); err != nil {
-		return fmt.Errorf("unable to put policy in vault: %w", err)
+	// Create the policy in vault, unless the serviceaccount only attaches existing policies
+	if vault.HasACLs(sa) {
+		if err := r.writePolicy(ctx, sa); err != nil {
+			return err
+		}
+		policies = append([]string{r.policies.PolicyName(sa)}, policies...)
 	}
-	params, err := buildAuthRoleParameters(ctx, r.Client, sa, []string{r.policies.PolicyName(sa)})
+	params, err := buildAuthRoleParameters(ctx, r.Client, sa, policies, r.roleDefaults)
 	if err != nil {
 		return fmt.Errorf("unable to build auth role parameters: %w", err)
 	}
@@ -88,28 +118,92 @@ func (r *ServiceAccountReconciler) reconcileCreateUpdate(ctx context.Context, sa
 	if err := r.roles.WriteRole(ctx, sa, params); err != nil {
 		return fmt.Errorf("unable to put auth role in vault: %w", err)
 	}
-	// Add finalizer if not present
-	if r.useFinalizers && !controllerutil.ContainsFinalizer(sa, api.ResourceFinalizer) {
-		if err := addFinalizer(ctx, r.Client, sa); err != nil {
-			return fmt.Errorf("unable to update serviceaccount with finalizer: %w", err)
+	if err := recordAuthMounts(ctx, r.Client, sa, r.roles.AuthMounts(sa)); err != nil {
+		return fmt.Errorf("unable to record auth mounts on serviceaccount: %w", err)
+	}
+	if err := r.recordLocation(ctx, sa); err != nil {
+		return err
+	}
+	// Remove the policy written before the serviceaccount only attached existing ones
+	if !vault.HasACLs(sa) {
+		if err := removePolicy(ctx, r.Client, r.policies, sa); err != nil {
+			return err
 		}
 	}
+	if err := r.ownership.Record(ctx, sa, util.HasAnnotation(sa, api.ManagedPolicyAnnotation), true); err != nil {
+		return fmt.Errorf("unable to record ownership of vault objects: %w", err)
+	}
+	// Add or remove the finalizer as configured
+	if err := syncFinalizer(ctx, r.Client, sa, r.useFinalizers); err != nil {
+		return fmt.Errorf("unable to update serviceaccount finalizer: %w", err)
+	}
 	r.recorder.Event(sa, corev1.EventTypeNormal, api.EventReasonSynced, "ServiceAccount synced to Vault")
 	return nil
 }
 
+func (r *ServiceAccountReconciler) writePolicy(ctx context.Context, sa *corev1.ServiceAccount) error {
+	policy, sources, err := r.getServiceAccountPolicy(ctx, sa)
+	if err != nil {
+		return fmt.Errorf("unable to get serviceaccount policy: %w", err)
+	}
+	policy, err = vault.FormatPolicy(policy, r.policyFormat)
+	if err != nil {
+		return fmt.Errorf("unable to render serviceaccount policy: %w", err)
+	}
+	if err := r.policies.WritePolicy(ctx, sa, policy); err != nil {
+		return fmt.Errorf("unable to put policy in vault: %w", err)
+	}
+	if err := recordPolicy(ctx, r.Client, sa, r.policies.PolicyName(sa)); err != nil {
+		return fmt.Errorf("unable to record policy on serviceaccount: %w", err)
+	}
+	// The sources are only reported when they change
+	changed, err := recordPolicySources(ctx, r.Client, sa, sources)
+	if err != nil {
+		return fmt.Errorf("unable to record policy sources on serviceaccount: %w", err)
+	}
+	if changed && len(sources) > 1 {
+		r.recorder.Event(sa, corev1.EventTypeNormal, api.EventReasonComposed,
+			fmt.Sprintf("Policy composed from %s, in order of precedence", strings.Join(sources, ", ")))
+	}
+	return nil
+}
+
 func (r *ServiceAccountReconciler) reconcileDelete(ctx context.Context, sa *corev1.ServiceAccount) error {
 	if !controllerutil.ContainsFinalizer(sa, api.ResourceFinalizer) {
 		// Nothing to do
 		return nil
 	}
-	// Ensure the policy is deleted in vault
-	if err := r.policies.DeletePolicy(ctx, sa); err != nil {
-		return fmt.Errorf("unable to delete policy in vault: %w", err)
+	skip, err := skipCleanup(ctx, r.Client, r.useFinalizers, r.ownership, sa)
+	if err != nil {
+		return err
 	}
-	// Ensure the auth role is deleted in vault
-	if err := r.roles.DeleteRole(ctx, sa); err != nil {
-		return fmt.Errorf("unable to delete auth role in vault: %w", err)
+	if skip {
+		if err := removeFinalizer(ctx, r.Client, sa); err != nil {
+			return fmt.Errorf("unable to remove finalizer from serviceaccount: %w", err)
+		}
+		return nil
+	}
+	// Serviceaccounts that only attach existing policies never wrote one. The recorded
+	// policy is deleted even if the serviceaccount no longer defines any ACLs.
+	deletePolicy := util.HasAnnotation(sa, api.ManagedPolicyAnnotation) || (vault.HasACLs(sa) && !util.IsIgnoredServiceAccount(sa))
+	retained, err := retainVaultObjects(ctx, r.Client, r.recorder, r.pendingDeletions, sa, deletePolicy, true)
+	if err != nil {
+		return err
+	}
+	if !retained {
+		// Ensure the policy is deleted in vault
+		if deletePolicy {
+			if err := r.policies.DeletePolicy(ctx, managedPolicyObject(sa)); err != nil {
+				return fmt.Errorf("unable to delete policy in vault: %w", err)
+			}
+		}
+		// Ensure the auth role is deleted in vault
+		if err := r.roles.DeleteRole(ctx, sa); err != nil {
+			return fmt.Errorf("unable to delete auth role in vault: %w", err)
+		}
+	}
+	if err := r.ownership.Forget(ctx, sa); err != nil {
+		return fmt.Errorf("unable to forget ownership of vault objects: %w", err)
 	}
 	// Remove the finalizer
 	if err := removeFinalizer(ctx, r.Client, sa); err != nil {
@@ -118,18 +212,43 @@ func (r *ServiceAccountReconciler) reconcileDelete(ctx context.Context, sa *core
 	return nil
 }
 
-func (r *ServiceAccountReconciler) getServiceAccountPolicy(ctx context.Context, sa *corev1.ServiceAccount) (string, error) {
-	if util.HasAnnotation(sa, api.VaultInlinePolicyAnnotation) {
-		return sa.GetAnnotations()[api.VaultInlinePolicyAnnotation], nil
+// recordLocation records the location the policy and role of the serviceaccount were
+// written to.
+func (r *ServiceAccountReconciler) recordLocation(ctx context.Context, sa *corev1.ServiceAccount) error {
+	loc, err := r.roles.Location(ctx, sa)
+	if err != nil {
+		return err
 	}
-	name := sa.GetAnnotations()[api.VaultConfigMapPolicyAnnotation]
-	var cm corev1.ConfigMap
-	if err := r.Get(ctx, client.ObjectKey{Namespace: sa.GetNamespace(), Name: name}, &cm); err != nil {
-		return "", fmt.Errorf("failed to get configmap: %w", err)
+	if err := recordLocation(ctx, r.Client, sa, loc); err != nil {
+		return fmt.Errorf("unable to record vault location on serviceaccount: %w", err)
 	}
-	policy, ok := cm.Data[api.VaultPolicyKey]
-	if !ok {
-		return "", errors.New("configmap does not have a policy key")
+	return nil
+}
+
+// getServiceAccountPolicy returns the policy of the serviceaccount composed from all of
+// its sources, along with a description of each source in order of precedence.
+func (r *ServiceAccountReconciler) getServiceAccountPolicy(ctx context.Context, sa *corev1.ServiceAccount) (string, []string, error) {
+	sources, err := r.policySources(ctx, sa)
+	if err != nil {
+		return "", nil, err
+	}
+	policy, err := composePolicy(sources)
+	if err != nil {
+		return "", nil, err
 	}
-	return policy, nil
+	descriptions := make([]string, len(sources))
+	for i, source := range sources {
+		descriptions[i] = source.description
+	}
+	return policy, descriptions, nil
+}
+
+// isPolicyTemplate returns true if the object marks its policy as a template.
+func isPolicyTemplate(obj client.Object) bool {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		return false
+	}
+	template, _ := strconv.ParseBool(annotations[api.VaultPolicyTemplateAnnotation])
+	return template
 }
@@ -14,6 +14,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	vaultapi "github.com/hashicorp/vault/api"
+
 	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
 )
 
@@ -117,6 +119,89 @@ var _ = Describe("ServiceAccounts Reconciler", func() {
 			})
 		})
 
+		Context("a ServiceAccount that only attaches existing policies", func() {
+
+			BeforeEach(func() {
+				sa.Annotations = map[string]string{
+					api.VaultRoleBindAnnotation:       "true",
+					api.VaultAttachPoliciesAnnotation: "default",
+				}
+			})
+
+			It("should emit a Synced event", func(ctx SpecContext) {
+				Eventually(EventOccurred(ctx, sa), timeout, interval).Should(BeTrue())
+				Expect(MostRecentEventReason(ctx, sa)).To(Equal(api.EventReasonSynced))
+			})
+
+			It("should not create a policy in vault", func(ctx SpecContext) {
+				Eventually(EventOccurred(ctx, sa), timeout, interval).Should(BeTrue())
+				Expect(VaultPolicy(ctx, vaultSaName)).To(BeEmpty())
+			})
+
+			It("should create a role bound to the attached policies", func(ctx SpecContext) {
+				Eventually(EventOccurred(ctx, sa), timeout, interval).Should(BeTrue())
+				role, err := VaultRole(ctx, vaultSaName)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(role).ToNot(BeNil())
+				Expect(role.Data["token_policies"]).To(ConsistOf("default"))
+			})
+		})
+
+		Context("a ServiceAccount that attaches a policy that is not allowed", func() {
+
+			BeforeEach(func() {
+				sa.Annotations = map[string]string{
+					api.VaultRoleBindAnnotation:       "true",
+					api.VaultAttachPoliciesAnnotation: "root",
+				}
+			})
+
+			It("should emit an Error event", func(ctx SpecContext) {
+				Eventually(EventOccurred(ctx, sa), timeout, interval).Should(BeTrue())
+				Expect(MostRecentEventReason(ctx, sa)).To(Equal(api.EventReasonError))
+			})
+
+			It("should not create a role in vault", func(ctx SpecContext) {
+				Eventually(EventOccurred(ctx, sa), timeout, interval).Should(BeTrue())
+				Expect(VaultRole(ctx, vaultSaName)).To(BeNil())
+			})
+		})
+
+		Context("a ServiceAccount that targets multiple auth mounts", func() {
+
+			BeforeEach(func() {
+				sa.Annotations = map[string]string{
+					api.VaultRoleBindAnnotation:     "true",
+					api.VaultInlinePolicyAnnotation: `path "secret/data/*" { capabilities = ["read"] }`,
+					api.VaultAuthMountsAnnotation:   "kubernetes,kubernetes-secondary",
+				}
+			})
+
+			It("should create a role in each mount", func(ctx SpecContext) {
+				Eventually(EventOccurred(ctx, sa), timeout, interval).Should(BeTrue())
+				Expect(VaultRoleInMount(ctx, "kubernetes", vaultSaName)).ToNot(BeNil())
+				Expect(VaultRoleInMount(ctx, "kubernetes-secondary", vaultSaName)).ToNot(BeNil())
+			})
+
+			It("should record the auth mounts", func(ctx SpecContext) {
+				Eventually(EventOccurred(ctx, sa), timeout, interval).Should(BeTrue())
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(sa), sa)).To(Succeed())
+				Expect(sa.GetAnnotations()).To(HaveKeyWithValue(api.ManagedAuthMountsAnnotation, "kubernetes,kubernetes-secondary"))
+				Expect(sa.GetAnnotations()).To(HaveKeyWithValue(api.ManagedPolicyAnnotation, vaultSaName))
+			})
+
+			It("should remove the role from a mount that is no longer targeted", func(ctx SpecContext) {
+				Eventually(EventOccurred(ctx, sa), timeout, interval).Should(BeTrue())
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(sa), sa)).To(Succeed())
+				sa.Annotations[api.VaultAuthMountsAnnotation] = "kubernetes"
+				Expect(k8sClient.Update(ctx, sa)).To(Succeed())
+				Eventually(func() (*vaultapi.Secret, error) {
+					return VaultRoleInMount(ctx, "kubernetes-secondary", vaultSaName)
+				}, timeout, interval).Should(BeNil())
+				Expect(VaultRoleInMount(ctx, "kubernetes", vaultSaName)).ToNot(BeNil())
+			})
+		})
+
 		Context("a ServiceAccount that has a configmap policy", func() {
 
 			var policy = `path "secret/data/*" { capabilities = ["create"] }`
@@ -163,6 +248,42 @@ var _ = Describe("ServiceAccounts Reconciler", func() {
 			})
 		})
 
+		Context("a ServiceAccount that references a policy template", func() {
+
+			BeforeEach(func(ctx SpecContext) {
+				sa.Annotations = map[string]string{
+					api.VaultRoleBindAnnotation:        "true",
+					api.VaultConfigMapPolicyAnnotation: "configmap-policy-template",
+				}
+				cm := &corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "configmap-policy-template",
+						Namespace:   "serviceaccount",
+						Annotations: map[string]string{api.VaultPolicyTemplateAnnotation: "true"},
+					},
+					Data: map[string]string{
+						api.VaultPolicyKey: `path "secret/data/{{ .Namespace }}/{{ .Name }}/*" { capabilities = ["read"] }`,
+					},
+				}
+				Expect(k8sClient.Create(ctx, cm)).To(Succeed())
+			})
+
+			AfterEach(func(ctx SpecContext) {
+				Expect(k8sClient.Delete(ctx, &corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "configmap-policy-template",
+						Namespace: "serviceaccount",
+					},
+				})).To(Succeed())
+			})
+
+			It("should create the rendered policy in vault", func(ctx SpecContext) {
+				Eventually(EventOccurred(ctx, sa), timeout, interval).Should(BeTrue())
+				Expect(VaultPolicy(ctx, vaultSaName)).To(Equal(
+					`path "secret/data/serviceaccount/serviceaccount/*" { capabilities = ["read"] }`))
+			})
+		})
+
 	})
 
 	When("cleaning up a ServiceAccount", func() {
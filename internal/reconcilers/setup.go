@@ -7,64 +7,285 @@
 package reconcilers
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
 	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
 )
 
 // Options are the options for configuring the reconcilers.
 type Options struct {
-	AuthMount               string
+	AuthMounts        []string
+	JWTAuthMounts     []string
+	JWTBoundAudiences []string
+	JWTUserClaim      string
+	// VaultNamespaceTemplate is the template used to map objects to Vault
+	// Enterprise namespaces. See vault.NewNamespaceMapper for details.
+	VaultNamespaceTemplate  string
 	Namespaces              []string
 	ExcludeNamespaces       []string
 	IncludeSystemNamespaces bool
 	UseFinalizers           bool
+	// Uninstall removes the finalizer from every resource in the cluster instead of
+	// running the reconcilers, so the controller can be removed safely.
+	Uninstall bool
+	// Stop is called to shut down the manager once the finalizers are removed in
+	// uninstall mode.
+	Stop func()
+	// TranslateVerbs maps Kubernetes verbs in Role rules to Vault capabilities.
+	TranslateVerbs bool
+	// RolePolicyFormat and ServiceAccountPolicyFormat are the formats policies
+	// are written to Vault in by the respective controllers.
+	RolePolicyFormat           vault.PolicyFormat
+	ServiceAccountPolicyFormat vault.PolicyFormat
+	// VaultConnections are the named Vault connections objects may select. If
+	// nil, all objects use the client configured from the environment.
+	VaultConnections *vault.ConnectionsConfig
+	// ConfigureAuthMount enables the auth mount if missing and keeps its
+	// configuration in sync with the cluster the controller is running in.
+	ConfigureAuthMount bool
+	AuthMountOptions   AuthMountOptions
+	// SharedPolicyNamespace is the namespace holding the ConfigMaps of shared policy
+	// templates. If empty, shared policies are disabled.
+	SharedPolicyNamespace string
+	// AttachablePolicies are the names or glob patterns of existing Vault policies
+	// that resources may attach to their roles.
+	AttachablePolicies []string
+	// AggregateRoles writes a single role per ServiceAccount bound to the policies of
+	// every Role bound to it, instead of a role per RoleBinding.
+	AggregateRoles bool
+	// RoleDefaults are the auth role parameter defaults and the maximums enforced
+	// on them. If nil, roles only use the parameters of their resources.
+	RoleDefaults *vault.RoleDefaultsConfig
+	// ControllerNamespace is the namespace the controller keeps its own state in.
+	ControllerNamespace string
+	// DeletionGracePeriod defers the deletion of the Vault objects of deleted resources,
+	// so they are kept if the resource is recreated in time. Requires ControllerNamespace.
+	DeletionGracePeriod time.Duration
+	// Tombstones is where the last definition of deleted policies and roles is kept,
+	// so they can be restored. See vault.NewTombstoneStore for the accepted values.
+	// If empty, deleted policies and roles are not kept.
+	Tombstones string
+	// TombstoneRetention is how long tombstones are kept in the ConfigMap. If zero,
+	// they are kept until the ConfigMap is full.
+	TombstoneRetention time.Duration
+	// NamespaceCleanup records the objects of every namespace that Vault objects are
+	// written for, and removes those Vault objects in a single pass once the namespace
+	// is deleted. Requires ControllerNamespace.
+	NamespaceCleanup bool
 }
 
 // SetupWithManager sets up all reconcilers with the given manager.
 func SetupWithManager(mgr ctrl.Manager, opts *Options) error {
-	policies := vault.NewPolicyManager()
-	roles := vault.NewRoleManager(opts.AuthMount)
+	watched := func(obj client.Object) bool {
+		return checkObject(obj, opts.Namespaces, opts.ExcludeNamespaces, opts.IncludeSystemNamespaces)
+	}
+	// Existing resources are brought in line with the finalizer configuration
+	if err := mgr.Add(&finalizerSync{
+		client:        mgr.GetClient(),
+		useFinalizers: opts.UseFinalizers,
+		uninstall:     opts.Uninstall,
+		stop:          opts.Stop,
+		watched:       watched,
+	}); err != nil {
+		return err
+	}
+	if opts.Uninstall {
+		return nil
+	}
+	for _, format := range []vault.PolicyFormat{opts.RolePolicyFormat, opts.ServiceAccountPolicyFormat} {
+		if format == "" {
+			continue
+		}
+		if err := format.Validate(); err != nil {
+			return err
+		}
+	}
+	namespaces, err := vault.NewNamespaceMapper(mgr.GetClient(), opts.VaultNamespaceTemplate)
+	if err != nil {
+		return err
+	}
+	var connections vault.ConnectionSelector
+	if opts.VaultConnections != nil {
+		connections = vault.NewConnectionSelector(mgr.GetClient(), opts.VaultConnections)
+	}
+	// Vault is checked through the configured connections on healthz
+	if err := mgr.AddHealthzCheck("vault", func(req *http.Request) error {
+		return vault.Health(req.Context(), connections)
+	}); err != nil {
+		return err
+	}
+	tombstones, err := vault.NewTombstoneStore(opts.Tombstones, mgr.GetClient(), opts.ControllerNamespace, opts.TombstoneRetention, connections)
+	if err != nil {
+		return err
+	}
 	recorder := mgr.GetEventRecorderFor("vault-rbac-controller")
+	policies := vault.NewPolicyManager(&vault.PolicyManagerOptions{
+		Connections: connections,
+		Namespaces:  namespaces,
+		Tombstones:  tombstones,
+		Recorder:    recorder,
+	})
+	roles := vault.NewRoleManager(&vault.RoleManagerOptions{
+		AuthMounts:        opts.AuthMounts,
+		JWTAuthMounts:     opts.JWTAuthMounts,
+		JWTBoundAudiences: opts.JWTBoundAudiences,
+		JWTUserClaim:      opts.JWTUserClaim,
+		Connections:       connections,
+		Namespaces:        namespaces,
+		Tombstones:        tombstones,
+		Recorder:          recorder,
+	})
+	var pending *pendingDeletions
+	if opts.DeletionGracePeriod > 0 {
+		if opts.ControllerNamespace == "" {
+			return errors.New("a controller namespace is required to defer deletions")
+		}
+		pending = &pendingDeletions{
+			client:      mgr.GetClient(),
+			namespace:   opts.ControllerNamespace,
+			gracePeriod: opts.DeletionGracePeriod,
+			policies:    policies,
+			roles:       roles,
+		}
+		if err := mgr.Add(pending); err != nil {
+			return err
+		}
+	}
+	var ownership *ownershipRecords
+	if opts.NamespaceCleanup {
+		if opts.ControllerNamespace == "" {
+			return errors.New("a controller namespace is required to clean up deleted namespaces")
+		}
+		ownership = &ownershipRecords{client: mgr.GetClient(), namespace: opts.ControllerNamespace}
+	}
+	var shared *sharedPolicies
+	if opts.SharedPolicyNamespace != "" {
+		shared = &sharedPolicies{reader: mgr.GetClient(), namespace: opts.SharedPolicyNamespace}
+	}
 	roleReconciler := &RoleReconciler{
-		Client:        mgr.GetClient(),
-		recorder:      recorder,
-		policies:      policies,
-		useFinalizers: opts.UseFinalizers,
+		Client:           mgr.GetClient(),
+		recorder:         recorder,
+		policies:         policies,
+		useFinalizers:    opts.UseFinalizers,
+		translateVerbs:   opts.TranslateVerbs,
+		policyFormat:     opts.RolePolicyFormat,
+		sharedPolicies:   shared,
+		pendingDeletions: pending,
+		ownership:        ownership,
 	}
 	rbReconciler := &RoleBindingReconciler{
-		Client:        mgr.GetClient(),
-		recorder:      recorder,
-		policies:      policies,
-		roles:         roles,
-		useFinalizers: opts.UseFinalizers,
+		Client:             mgr.GetClient(),
+		recorder:           recorder,
+		policies:           policies,
+		roles:              roles,
+		useFinalizers:      opts.UseFinalizers,
+		attachablePolicies: opts.AttachablePolicies,
+		aggregateRoles:     opts.AggregateRoles,
+		roleDefaults:       opts.RoleDefaults,
+		pendingDeletions:   pending,
+		ownership:          ownership,
 	}
 	saReconciler := &ServiceAccountReconciler{
-		Client:        mgr.GetClient(),
-		recorder:      recorder,
-		policies:      policies,
-		roles:         roles,
-		useFinalizers: opts.UseFinalizers,
+		Client:             mgr.GetClient(),
+		recorder:           recorder,
+		policies:           policies,
+		roles:              roles,
+		useFinalizers:      opts.UseFinalizers,
+		policyFormat:       opts.ServiceAccountPolicyFormat,
+		translateVerbs:     opts.TranslateVerbs,
+		sharedPolicies:     shared,
+		attachablePolicies: opts.AttachablePolicies,
+		aggregateRoles:     opts.AggregateRoles,
+		roleDefaults:       opts.RoleDefaults,
+		pendingDeletions:   pending,
+		ownership:          ownership,
+	}
+	if opts.ConfigureAuthMount {
+		mounts := vault.NewAuthMountManager(&vault.AuthMountManagerOptions{
+			Connections: connections,
+			Namespaces:  namespaces,
+		})
+		for _, mount := range opts.AuthMounts {
+			// Only Kubernetes auth mounts are configured, JWT mounts are left to the administrator
+			if contains(opts.JWTAuthMounts, mount) {
+				continue
+			}
+			if err := mgr.Add(&authMountSyncer{
+				client:     mgr.GetClient(),
+				mounts:     mounts,
+				mount:      mount,
+				restConfig: mgr.GetConfig(),
+				opts:       &opts.AuthMountOptions,
+				watched:    watched,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	// The namespace filter is applied to the primary resources only, so that shared
+	// policies are watched even when their namespace is excluded.
+	eventFilter := builder.WithPredicates(checkNamespacesPredicate(opts.Namespaces, opts.ExcludeNamespaces, opts.IncludeSystemNamespaces))
+	roleBuilder := ctrl.NewControllerManagedBy(mgr).For(&rbacv1.Role{}, eventFilter)
+	rbBuilder := ctrl.NewControllerManagedBy(mgr).For(&rbacv1.RoleBinding{}, eventFilter).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(watchedRequests(watched, referencingObjects(mgr.GetClient(),
+			func() client.ObjectList { return &rbacv1.RoleBindingList{} }, api.VaultRoleSecretAnnotation))), builder.OnlyMetadata)
+	saBuilder := ctrl.NewControllerManagedBy(mgr).For(&corev1.ServiceAccount{}, eventFilter).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(watchedRequests(watched, referencingObjects(mgr.GetClient(),
+			func() client.ObjectList { return &corev1.ServiceAccountList{} }, api.VaultSecretPolicyAnnotation, api.VaultRoleSecretAnnotation))), builder.OnlyMetadata).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(watchedRequests(watched, referencingObjects(mgr.GetClient(),
+			func() client.ObjectList { return &corev1.ServiceAccountList{} }, api.VaultConfigMapPolicyAnnotation)))).
+		Watches(&source.Kind{Type: &rbacv1.Role{}}, handler.EnqueueRequestsFromMapFunc(watchedRequests(watched, referencingObjects(mgr.GetClient(),
+			func() client.ObjectList { return &corev1.ServiceAccountList{} }, api.VaultPolicyRolesAnnotation))))
+	if shared != nil {
+		roleBuilder = roleBuilder.Watches(&source.Kind{Type: &corev1.ConfigMap{}},
+			handler.EnqueueRequestsFromMapFunc(watchedRequests(watched, shared.consumers(func() client.ObjectList { return &rbacv1.RoleList{} }))))
+		saBuilder = saBuilder.Watches(&source.Kind{Type: &corev1.ConfigMap{}},
+			handler.EnqueueRequestsFromMapFunc(watchedRequests(watched, shared.consumers(func() client.ObjectList { return &corev1.ServiceAccountList{} }))))
+	}
+	if opts.AggregateRoles {
+		// The rolebindings of a serviceaccount are looked up by the serviceaccounts they bind
+		if err := mgr.GetFieldIndexer().IndexField(context.Background(), &rbacv1.RoleBinding{},
+			boundServiceAccountIndex, indexBoundServiceAccounts); err != nil {
+			return err
+		}
+		saBuilder = saBuilder.
+			Watches(&source.Kind{Type: &rbacv1.RoleBinding{}}, handler.EnqueueRequestsFromMapFunc(watchedRequests(watched, serviceAccountsForRoleBinding(mgr.GetClient())))).
+			Watches(&source.Kind{Type: &rbacv1.Role{}}, handler.EnqueueRequestsFromMapFunc(watchedRequests(watched, serviceAccountsForRole(mgr.GetClient()))))
+	}
+	builders := map[reconcile.Reconciler]*builder.Builder{
+		roleReconciler: roleBuilder,
+		rbReconciler:   rbBuilder,
+		saReconciler:   saBuilder,
+	}
+	if ownership != nil {
+		nsReconciler := &NamespaceReconciler{
+			Client:           mgr.GetClient(),
+			recorder:         recorder,
+			policies:         policies,
+			roles:            roles,
+			ownership:        ownership,
+			pendingDeletions: pending,
+		}
+		builders[nsReconciler] = ctrl.NewControllerManagedBy(mgr).For(&corev1.Namespace{}).
+			Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(ownership.ownedNamespace))
 	}
-	eventFilter := checkNamespacesPredicate(opts.Namespaces, opts.ExcludeNamespaces, opts.IncludeSystemNamespaces)
-	for reconciler, builder := range map[reconcile.Reconciler]*builder.Builder{
-		roleReconciler: ctrl.NewControllerManagedBy(mgr).
-			For(&rbacv1.Role{}).
-			WithEventFilter(eventFilter),
-		rbReconciler: ctrl.NewControllerManagedBy(mgr).
-			For(&rbacv1.RoleBinding{}).
-			WithEventFilter(eventFilter),
-		saReconciler: ctrl.NewControllerManagedBy(mgr).
-			For(&corev1.ServiceAccount{}).
-			WithEventFilter(eventFilter),
-	} {
+	for reconciler, builder := range builders {
 		if err := builder.Complete(reconciler); err != nil {
 			return err
 		}
@@ -89,6 +310,20 @@ func checkNamespacesPredicate(namespaces []string, excludeNamespaces []string, i
 	}
 }
 
+// watchedRequests filters the requests of the map function to objects in the watched
+// namespaces, as the namespace predicate only applies to the primary resources.
+func watchedRequests(watched func(client.Object) bool, fn handler.MapFunc) handler.MapFunc {
+	return func(obj client.Object) []reconcile.Request {
+		var requests []reconcile.Request
+		for _, req := range fn(obj) {
+			if watched(&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: req.Namespace, Name: req.Name}}) {
+				requests = append(requests, req)
+			}
+		}
+		return requests
+	}
+}
+
 func checkObject(obj client.Object, namespaces []string, excludeNamespaces []string, includeKubeSystem bool) bool {
 	ns := obj.GetNamespace()
 	if !includeKubeSystem && isSystemNamespace(ns) {
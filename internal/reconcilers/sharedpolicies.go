@@ -0,0 +1,88 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+// sharedPolicies is the catalogue of policy templates kept as ConfigMaps in a
+// single namespace owned by the platform team.
+type sharedPolicies struct {
+	reader    client.Reader
+	namespace string
+}
+
+// Render returns the shared policy referenced by the object rendered as a template
+// of the object. The second return value is false if the object does not reference
+// a shared policy.
+func (s *sharedPolicies) Render(ctx context.Context, obj client.Object) (string, bool, error) {
+	name, ok := obj.GetAnnotations()[api.VaultSharedPolicyAnnotation]
+	if !ok {
+		return "", false, nil
+	}
+	if s == nil {
+		return "", true, errors.New("shared policies are not enabled on the controller")
+	}
+	var cm corev1.ConfigMap
+	if err := s.reader.Get(ctx, client.ObjectKey{Namespace: s.namespace, Name: name}, &cm); err != nil {
+		return "", true, fmt.Errorf("failed to get shared policy %q: %w", name, err)
+	}
+	policy, ok := cm.Data[api.VaultPolicyKey]
+	if !ok {
+		return "", true, fmt.Errorf("shared policy %q does not have a policy key", name)
+	}
+	rendered, err := vault.RenderPolicyTemplate(policy, obj)
+	if err != nil {
+		return "", true, fmt.Errorf("failed to render shared policy %q: %w", name, err)
+	}
+	return rendered, true, nil
+}
+
+// consumers returns a map function that enqueues every object of the listed kind
+// that references a shared policy when its ConfigMap changes.
+func (s *sharedPolicies) consumers(newList func() client.ObjectList) handler.MapFunc {
+	return func(obj client.Object) []reconcile.Request {
+		if obj.GetNamespace() != s.namespace {
+			return nil
+		}
+		ctx := context.Background()
+		list := newList()
+		if err := s.reader.List(ctx, list); err != nil {
+			ctrl.Log.Error(err, "unable to list consumers of shared policy", "name", obj.GetName())
+			return nil
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			ctrl.Log.Error(err, "unable to extract consumers of shared policy", "name", obj.GetName())
+			return nil
+		}
+		var requests []reconcile.Request
+		for _, item := range items {
+			consumer, ok := item.(client.Object)
+			if !ok {
+				continue
+			}
+			if consumer.GetAnnotations()[api.VaultSharedPolicyAnnotation] == obj.GetName() {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(consumer)})
+			}
+		}
+		return requests
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package reconcilers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+func TestSharedPolicies(t *testing.T) {
+	ctx := context.Background()
+	cli := fake.NewClientBuilder().WithObjects(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "platform", Name: "tenant"},
+			Data:       map[string]string{api.VaultPolicyKey: `path "secret/data/{{ .Namespace }}/*" { capabilities = ["read"] }`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "platform", Name: "empty"},
+		},
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "team-a", Name: "app",
+			Annotations: map[string]string{api.VaultSharedPolicyAnnotation: "tenant"},
+		}},
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "team-b", Name: "other",
+			Annotations: map[string]string{api.VaultSharedPolicyAnnotation: "empty"},
+		}},
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Name: "unrelated"}},
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system", Name: "app",
+			Annotations: map[string]string{api.VaultSharedPolicyAnnotation: "tenant"},
+		}},
+	).Build()
+	shared := &sharedPolicies{reader: cli, namespace: "platform"}
+
+	role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "team-a", Name: "app",
+		Annotations: map[string]string{api.VaultSharedPolicyAnnotation: "tenant"},
+	}}
+	policy, ok, err := shared.Render(ctx, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("Expected the role to reference a shared policy")
+	}
+	if expected := `path "secret/data/team-a/*" { capabilities = ["read"] }`; policy != expected {
+		t.Errorf("Expected %q, got %q", expected, policy)
+	}
+
+	if _, ok, err := shared.Render(ctx, &rbacv1.Role{}); ok || err != nil {
+		t.Errorf("Expected no shared policy for an object without the annotation, got %t, %v", ok, err)
+	}
+	for _, name := range []string{"empty", "missing"} {
+		role.Annotations[api.VaultSharedPolicyAnnotation] = name
+		if _, _, err := shared.Render(ctx, role); err == nil {
+			t.Errorf("Expected error for shared policy %q, got nil", name)
+		}
+	}
+	var disabled *sharedPolicies
+	if _, ok, err := disabled.Render(ctx, role); !ok || err == nil {
+		t.Error("Expected error when shared policies are disabled, got nil")
+	}
+
+	watched := func(obj client.Object) bool { return checkObject(obj, nil, nil, false) }
+	mapFunc := watchedRequests(watched, shared.consumers(func() client.ObjectList { return &rbacv1.RoleList{} }))
+	requests := mapFunc(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "platform", Name: "tenant"}})
+	if len(requests) != 1 || requests[0].Namespace != "team-a" || requests[0].Name != "app" {
+		t.Errorf("Expected a request for team-a/app, got %v", requests)
+	}
+	requests = mapFunc(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "tenant"}})
+	if len(requests) != 0 {
+		t.Errorf("Expected no requests for a configmap outside the shared policy namespace, got %v", requests)
+	}
+}
+
+func TestSharedPolicyInjection(t *testing.T) {
+	cli := fake.NewClientBuilder().WithObjects(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "platform", Name: "tenant"},
+		Data:       map[string]string{api.VaultPolicyKey: `path "secret/data/{{ index .Labels "team" }}/*" { capabilities = ["read"] }`},
+	}).Build()
+	shared := &sharedPolicies{reader: cli, namespace: "platform"}
+	// Tenants label their own objects, the label must not widen the shared policy
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "team-a",
+		Name:        "app",
+		Labels:      map[string]string{"team": `web" { capabilities = ["read"] } path "sys/policy" { capabilities = ["sudo"] } path "x`},
+		Annotations: map[string]string{api.VaultSharedPolicyAnnotation: "tenant"},
+	}}
+	rendered, _, err := shared.Render(context.Background(), sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := vault.ParsePolicy(rendered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Path) != 1 {
+		t.Errorf("Expected only the path of the shared policy, got %v", policy.Path)
+	}
+	for path, rules := range policy.Path {
+		if !strings.HasPrefix(path, "secret/data/") {
+			t.Errorf("Expected only paths under secret/data/, got %q", path)
+		}
+		if len(rules.Capabilities) != 1 || rules.Capabilities[0] != "read" {
+			t.Errorf("Expected only the read capability, got %v", rules.Capabilities)
+		}
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/hashicorp/go-hclog"
+	jwtauth "github.com/hashicorp/vault-plugin-auth-jwt"
 	k8sauth "github.com/hashicorp/vault-plugin-auth-kubernetes"
 	vaultapi "github.com/hashicorp/vault/api"
 	vaulthttp "github.com/hashicorp/vault/http"
@@ -78,13 +79,17 @@ var _ = BeforeSuite(func() {
 
 	// Setup reconcilers
 	mgr, err = ctrl.NewManager(cfg, ctrl.Options{
-		Scheme: scheme.Scheme,
+		Scheme:                scheme.Scheme,
+		ClientDisableCacheFor: []client.Object{&corev1.Secret{}},
 	})
 	Expect(err).ToNot(HaveOccurred())
 	Expect(mgr).ToNot(BeNil())
 	Expect(SetupWithManager(mgr, &Options{
-		AuthMount:     "kubernetes",
-		UseFinalizers: true,
+		AuthMounts:         []string{"kubernetes"},
+		JWTAuthMounts:      []string{"jwt"},
+		JWTBoundAudiences:  []string{"vault"},
+		UseFinalizers:      true,
+		AttachablePolicies: []string{"default"},
 	})).To(Succeed())
 	go func() {
 		defer GinkgoRecover()
@@ -118,7 +123,11 @@ var _ = AfterSuite(func() {
 })
 
 func VaultRole(ctx context.Context, path string) (*vaultapi.Secret, error) {
-	path = "auth/kubernetes/role/" + path
+	return VaultRoleInMount(ctx, "kubernetes", path)
+}
+
+func VaultRoleInMount(ctx context.Context, mount, path string) (*vaultapi.Secret, error) {
+	path = "auth/" + mount + "/role/" + path
 	return vaultClient.Logical().ReadWithContext(ctx, path)
 }
 
@@ -148,6 +157,20 @@ func MostRecentEventReason(ctx context.Context, obj client.Object) (string, erro
 	return event.Reason, nil
 }
 
+func EventReasons(ctx context.Context, obj client.Object) ([]string, error) {
+	var eventList eventsv1.EventList
+	if err := k8sClient.List(ctx, &eventList, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil, err
+	}
+	var reasons []string
+	for _, e := range eventList.Items {
+		if string(e.Regarding.UID) == string(obj.GetUID()) {
+			reasons = append(reasons, e.Reason)
+		}
+	}
+	return reasons, nil
+}
+
 func GetMostRecentEvent(ctx context.Context, obj client.Object) (*eventsv1.Event, error) {
 	log := GinkgoLogr.WithName("GetMostRecentEvent")
 	log.Info("getting most recent event",
@@ -179,6 +202,7 @@ func setupTestVault(t testingi.T) *hashivault.TestCluster {
 	cluster := hashivault.NewTestCluster(t, &hashivault.CoreConfig{
 		CredentialBackends: map[string]logical.Factory{
 			"kubernetes": k8sauth.Factory,
+			"jwt":        jwtauth.Factory,
 		},
 	}, &hashivault.TestClusterOptions{
 		NumCores:    1,
@@ -195,6 +219,16 @@ func setupTestVault(t testingi.T) *hashivault.TestCluster {
 	}); err != nil {
 		t.Fatal(err)
 	}
+	if err := cluster.Cores[0].Client.Sys().EnableAuthWithOptions("kubernetes-secondary", &vaultapi.EnableAuthOptions{
+		Type: "kubernetes",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Cores[0].Client.Sys().EnableAuthWithOptions("jwt", &vaultapi.EnableAuthOptions{
+		Type: "jwt",
+	}); err != nil {
+		t.Fatal(err)
+	}
 
 	return cluster
 }
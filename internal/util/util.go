@@ -8,6 +8,7 @@ package util
 
 import (
 	"fmt"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
@@ -35,3 +36,15 @@ func HasAnnotation(obj client.Object, toCheck string) bool {
 	}
 	return false
 }
+
+// SplitList splits a comma-separated list, trimming whitespace and dropping
+// empty elements.
+func SplitList(list string) []string {
+	var out []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
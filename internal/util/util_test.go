@@ -7,6 +7,7 @@
 package util
 
 import (
+	"reflect"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
@@ -109,3 +110,22 @@ func TestIsIgnoredRoleBinding(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitList(t *testing.T) {
+	tt := []struct {
+		list string
+		want []string
+	}{
+		{list: "", want: nil},
+		{list: "kubernetes", want: []string{"kubernetes"}},
+		{list: "kubernetes,jwt", want: []string{"kubernetes", "jwt"}},
+		{list: " kubernetes , jwt, ", want: []string{"kubernetes", "jwt"}},
+	}
+	for _, tt := range tt {
+		t.Run(tt.list, func(t *testing.T) {
+			if got := SplitList(tt.list); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,7 +7,8 @@
 package vault
 
 import (
-	"encoding/json"
+	"fmt"
+	"sort"
 
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
@@ -17,24 +18,85 @@ import (
 	"github.com/tinyzimmer/vault-rbac-controller/internal/util"
 )
 
-type policyJSON struct {
-	Path map[string]pathPolicy `json:"path"`
+// denyCapability is the capability that takes precedence over all others on a path.
+const denyCapability = "deny"
+
+// ToJSONPolicyString renders the rules as a JSON Vault policy. See PolicyFromRules
+// for how rules and options are combined.
+func ToJSONPolicyString(rules []rbacv1.PolicyRule, options map[string]*PathOptions) (string, error) {
+	pol, err := PolicyFromRules(rules, options)
+	if err != nil {
+		return "", err
+	}
+	return pol.JSON()
 }
 
-type pathPolicy struct {
-	Capabilities []string `json:"capabilities"`
+// FindPolicyConflicts returns a description of every path that is defined by
+// more than one rule with differing capabilities.
+func FindPolicyConflicts(rules []rbacv1.PolicyRule) []string {
+	_, conflicts := mergeRules(rules)
+	return conflicts
 }
 
-func ToJSONPolicyString(rules []rbacv1.PolicyRule) string {
-	pol := policyJSON{Path: make(map[string]pathPolicy)}
+func mergeRules(rules []rbacv1.PolicyRule) (map[string][]string, []string) {
+	defined := make(map[string][][]string)
+	var order []string
 	for _, rule := range rules {
 		for _, res := range rule.Resources {
-			pol.Path[res] = pathPolicy{Capabilities: rule.Verbs}
+			if _, ok := defined[res]; !ok {
+				order = append(order, res)
+			}
+			defined[res] = append(defined[res], normalizeCapabilities(rule.Verbs))
+		}
+	}
+	paths := make(map[string][]string, len(defined))
+	var conflicts []string
+	sort.Strings(order)
+	for _, path := range order {
+		definitions := defined[path]
+		var merged []string
+		for _, capabilities := range definitions {
+			merged = append(merged, capabilities...)
+		}
+		merged = normalizeCapabilities(merged)
+		if contains(merged, denyCapability) {
+			merged = []string{denyCapability}
+		}
+		paths[path] = merged
+		for _, capabilities := range definitions[1:] {
+			if !equalStrings(capabilities, definitions[0]) {
+				conflicts = append(conflicts, fmt.Sprintf(
+					"path %q is defined by %d rules with differing capabilities, merged to %v",
+					path, len(definitions), merged))
+				break
+			}
+		}
+	}
+	return paths, conflicts
+}
+
+// normalizeCapabilities returns a sorted copy of the capabilities without duplicates.
+func normalizeCapabilities(capabilities []string) []string {
+	out := make([]string, 0, len(capabilities))
+	for _, c := range capabilities {
+		if !contains(out, c) {
+			out = append(out, c)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
 	}
-	// Will never error since we are marshaling strings
-	out, _ := json.MarshalIndent(pol, "", "  ")
-	return string(out)
+	return true
 }
 
 const vaultAPIGroup = "vault.hashicorp.com"
@@ -62,9 +124,12 @@ func HasACLs(object client.Object) bool {
 
 func serviceAccountHasACLs(svcacct *corev1.ServiceAccount) bool {
 	return util.HasAnnotation(svcacct, api.VaultInlinePolicyAnnotation) ||
-		util.HasAnnotation(svcacct, api.VaultConfigMapPolicyAnnotation)
+		util.HasAnnotation(svcacct, api.VaultConfigMapPolicyAnnotation) ||
+		util.HasAnnotation(svcacct, api.VaultSecretPolicyAnnotation) ||
+		util.HasAnnotation(svcacct, api.VaultPolicyRolesAnnotation) ||
+		util.HasAnnotation(svcacct, api.VaultSharedPolicyAnnotation)
 }
 
 func roleHasACLs(role *rbacv1.Role) bool {
-	return len(FilterACLs(role.Rules)) > 0
+	return len(FilterACLs(role.Rules)) > 0 || util.HasAnnotation(role, api.VaultSharedPolicyAnnotation)
 }
@@ -53,9 +53,9 @@ func TestToJSONPolicyString(t *testing.T) {
   "path": {
     "bar": {
       "capabilities": [
-        "update",
         "create",
-        "read"
+        "read",
+        "update"
       ]
     }
   }
@@ -86,17 +86,107 @@ func TestToJSONPolicyString(t *testing.T) {
       ]
     }
   }
+}`,
+		},
+		{
+			rules: []rbacv1.PolicyRule{
+				{
+					Resources: []string{"foo"},
+					Verbs:     []string{"read", "list"},
+				},
+				{
+					Resources: []string{"foo", "bar"},
+					Verbs:     []string{"update", "read"},
+				},
+			},
+			json: `
+{
+  "path": {
+    "bar": {
+      "capabilities": [
+        "read",
+        "update"
+      ]
+    },
+    "foo": {
+      "capabilities": [
+        "list",
+        "read",
+        "update"
+      ]
+    }
+  }
+}`,
+		},
+		{
+			rules: []rbacv1.PolicyRule{
+				{
+					Resources: []string{"foo"},
+					Verbs:     []string{"deny"},
+				},
+				{
+					Resources: []string{"foo"},
+					Verbs:     []string{"read"},
+				},
+			},
+			json: `
+{
+  "path": {
+    "foo": {
+      "capabilities": [
+        "deny"
+      ]
+    }
+  }
 }`,
 		},
 	}
 	for _, tc := range tt {
-		out := ToJSONPolicyString(tc.rules)
+		out, err := ToJSONPolicyString(tc.rules, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
 		if out != strings.TrimSpace(tc.json) {
 			t.Errorf("Expected %s, got %s", tc.json, out)
 		}
 	}
 }
 
+func TestFindPolicyConflicts(t *testing.T) {
+	tt := []struct {
+		rules     []rbacv1.PolicyRule
+		conflicts int
+	}{
+		{
+			rules: []rbacv1.PolicyRule{
+				{Resources: []string{"foo"}, Verbs: []string{"read"}},
+				{Resources: []string{"bar"}, Verbs: []string{"read"}},
+			},
+			conflicts: 0,
+		},
+		{
+			rules: []rbacv1.PolicyRule{
+				{Resources: []string{"foo"}, Verbs: []string{"read", "list"}},
+				{Resources: []string{"foo"}, Verbs: []string{"list", "read"}},
+			},
+			conflicts: 0,
+		},
+		{
+			rules: []rbacv1.PolicyRule{
+				{Resources: []string{"foo", "bar"}, Verbs: []string{"read"}},
+				{Resources: []string{"foo"}, Verbs: []string{"deny"}},
+				{Resources: []string{"bar"}, Verbs: []string{"update"}},
+			},
+			conflicts: 2,
+		},
+	}
+	for _, tc := range tt {
+		if conflicts := FindPolicyConflicts(tc.rules); len(conflicts) != tc.conflicts {
+			t.Errorf("Expected %d conflicts, got %d: %v", tc.conflicts, len(conflicts), conflicts)
+		}
+	}
+}
+
 func TestHasACLs(t *testing.T) {
 	tt := []struct {
 		object  client.Object
@@ -120,6 +210,34 @@ func TestHasACLs(t *testing.T) {
 				},
 			},
 		}, hasACLs: true},
+		{object: &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					api.VaultSecretPolicyAnnotation: "policy",
+				},
+			},
+		}, hasACLs: true},
+		{object: &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					api.VaultPolicyRolesAnnotation: "reader",
+				},
+			},
+		}, hasACLs: true},
+		{object: &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					api.VaultSharedPolicyAnnotation: "tenant",
+				},
+			},
+		}, hasACLs: true},
+		{object: &rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					api.VaultSharedPolicyAnnotation: "tenant",
+				},
+			},
+		}, hasACLs: true},
 		{object: &rbacv1.Role{
 			Rules: []rbacv1.PolicyRule{
 				{
@@ -0,0 +1,109 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// KubernetesAuthType is the type of the Kubernetes auth method in Vault.
+const KubernetesAuthType = "kubernetes"
+
+// KubernetesAuthConfig is the configuration written to a Kubernetes auth mount.
+// See the API documentation for details:
+// https://developer.hashicorp.com/vault/api-docs/auth/kubernetes#configure-method
+type KubernetesAuthConfig struct {
+	// Host is the address of the Kubernetes API server.
+	Host string
+	// CACert is the PEM encoded CA certificate of the Kubernetes API server.
+	CACert string
+	// Issuer is the expected issuer of service account tokens. If left empty
+	// Vault's default is used.
+	Issuer string
+	// TokenReviewerJWT is the token Vault uses to access the TokenReview API.
+	// If left empty Vault will use the JWT of the client logging in.
+	TokenReviewerJWT string
+	// DisableLocalCAJWT instructs Vault to not fall back to its own service
+	// account when running inside a Kubernetes pod.
+	DisableLocalCAJWT bool
+}
+
+func (c *KubernetesAuthConfig) params() map[string]any {
+	params := map[string]any{
+		"kubernetes_host":        c.Host,
+		"kubernetes_ca_cert":     c.CACert,
+		"disable_local_ca_jwt":   c.DisableLocalCAJWT,
+		"token_reviewer_jwt":     c.TokenReviewerJWT,
+		"disable_iss_validation": c.Issuer == "",
+	}
+	if c.Issuer != "" {
+		params["issuer"] = c.Issuer
+	}
+	return params
+}
+
+type AuthMountManager interface {
+	// Location returns the location of the auth mounts the roles of the object are
+	// written to.
+	Location(ctx context.Context, obj client.Object) (Location, error)
+	ConfigureAuthMount(ctx context.Context, loc Location, mount string, config *KubernetesAuthConfig) error
+}
+
+// AuthMountManagerOptions are the options for configuring an AuthMountManager.
+type AuthMountManagerOptions struct {
+	// Connections selects the Vault connections auth mounts are configured in. If
+	// nil, the client from NewClient is used.
+	Connections ConnectionSelector
+	// Namespaces maps objects to the Vault namespaces auth mounts are configured
+	// in. If nil, mounts are configured in the namespace of the client.
+	Namespaces NamespaceMapper
+}
+
+func NewAuthMountManager(opts *AuthMountManagerOptions) AuthMountManager {
+	return &authMountManager{opts: opts}
+}
+
+type authMountManager struct {
+	opts *AuthMountManagerOptions
+}
+
+func (a *authMountManager) Location(ctx context.Context, obj client.Object) (Location, error) {
+	return resolveLocation(ctx, a.opts.Connections, a.opts.Namespaces, obj)
+}
+
+func (a *authMountManager) ConfigureAuthMount(ctx context.Context, loc Location, mount string, config *KubernetesAuthConfig) error {
+	cli, err := clientAt(ctx, a.opts.Connections, loc)
+	if err != nil {
+		return err
+	}
+	mounts, err := cli.Sys().ListAuthWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list auth mounts: %w", err)
+	}
+	existing, ok := mounts[strings.Trim(mount, "/")+"/"]
+	switch {
+	case !ok:
+		if err := cli.Sys().EnableAuthWithOptionsWithContext(ctx, mount, &api.EnableAuthOptions{
+			Type:        KubernetesAuthType,
+			Description: "Managed by vault-rbac-controller",
+		}); err != nil {
+			return fmt.Errorf("failed to enable auth mount: %w", err)
+		}
+	case existing.Type != KubernetesAuthType:
+		return fmt.Errorf("auth mount %q is of type %q, expected %q", mount, existing.Type, KubernetesAuthType)
+	}
+	if _, err := cli.Logical().WriteWithContext(ctx, path.Join("auth", mount, "config"), config.params()); err != nil {
+		return fmt.Errorf("failed to write auth mount config: %w", err)
+	}
+	return nil
+}
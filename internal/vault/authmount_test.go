@@ -0,0 +1,94 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/hashicorp/vault/api"
+)
+
+var _ = Describe("Vault Auth Mounts", func() {
+	var mounts AuthMountManager
+	var config *KubernetesAuthConfig
+
+	BeforeEach(func() {
+		mounts = NewAuthMountManager(&AuthMountManagerOptions{})
+		Expect(mounts).ToNot(BeNil())
+		config = &KubernetesAuthConfig{
+			Host:              "https://kubernetes.default.svc:443",
+			CACert:            string(cluster.CACertPEM),
+			Issuer:            "https://kubernetes.default.svc.cluster.local",
+			DisableLocalCAJWT: true,
+		}
+	})
+
+	Describe("configuring auth mounts", func() {
+
+		When("the mount does not exist", func() {
+			BeforeEach(func() {
+				DeferCleanup(func() {
+					cli, err := NewClient()
+					Expect(err).To(BeNil())
+					Expect(cli.Sys().DisableAuth("auto-kubernetes")).To(Succeed())
+				})
+				Expect(mounts.ConfigureAuthMount(context.Background(), Location{}, "auto-kubernetes", config)).To(Succeed())
+			})
+			It("should enable the mount", func() {
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				auths, err := cli.Sys().ListAuth()
+				Expect(err).To(BeNil())
+				Expect(auths).To(HaveKey("auto-kubernetes/"))
+				Expect(auths["auto-kubernetes/"].Type).To(Equal(KubernetesAuthType))
+			})
+			It("should write the configuration", func() {
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				cfg, err := cli.Logical().Read("auth/auto-kubernetes/config")
+				Expect(err).To(BeNil())
+				Expect(cfg).ToNot(BeNil())
+				Expect(cfg.Data["kubernetes_host"]).To(Equal(config.Host))
+				Expect(cfg.Data["issuer"]).To(Equal(config.Issuer))
+			})
+		})
+
+		When("the mount already exists", func() {
+			BeforeEach(func() {
+				// A dedicated mount, so the shared mounts keep their configuration
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				Expect(cli.Sys().EnableAuthWithOptions("existing-kubernetes", &api.EnableAuthOptions{
+					Type: KubernetesAuthType,
+				})).To(Succeed())
+				DeferCleanup(func() {
+					Expect(cli.Sys().DisableAuth("existing-kubernetes")).To(Succeed())
+				})
+				config.Host = "https://example.com:6443"
+				Expect(mounts.ConfigureAuthMount(context.Background(), Location{}, "existing-kubernetes", config)).To(Succeed())
+			})
+			It("should update the configuration", func() {
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				cfg, err := cli.Logical().Read("auth/existing-kubernetes/config")
+				Expect(err).To(BeNil())
+				Expect(cfg).ToNot(BeNil())
+				Expect(cfg.Data["kubernetes_host"]).To(Equal("https://example.com:6443"))
+			})
+		})
+
+		When("the mount is of another type", func() {
+			It("should return an error", func() {
+				Expect(mounts.ConfigureAuthMount(context.Background(), Location{}, "token", config)).ToNot(Succeed())
+			})
+		})
+
+	})
+})
@@ -0,0 +1,329 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+)
+
+// DefaultServiceAccountTokenFile is the default path to the token used for
+// Kubernetes auth logins.
+const DefaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// ConnectionsConfig is the configuration file format for named Vault connections.
+type ConnectionsConfig struct {
+	// Default is the name of the connection used for objects that do not select
+	// one. If empty, the client configured from the environment is used.
+	Default string `json:"default,omitempty"`
+	// Connections are the named Vault connections.
+	Connections []*Connection `json:"connections"`
+}
+
+// Connection is a named connection to a Vault cluster.
+type Connection struct {
+	// Name is the name objects use to select the connection.
+	Name string `json:"name"`
+	// Address is the address of the Vault server.
+	Address string `json:"address"`
+	// Namespace is the Vault Enterprise namespace the connection is scoped to.
+	Namespace string `json:"namespace,omitempty"`
+	// TLS is the TLS configuration for the connection.
+	TLS ConnectionTLS `json:"tls,omitempty"`
+	// Auth is the authentication configuration for the connection.
+	Auth ConnectionAuth `json:"auth,omitempty"`
+}
+
+// ConnectionTLS is the TLS configuration for a Vault connection.
+type ConnectionTLS struct {
+	CACert     string `json:"caCert,omitempty"`
+	CAPath     string `json:"caPath,omitempty"`
+	ClientCert string `json:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty"`
+	ServerName string `json:"serverName,omitempty"`
+	Insecure   bool   `json:"insecure,omitempty"`
+}
+
+// ConnectionAuth is the authentication configuration for a Vault connection.
+// Exactly one method must be configured.
+type ConnectionAuth struct {
+	// TokenFile is a path to a file containing a Vault token. The file is read
+	// on every use so externally renewed tokens are picked up.
+	TokenFile string `json:"tokenFile,omitempty"`
+	// Kubernetes configures a login using the Kubernetes auth method.
+	Kubernetes *KubernetesLogin `json:"kubernetes,omitempty"`
+}
+
+// KubernetesLogin configures a login to Vault using the Kubernetes auth method.
+type KubernetesLogin struct {
+	// Mount is the auth mount to log in with. Defaults to "kubernetes".
+	Mount string `json:"mount,omitempty"`
+	// Role is the role to log in as.
+	Role string `json:"role"`
+	// TokenFile is the path to the service account token. Defaults to the token
+	// mounted into the controller's pod.
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+// LoadConnectionsConfig reads the connections configuration at the given path.
+func LoadConnectionsConfig(path string) (*ConnectionsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read connections config: %w", err)
+	}
+	var config ConnectionsConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse connections config: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validate checks the connections configuration for errors.
+func (c *ConnectionsConfig) Validate() error {
+	names := make(map[string]struct{}, len(c.Connections))
+	for _, conn := range c.Connections {
+		if conn.Name == "" {
+			return errors.New("vault connections must have a name")
+		}
+		if _, ok := names[conn.Name]; ok {
+			return fmt.Errorf("duplicate vault connection %q", conn.Name)
+		}
+		names[conn.Name] = struct{}{}
+		if conn.Address == "" {
+			return fmt.Errorf("vault connection %q must have an address", conn.Name)
+		}
+		if conn.Auth.TokenFile == "" && conn.Auth.Kubernetes == nil {
+			return fmt.Errorf("vault connection %q must configure an auth method", conn.Name)
+		}
+		if conn.Auth.TokenFile != "" && conn.Auth.Kubernetes != nil {
+			return fmt.Errorf("vault connection %q must configure only one auth method", conn.Name)
+		}
+		if conn.Auth.Kubernetes != nil && conn.Auth.Kubernetes.Role == "" {
+			return fmt.Errorf("vault connection %q must configure a kubernetes auth role", conn.Name)
+		}
+	}
+	if _, ok := names[c.Default]; c.Default != "" && !ok {
+		return fmt.Errorf("default vault connection %q is not defined", c.Default)
+	}
+	return nil
+}
+
+// ConnectionSelector selects the Vault client used for an object.
+type ConnectionSelector interface {
+	// Connection returns the name of the connection selected by the object, or an
+	// empty string for the client configured from the environment.
+	Connection(ctx context.Context, obj client.Object) (string, error)
+	// Client returns the client of the named connection.
+	Client(ctx context.Context, name string) (*vaultapi.Client, error)
+	// Health checks that the Vault servers of all connections are reachable.
+	Health(ctx context.Context) error
+}
+
+// NewConnectionSelector returns a ConnectionSelector choosing between the given
+// connections. The connection is selected by the VaultConnectionAnnotation on the
+// object, then on the object's Kubernetes namespace, and finally the configured
+// default. When no connection is selected the client from NewClient is used.
+func NewConnectionSelector(reader client.Reader, config *ConnectionsConfig) ConnectionSelector {
+	clients := make(map[string]*connectionClient, len(config.Connections))
+	for _, conn := range config.Connections {
+		clients[conn.Name] = &connectionClient{conn: conn}
+	}
+	return &connectionSelector{reader: reader, defaultName: config.Default, clients: clients}
+}
+
+type connectionSelector struct {
+	reader      client.Reader
+	defaultName string
+	clients     map[string]*connectionClient
+}
+
+func (c *connectionSelector) Client(ctx context.Context, name string) (*vaultapi.Client, error) {
+	if name == "" {
+		return NewClient()
+	}
+	cli, ok := c.clients[name]
+	if !ok {
+		return nil, fmt.Errorf("vault connection %q is not defined", name)
+	}
+	return cli.client(ctx)
+}
+
+func (c *connectionSelector) Connection(ctx context.Context, obj client.Object) (string, error) {
+	if annotations := obj.GetAnnotations(); annotations != nil {
+		if name, ok := annotations[api.VaultConnectionAnnotation]; ok {
+			return name, nil
+		}
+	}
+	var ns corev1.Namespace
+	// A deleted namespace no longer selects a connection, the default still applies
+	if err := c.reader.Get(ctx, client.ObjectKey{Name: obj.GetNamespace()}, &ns); client.IgnoreNotFound(err) != nil {
+		return "", fmt.Errorf("failed to fetch namespace: %w", err)
+	}
+	if annotations := ns.GetAnnotations(); annotations != nil {
+		if name, ok := annotations[api.VaultConnectionAnnotation]; ok {
+			return name, nil
+		}
+	}
+	return c.defaultName, nil
+}
+
+func (c *connectionSelector) Health(ctx context.Context) error {
+	names := make([]string, 0, len(c.clients)+1)
+	if c.defaultName == "" {
+		names = append(names, "")
+	}
+	for name := range c.clients {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		cli, err := c.Client(ctx, name)
+		if err != nil {
+			return err
+		}
+		if _, err := cli.Sys().HealthWithContext(ctx); err != nil {
+			return fmt.Errorf("vault connection %q is not healthy: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Health checks that Vault is reachable through every configured connection, or
+// through the client configured from the environment if connections is nil.
+func Health(ctx context.Context, connections ConnectionSelector) error {
+	if connections != nil {
+		return connections.Health(ctx)
+	}
+	cli, err := NewClient()
+	if err != nil {
+		return err
+	}
+	_, err = cli.Sys().HealthWithContext(ctx)
+	return err
+}
+
+// loginRenewWindow is how long before expiry a login token is replaced.
+const loginRenewWindow = time.Minute
+
+// connectionClient lazily creates and authenticates the client for a connection.
+type connectionClient struct {
+	conn *Connection
+
+	mu      sync.Mutex
+	cli     *vaultapi.Client
+	expires time.Time
+}
+
+func (c *connectionClient) client(ctx context.Context) (*vaultapi.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cli == nil {
+		cli, err := c.newClient()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create client for vault connection %q: %w", c.conn.Name, err)
+		}
+		c.cli = cli
+	}
+	switch {
+	case c.conn.Auth.TokenFile != "":
+		token, err := os.ReadFile(c.conn.Auth.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token for vault connection %q: %w", c.conn.Name, err)
+		}
+		c.cli.SetToken(strings.TrimSpace(string(token)))
+	case c.conn.Auth.Kubernetes != nil:
+		if c.cli.Token() == "" || time.Now().Add(loginRenewWindow).After(c.expires) {
+			if err := c.login(ctx); err != nil {
+				return nil, fmt.Errorf("failed to log in to vault connection %q: %w", c.conn.Name, err)
+			}
+		}
+	}
+	return c.cli, nil
+}
+
+func (c *connectionClient) newClient() (*vaultapi.Client, error) {
+	config := vaultapi.DefaultConfig()
+	if config.Error != nil {
+		return nil, config.Error
+	}
+	config.Address = c.conn.Address
+	if err := config.ConfigureTLS(&vaultapi.TLSConfig{
+		CACert:        c.conn.TLS.CACert,
+		CAPath:        c.conn.TLS.CAPath,
+		ClientCert:    c.conn.TLS.ClientCert,
+		ClientKey:     c.conn.TLS.ClientKey,
+		TLSServerName: c.conn.TLS.ServerName,
+		Insecure:      c.conn.TLS.Insecure,
+	}); err != nil {
+		return nil, err
+	}
+	cli, err := vaultapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	// Never inherit credentials or namespaces from the environment
+	cli.ClearToken()
+	cli.ClearNamespace()
+	if c.conn.Namespace != "" {
+		cli.SetNamespace(c.conn.Namespace)
+	}
+	return cli, nil
+}
+
+func (c *connectionClient) login(ctx context.Context) error {
+	login := c.conn.Auth.Kubernetes
+	mount, tokenFile := login.Mount, login.TokenFile
+	if mount == "" {
+		mount = KubernetesAuthType
+	}
+	if tokenFile == "" {
+		tokenFile = DefaultServiceAccountTokenFile
+	}
+	jwt, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read service account token: %w", err)
+	}
+	// Log in with a clone, callers may still be using the client with the current token
+	cli, err := c.cli.CloneWithHeaders()
+	if err != nil {
+		return err
+	}
+	cli.ClearToken()
+	secret, err := cli.Logical().WriteWithContext(ctx, path.Join("auth", mount, "login"), map[string]any{
+		"role": login.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Auth == nil {
+		return errors.New("login response did not contain a token")
+	}
+	c.cli.SetToken(secret.Auth.ClientToken)
+	if secret.Auth.LeaseDuration == 0 {
+		// The token does not expire
+		c.expires = time.Now().Add(100 * 365 * 24 * time.Hour)
+		return nil
+	}
+	c.expires = time.Now().Add(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+	return nil
+}
@@ -0,0 +1,272 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+)
+
+func TestLoadConnectionsConfig(t *testing.T) {
+	tt := []struct {
+		name      string
+		config    string
+		shouldErr bool
+	}{
+		{
+			name: "valid",
+			config: `
+default: prod
+connections:
+- name: prod
+  address: https://vault.example.com
+  tls:
+    caCert: /etc/vault/ca.crt
+  auth:
+    kubernetes:
+      role: vault-rbac-controller
+- name: nonprod
+  address: https://vault-nonprod.example.com
+  auth:
+    tokenFile: /etc/vault/token
+`,
+		},
+		{
+			name: "unknown field",
+			config: `
+connections:
+- name: prod
+  addr: https://vault.example.com
+`,
+			shouldErr: true,
+		},
+		{
+			name: "missing auth",
+			config: `
+connections:
+- name: prod
+  address: https://vault.example.com
+`,
+			shouldErr: true,
+		},
+		{
+			name: "duplicate name",
+			config: `
+connections:
+- name: prod
+  address: https://vault.example.com
+  auth:
+    tokenFile: /etc/vault/token
+- name: prod
+  address: https://vault.example.com
+  auth:
+    tokenFile: /etc/vault/token
+`,
+			shouldErr: true,
+		},
+		{
+			name: "undefined default",
+			config: `
+default: missing
+connections: []
+`,
+			shouldErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "connections.yaml")
+			if err := os.WriteFile(path, []byte(tc.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConnectionsConfig(path)
+			if tc.shouldErr && err == nil {
+				t.Error("Expected error, got nil")
+			}
+			if !tc.shouldErr && err != nil {
+				t.Errorf("Expected no error, got %s", err)
+			}
+		})
+	}
+}
+
+// vaultStandIn records the requests made to it and the tokens they were made with.
+type vaultStandIn struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests map[string]string
+}
+
+func newVaultStandIn(t *testing.T) *vaultStandIn {
+	v := &vaultStandIn{requests: make(map[string]string)}
+	v.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		if r.URL.Path == "/v1/auth/kubernetes/login" {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"auth": map[string]any{"client_token": "login-token", "lease_duration": 3600},
+			})
+			return
+		}
+		if r.URL.Path == "/v1/sys/health" {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"initialized": true})
+			return
+		}
+		v.requests[r.Method+" "+r.URL.Path] = r.Header.Get("X-Vault-Token")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(v.Close)
+	return v
+}
+
+func TestConnectionSelector(t *testing.T) {
+	prod, nonprod := newVaultStandIn(t), newVaultStandIn(t)
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "vault-token")
+	jwtFile := filepath.Join(dir, "jwt")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(jwtFile, []byte("jwt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	selector := NewConnectionSelector(fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "staging",
+			Annotations: map[string]string{api.VaultConnectionAnnotation: "nonprod"},
+		}},
+	).Build(), &ConnectionsConfig{
+		Default: "prod",
+		Connections: []*Connection{
+			{
+				Name:    "prod",
+				Address: prod.URL,
+				Auth:    ConnectionAuth{Kubernetes: &KubernetesLogin{Role: "controller", TokenFile: jwtFile}},
+			},
+			{
+				Name:    "nonprod",
+				Address: nonprod.URL,
+				Auth:    ConnectionAuth{TokenFile: tokenFile},
+			},
+		},
+	})
+	policies := NewPolicyManager(&PolicyManagerOptions{Connections: selector})
+
+	tt := []struct {
+		name        string
+		namespace   string
+		annotations map[string]string
+		server      *vaultStandIn
+		token       string
+	}{
+		{name: "default", namespace: "default", server: prod, token: "login-token"},
+		{name: "namespace", namespace: "staging", server: nonprod, token: "file-token"},
+		{
+			name:        "object",
+			namespace:   "staging",
+			annotations: map[string]string{api.VaultConnectionAnnotation: "prod"},
+			server:      prod,
+			token:       "login-token",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			obj := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+				Name:        tc.name,
+				Namespace:   tc.namespace,
+				Annotations: tc.annotations,
+			}}
+			if err := policies.WritePolicy(context.Background(), obj, `path "secret/*" { capabilities = ["read"] }`); err != nil {
+				t.Fatal(err)
+			}
+			req := "PUT /v1/sys/policies/acl/" + tc.namespace + "-" + tc.name
+			tc.server.mu.Lock()
+			defer tc.server.mu.Unlock()
+			token, ok := tc.server.requests[req]
+			if !ok {
+				t.Fatalf("Expected request %q to be made to the selected connection", req)
+			}
+			if token != tc.token {
+				t.Errorf("Expected token %q, got %q", tc.token, token)
+			}
+		})
+	}
+
+	obj := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name:        "unknown",
+		Namespace:   "default",
+		Annotations: map[string]string{api.VaultConnectionAnnotation: "unknown"},
+	}}
+	if err := policies.WritePolicy(context.Background(), obj, ""); err == nil {
+		t.Error("Expected error for an undefined connection, got nil")
+	}
+	if err := selector.Health(context.Background()); err != nil {
+		t.Errorf("Expected all connections to be healthy, got %s", err)
+	}
+
+	// Objects are deleted through the connection they were written through
+	recorded := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name:      "recorded",
+		Namespace: "default",
+		Annotations: map[string]string{
+			api.ManagedConnectionAnnotation:     "nonprod",
+			api.ManagedVaultNamespaceAnnotation: "",
+		},
+	}}
+	if err := policies.DeletePolicy(context.Background(), recorded); err != nil {
+		t.Fatal(err)
+	}
+	nonprod.mu.Lock()
+	defer nonprod.mu.Unlock()
+	if _, ok := nonprod.requests["DELETE /v1/sys/policies/acl/default-recorded"]; !ok {
+		t.Error("Expected the policy to be deleted through the recorded connection")
+	}
+}
+
+func TestConnectionLoginKeepsToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	jwtFile := filepath.Join(t.TempDir(), "jwt")
+	if err := os.WriteFile(jwtFile, []byte("jwt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conn := &connectionClient{conn: &Connection{
+		Name:    "prod",
+		Address: srv.URL,
+		Auth:    ConnectionAuth{Kubernetes: &KubernetesLogin{Role: "controller", TokenFile: jwtFile}},
+	}}
+	cli, err := conn.newClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetToken("current-token")
+	conn.cli = cli
+	// The token is about to expire, but the login fails
+	if _, err := conn.client(context.Background()); err == nil {
+		t.Fatal("Expected the login to fail")
+	}
+	if token := cli.Token(); token != "current-token" {
+		t.Errorf("Expected the shared client to keep its token during a login, got %q", token)
+	}
+}
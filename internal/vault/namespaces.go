@@ -0,0 +1,162 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+)
+
+// NamespaceMapper maps Kubernetes objects to the Vault namespace their policies
+// and roles are written to.
+type NamespaceMapper interface {
+	VaultNamespace(ctx context.Context, obj client.Object) (string, error)
+}
+
+// NewNamespaceMapper returns a NamespaceMapper that resolves the Vault namespace
+// from the VaultNamespaceAnnotation on the object's Kubernetes namespace, falling
+// back to rendering the given template. The template is rendered with the fields
+// of NamespaceTemplateData, a template without any actions acts as a static
+// namespace for all objects. With an empty template, objects in namespaces without
+// the annotation are written to the namespace of the client.
+func NewNamespaceMapper(reader client.Reader, tmpl string) (NamespaceMapper, error) {
+	if tmpl == "" {
+		return &namespaceMapper{reader: reader}, nil
+	}
+	t, err := template.New("namespace").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse namespace template: %w", err)
+	}
+	return &namespaceMapper{reader: reader, tmpl: t}, nil
+}
+
+// NamespaceTemplateData is the data available to Vault namespace templates.
+type NamespaceTemplateData struct {
+	// Namespace is the Kubernetes namespace of the object.
+	Namespace string
+	// Name is the name of the object.
+	Name string
+}
+
+type namespaceMapper struct {
+	reader client.Reader
+	// tmpl is nil when only the annotation is read.
+	tmpl *template.Template
+}
+
+func (n *namespaceMapper) VaultNamespace(ctx context.Context, obj client.Object) (string, error) {
+	var ns corev1.Namespace
+	// A deleted namespace no longer carries an annotation, the template still applies
+	// and objects written before it was deleted have their location recorded
+	if err := n.reader.Get(ctx, client.ObjectKey{Name: obj.GetNamespace()}, &ns); client.IgnoreNotFound(err) != nil {
+		return "", fmt.Errorf("failed to fetch namespace: %w", err)
+	}
+	if annotations := ns.GetAnnotations(); annotations != nil {
+		if vaultNs, ok := annotations[api.VaultNamespaceAnnotation]; ok {
+			return strings.Trim(vaultNs, "/"), nil
+		}
+	}
+	if n.tmpl == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, &NamespaceTemplateData{
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}); err != nil {
+		return "", fmt.Errorf("failed to render namespace template: %w", err)
+	}
+	return strings.Trim(buf.String(), "/"), nil
+}
+
+// Location is where in Vault the policy and role of an object are written.
+type Location struct {
+	// Connection is the name of the Vault connection, empty for the client
+	// configured from the environment.
+	Connection string `json:"connection,omitempty"`
+	// Namespace is the Vault namespace, relative to the one of the client.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Annotations returns the annotations recording the location on an object.
+func (l Location) Annotations() map[string]string {
+	return map[string]string{
+		api.ManagedConnectionAnnotation:     l.Connection,
+		api.ManagedVaultNamespaceAnnotation: l.Namespace,
+	}
+}
+
+// recordedLocation returns the location recorded on the object when its policy or
+// role was last written, if any.
+func recordedLocation(obj client.Object) (Location, bool) {
+	annotations := obj.GetAnnotations()
+	namespace, ok := annotations[api.ManagedVaultNamespaceAnnotation]
+	if !ok {
+		return Location{}, false
+	}
+	return Location{Connection: annotations[api.ManagedConnectionAnnotation], Namespace: namespace}, true
+}
+
+// resolveLocation returns the location the object is currently mapped to.
+func resolveLocation(ctx context.Context, connections ConnectionSelector, namespaces NamespaceMapper, obj client.Object) (Location, error) {
+	var loc Location
+	if connections != nil {
+		name, err := connections.Connection(ctx, obj)
+		if err != nil {
+			return Location{}, fmt.Errorf("failed to select vault connection: %w", err)
+		}
+		loc.Connection = name
+	}
+	if namespaces != nil {
+		ns, err := namespaces.VaultNamespace(ctx, obj)
+		if err != nil {
+			return Location{}, fmt.Errorf("failed to resolve vault namespace: %w", err)
+		}
+		loc.Namespace = ns
+	}
+	return loc, nil
+}
+
+// lastLocation returns the location the policy and role of the object were last
+// written to. Objects written before locations were recorded are resolved instead.
+func lastLocation(ctx context.Context, connections ConnectionSelector, namespaces NamespaceMapper, obj client.Object) (Location, error) {
+	if loc, ok := recordedLocation(obj); ok {
+		return loc, nil
+	}
+	return resolveLocation(ctx, connections, namespaces, obj)
+}
+
+// clientAt returns a Vault client for the connection of the location, scoped to its
+// namespace. The returned client is a clone when a namespace is set, so the base
+// client is never modified.
+func clientAt(ctx context.Context, connections ConnectionSelector, loc Location) (*vaultapi.Client, error) {
+	var cli *vaultapi.Client
+	var err error
+	if connections != nil {
+		cli, err = connections.Client(ctx, loc.Connection)
+	} else {
+		cli, err = NewClient()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vault client: %w", err)
+	}
+	if loc.Namespace == "" {
+		return cli, nil
+	}
+	// Namespaces are relative to the one the client is configured with
+	return cli.WithNamespace(path.Join(cli.Namespace(), loc.Namespace)), nil
+}
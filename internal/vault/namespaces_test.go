@@ -0,0 +1,235 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+)
+
+func TestVaultNamespace(t *testing.T) {
+	reader := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "plain"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name: "annotated",
+			Annotations: map[string]string{
+				api.VaultNamespaceAnnotation: "/teams/payments/",
+			},
+		}},
+	).Build()
+	tt := []struct {
+		name      string
+		tmpl      string
+		namespace string
+		want      string
+		shouldErr bool
+	}{
+		{name: "static", tmpl: "tenants", namespace: "plain", want: "tenants"},
+		{name: "template", tmpl: "tenants/{{ .Namespace }}", namespace: "plain", want: "tenants/plain"},
+		{name: "annotation", tmpl: "tenants/{{ .Namespace }}", namespace: "annotated", want: "teams/payments"},
+		{name: "missing namespace", tmpl: "tenants/{{ .Namespace }}", namespace: "missing", want: "tenants/missing"},
+		{name: "missing key", tmpl: "tenants/{{ .Labels }}", namespace: "plain", shouldErr: true},
+		{name: "annotation only", namespace: "annotated", want: "teams/payments"},
+		{name: "annotation only without annotation", namespace: "plain", want: ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, err := NewNamespaceMapper(reader, tc.tmpl)
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			obj := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: tc.namespace}}
+			got, err := mapper.VaultNamespace(context.Background(), obj)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatal("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if got != tc.want {
+				t.Errorf("Expected namespace %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNamespacedClients(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		headers = make(map[string]string)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		headers[r.Method+" "+r.URL.Path] = r.Header.Get("X-Vault-Namespace")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	newClient := NewClient
+	defer func() { NewClient = newClient }()
+	NewClient = func() (*vaultapi.Client, error) {
+		cfg := vaultapi.DefaultConfig()
+		cfg.Address = srv.URL
+		cli, err := vaultapi.NewClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cli.SetToken("test")
+		cli.SetNamespace("admin")
+		return cli, nil
+	}
+
+	reader := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+	).Build()
+	mapper, err := NewNamespaceMapper(reader, "tenants/{{ .Namespace }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj client.Object = &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+
+	policies := NewPolicyManager(&PolicyManagerOptions{Namespaces: mapper})
+	if err := policies.WritePolicy(context.Background(), obj, `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+	roles := NewRoleManager(&RoleManagerOptions{AuthMounts: []string{"kubernetes"}, Namespaces: mapper})
+	if err := roles.WriteRole(context.Background(), obj, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := roles.DeleteRole(context.Background(), obj); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []string{
+		"PUT /v1/sys/policies/acl/default-app",
+		"PUT /v1/auth/kubernetes/role/default-app",
+		"DELETE /v1/auth/kubernetes/role/default-app",
+	} {
+		got, ok := headers[req]
+		if !ok {
+			t.Errorf("Expected request %q to be made", req)
+			continue
+		}
+		if got != "admin/tenants/default" {
+			t.Errorf("Expected namespace header %q for %q, got %q", "admin/tenants/default", req, got)
+		}
+	}
+
+	// Objects written to another namespace are moved, and deleted from the recorded
+	// namespace even once their Kubernetes namespace is gone
+	mu.Lock()
+	headers = make(map[string]string)
+	mu.Unlock()
+	moved := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: map[string]string{
+		api.ManagedAuthMountsAnnotation:     "kubernetes",
+		api.ManagedVaultNamespaceAnnotation: "tenants/old",
+	}}}
+	if err := policies.WritePolicy(context.Background(), moved, `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := roles.WriteRole(context.Background(), moved, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	gone := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "gone", Annotations: map[string]string{
+		api.ManagedAuthMountsAnnotation:     "kubernetes",
+		api.ManagedVaultNamespaceAnnotation: "teams/payments",
+	}}}
+	if err := roles.DeleteRole(context.Background(), gone); err != nil {
+		t.Fatal(err)
+	}
+	for req, want := range map[string]string{
+		"PUT /v1/sys/policies/acl/default-app":        "admin/tenants/default",
+		"DELETE /v1/sys/policies/acl/default-app":     "admin/tenants/old",
+		"PUT /v1/auth/kubernetes/role/default-app":    "admin/tenants/default",
+		"DELETE /v1/auth/kubernetes/role/default-app": "admin/tenants/old",
+		"DELETE /v1/auth/kubernetes/role/gone-app":    "admin/teams/payments",
+	} {
+		got, ok := headers[req]
+		if !ok {
+			t.Errorf("Expected request %q to be made", req)
+			continue
+		}
+		if got != want {
+			t.Errorf("Expected namespace header %q for %q, got %q", want, req, got)
+		}
+	}
+}
+
+func TestAnnotatedNamespacedClients(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		headers = make(map[string]string)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		headers[r.Method+" "+r.URL.Path] = r.Header.Get("X-Vault-Namespace")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	newClient := NewClient
+	defer func() { NewClient = newClient }()
+	NewClient = func() (*vaultapi.Client, error) {
+		cfg := vaultapi.DefaultConfig()
+		cfg.Address = srv.URL
+		cli, err := vaultapi.NewClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cli.SetToken("test")
+		cli.SetNamespace("admin")
+		return cli, nil
+	}
+
+	// Without a template, only annotated namespaces are mapped
+	reader := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "plain"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "annotated", Annotations: map[string]string{
+			api.VaultNamespaceAnnotation: "teams/payments",
+		}}},
+	).Build()
+	mapper, err := NewNamespaceMapper(reader, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := NewPolicyManager(&PolicyManagerOptions{Namespaces: mapper})
+	for _, ns := range []string{"plain", "annotated"} {
+		obj := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: ns}}
+		if err := policies.WritePolicy(context.Background(), obj, `path "secret/*" { capabilities = ["read"] }`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for req, want := range map[string]string{
+		"PUT /v1/sys/policies/acl/plain-app":     "admin",
+		"PUT /v1/sys/policies/acl/annotated-app": "admin/teams/payments",
+	} {
+		got, ok := headers[req]
+		if !ok {
+			t.Errorf("Expected request %q to be made", req)
+			continue
+		}
+		if got != want {
+			t.Errorf("Expected namespace header %q for %q, got %q", want, req, got)
+		}
+	}
+}
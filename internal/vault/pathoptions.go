@@ -0,0 +1,106 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+)
+
+// PathOptions are the settings for a policy path that cannot be expressed in a
+// PolicyRule. See the documentation for details:
+// https://developer.hashicorp.com/vault/docs/concepts/policies#fine-grained-control
+type PathOptions struct {
+	AllowedParameters  map[string][]any `json:"allowed_parameters,omitempty"`
+	DeniedParameters   map[string][]any `json:"denied_parameters,omitempty"`
+	RequiredParameters []string         `json:"required_parameters,omitempty"`
+	MinWrappingTTL     string           `json:"min_wrapping_ttl,omitempty"`
+	MaxWrappingTTL     string           `json:"max_wrapping_ttl,omitempty"`
+}
+
+// ParsePathOptions returns the path options defined in the VaultPathOptionsAnnotation
+// of the given object, keyed by policy path.
+func ParsePathOptions(obj client.Object) (map[string]*PathOptions, error) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		return nil, nil
+	}
+	raw, ok := annotations[api.VaultPathOptionsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var options map[string]*PathOptions
+	if err := yaml.UnmarshalStrict([]byte(raw), &options); err != nil {
+		return nil, fmt.Errorf("failed to parse path options: %w", err)
+	}
+	for path, opts := range options {
+		if err := opts.validate(); err != nil {
+			return nil, fmt.Errorf("invalid options for path %q: %w", path, err)
+		}
+	}
+	return options, nil
+}
+
+func (o *PathOptions) isEmpty() bool {
+	return len(o.AllowedParameters) == 0 && len(o.DeniedParameters) == 0 &&
+		len(o.RequiredParameters) == 0 && o.MinWrappingTTL == "" && o.MaxWrappingTTL == ""
+}
+
+func (o *PathOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	min, err := parseTTL(o.MinWrappingTTL)
+	if err != nil {
+		return fmt.Errorf("invalid min_wrapping_ttl: %w", err)
+	}
+	max, err := parseTTL(o.MaxWrappingTTL)
+	if err != nil {
+		return fmt.Errorf("invalid max_wrapping_ttl: %w", err)
+	}
+	if min > 0 && max > 0 && min > max {
+		return errors.New("min_wrapping_ttl is greater than max_wrapping_ttl")
+	}
+	return nil
+}
+
+// parseTTL parses a TTL as either a duration string or a number of seconds.
+func parseTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.Atoi(ttl); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(ttl)
+}
+
+// validatePolicyPath checks that glob and segment wildcards are used where Vault
+// allows them. A "*" glob may only be the last character of a path and a "+"
+// wildcard must make up an entire path segment.
+func validatePolicyPath(path string) error {
+	if path == "" {
+		return errors.New("policy paths must not be empty")
+	}
+	if i := strings.Index(path, "*"); i >= 0 && i != len(path)-1 {
+		return fmt.Errorf("policy path %q may only contain a glob at the end", path)
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if strings.Contains(segment, "+") && segment != "+" {
+			return fmt.Errorf("policy path %q must use \"+\" as an entire segment", path)
+		}
+	}
+	return nil
+}
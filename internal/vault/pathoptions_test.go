@@ -0,0 +1,139 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"strings"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+)
+
+func TestParsePathOptions(t *testing.T) {
+	tt := []struct {
+		name       string
+		annotation string
+		paths      int
+		shouldErr  bool
+	}{
+		{name: "no annotation", paths: 0},
+		{
+			name: "yaml",
+			annotation: `
+secret/data/app:
+  allowed_parameters:
+    foo: [bar, baz]
+  required_parameters: [foo]
+  min_wrapping_ttl: 1s
+  max_wrapping_ttl: 90
+`,
+			paths: 1,
+		},
+		{
+			name:       "json",
+			annotation: `{"secret/data/app": {"denied_parameters": {"*": []}}}`,
+			paths:      1,
+		},
+		{name: "unknown key", annotation: `{"secret/data/app": {"allowed": {}}}`, shouldErr: true},
+		{name: "invalid ttl", annotation: `{"secret/data/app": {"max_wrapping_ttl": "soon"}}`, shouldErr: true},
+		{
+			name:       "min greater than max",
+			annotation: `{"secret/data/app": {"min_wrapping_ttl": "2m", "max_wrapping_ttl": "1m"}}`,
+			shouldErr:  true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			role := &rbacv1.Role{}
+			if tc.annotation != "" {
+				role.SetAnnotations(map[string]string{api.VaultPathOptionsAnnotation: tc.annotation})
+			}
+			options, err := ParsePathOptions(role)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatal("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if len(options) != tc.paths {
+				t.Errorf("Expected options for %d paths, got %d", tc.paths, len(options))
+			}
+		})
+	}
+}
+
+func TestValidatePolicyPath(t *testing.T) {
+	tt := []struct {
+		path  string
+		valid bool
+	}{
+		{path: "secret/data/app", valid: true},
+		{path: "secret/data/*", valid: true},
+		{path: "secret/data/app*", valid: true},
+		{path: "secret/+/app", valid: true},
+		{path: "secret/+/app/*", valid: true},
+		{path: "", valid: false},
+		{path: "secret/*/app", valid: false},
+		{path: "secret/data+/app", valid: false},
+	}
+	for _, tc := range tt {
+		if err := validatePolicyPath(tc.path); (err == nil) != tc.valid {
+			t.Errorf("Expected path %q valid = %t, got error %v", tc.path, tc.valid, err)
+		}
+	}
+}
+
+func TestToJSONPolicyStringWithOptions(t *testing.T) {
+	rules := []rbacv1.PolicyRule{
+		{Resources: []string{"secret/data/app"}, Verbs: []string{"create"}},
+	}
+	role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		api.VaultPathOptionsAnnotation: `{"secret/data/app": {"allowed_parameters": {"foo": ["bar"]}, "max_wrapping_ttl": "90s"}}`,
+	}}}
+	options, err := ParsePathOptions(role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ToJSONPolicyString(rules, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+{
+  "path": {
+    "secret/data/app": {
+      "capabilities": [
+        "create"
+      ],
+      "allowed_parameters": {
+        "foo": [
+          "bar"
+        ]
+      },
+      "max_wrapping_ttl": "90s"
+    }
+  }
+}`
+	if out != strings.TrimSpace(expected) {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+
+	if _, err := ToJSONPolicyString(rules, map[string]*PathOptions{"secret/data/other": {}}); err == nil {
+		t.Error("Expected error for options on an undefined path, got nil")
+	}
+	if _, err := ToJSONPolicyString([]rbacv1.PolicyRule{
+		{Resources: []string{"secret/*/app"}, Verbs: []string{"read"}},
+	}, nil); err == nil {
+		t.Error("Expected error for an invalid path, got nil")
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"context"
 	"fmt"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
@@ -18,15 +20,34 @@ import (
 
 type PolicyManager interface {
 	PolicyName(client.Object) string
+	Location(context.Context, client.Object) (Location, error)
 	WritePolicy(context.Context, client.Object, string) error
 	DeletePolicy(context.Context, client.Object) error
 }
 
-func NewPolicyManager() PolicyManager {
-	return &policyManager{}
+// PolicyManagerOptions are the options for configuring a PolicyManager.
+type PolicyManagerOptions struct {
+	// Connections selects the Vault connection policies are written to. If nil,
+	// the client from NewClient is used.
+	Connections ConnectionSelector
+	// Namespaces maps objects to the Vault namespace their policies are written
+	// to. If nil, policies are written to the namespace of the client.
+	Namespaces NamespaceMapper
+	// Tombstones stores the last definition of policies before they are deleted.
+	// If nil, deleted policies are not kept.
+	Tombstones TombstoneStore
+	// Recorder reports tombstones that could not be stored. If nil, they are
+	// only logged.
+	Recorder record.EventRecorder
 }
 
-type policyManager struct{}
+func NewPolicyManager(opts *PolicyManagerOptions) PolicyManager {
+	return &policyManager{opts: opts}
+}
+
+type policyManager struct {
+	opts *PolicyManagerOptions
+}
 
 func (p *policyManager) PolicyName(object client.Object) string {
 	if annotations := object.GetAnnotations(); annotations != nil {
@@ -37,24 +58,63 @@ func (p *policyManager) PolicyName(object client.Object) string {
 	return util.DefaultResourceFormat(object.GetNamespace(), object.GetName())
 }
 
+// Location returns the location the policy of the object is currently mapped to.
+func (p *policyManager) Location(ctx context.Context, object client.Object) (Location, error) {
+	return resolveLocation(ctx, p.opts.Connections, p.opts.Namespaces, object)
+}
+
 func (p *policyManager) WritePolicy(ctx context.Context, object client.Object, policy string) error {
 	policyName := p.PolicyName(object)
-	cli, err := NewClient()
+	loc, err := p.Location(ctx, object)
+	if err != nil {
+		return err
+	}
+	cli, err := clientAt(ctx, p.opts.Connections, loc)
 	if err != nil {
-		return fmt.Errorf("failed to get vault client: %w", err)
+		return err
 	}
 	if err := cli.Sys().PutPolicyWithContext(ctx, policyName, policy); err != nil {
 		return fmt.Errorf("failed to write policy to vault: %w", err)
 	}
+	// Remove the policy from the location it was previously written to
+	if previous, ok := recordedLocation(object); ok && previous != loc {
+		cli, err := clientAt(ctx, p.opts.Connections, previous)
+		if err != nil {
+			return err
+		}
+		if err := cli.Sys().DeletePolicyWithContext(ctx, policyName); err != nil {
+			return fmt.Errorf("failed to delete policy from previous vault namespace: %w", err)
+		}
+	}
 	return nil
 }
 
 func (p *policyManager) DeletePolicy(ctx context.Context, object client.Object) error {
-	cli, err := NewClient()
+	loc, err := lastLocation(ctx, p.opts.Connections, p.opts.Namespaces, object)
+	if err != nil {
+		return err
+	}
+	cli, err := clientAt(ctx, p.opts.Connections, loc)
 	if err != nil {
-		return fmt.Errorf("failed to get vault client: %w", err)
+		return err
+	}
+	policyName := p.PolicyName(object)
+	if p.opts.Tombstones != nil {
+		policy, err := cli.Sys().GetPolicyWithContext(ctx, policyName)
+		if err != nil {
+			return fmt.Errorf("failed to read policy from vault: %w", err)
+		}
+		if policy != "" {
+			saveTombstone(ctx, p.opts.Tombstones, p.opts.Recorder, object, &Tombstone{
+				ObjectReference: NewObjectReference(object),
+				PolicyName:      policyName,
+				Policy:          policy,
+				Location:        &loc,
+				DeletedAt:       metav1.Now(),
+			})
+		}
 	}
-	if err := cli.Sys().DeletePolicyWithContext(ctx, p.PolicyName(object)); err != nil {
+	if err := cli.Sys().DeletePolicyWithContext(ctx, policyName); err != nil {
 		return fmt.Errorf("failed to delete policy from vault: %w", err)
 	}
 	return nil
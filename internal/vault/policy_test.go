@@ -26,7 +26,7 @@ var _ = Describe("Vault Policies", func() {
 		object = &corev1.ServiceAccount{}
 		object.SetName("serviceaccount")
 		object.SetNamespace("default")
-		policies = NewPolicyManager()
+		policies = NewPolicyManager(&PolicyManagerOptions{})
 		Expect(policies).ToNot(BeNil())
 	})
 
@@ -0,0 +1,406 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// PolicyFormat is the format policies are written to Vault in.
+type PolicyFormat string
+
+const (
+	// PolicyFormatRaw writes policies as they were given. For Roles this is the
+	// JSON rendering of their rules.
+	PolicyFormatRaw PolicyFormat = "raw"
+	// PolicyFormatHCL writes policies as canonical HCL.
+	PolicyFormatHCL PolicyFormat = "hcl"
+	// PolicyFormatJSON writes policies as canonical JSON.
+	PolicyFormatJSON PolicyFormat = "json"
+)
+
+// Validate returns an error if the format is not recognized.
+func (f PolicyFormat) Validate() error {
+	switch f {
+	case PolicyFormatRaw, PolicyFormatHCL, PolicyFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy format %q, must be one of raw, hcl or json", f)
+	}
+}
+
+// Policy is a Vault ACL policy. It is the common model for policies given as
+// HCL or JSON and policies built from Role rules.
+type Policy struct {
+	Path map[string]*PolicyPath `json:"path"`
+}
+
+// PolicyPath are the rules for a single path in a Policy.
+type PolicyPath struct {
+	Capabilities []string `json:"capabilities"`
+	*PathOptions
+}
+
+// PolicyFromRules builds a policy from the rules. Rules defining the same path are
+// merged into the union of their capabilities, with deny taking precedence. The
+// given options are applied to the path of the same name.
+func PolicyFromRules(rules []rbacv1.PolicyRule, options map[string]*PathOptions) (*Policy, error) {
+	paths, _ := mergeRules(rules)
+	pol := &Policy{Path: make(map[string]*PolicyPath, len(paths))}
+	for path, capabilities := range paths {
+		if err := validatePolicyPath(path); err != nil {
+			return nil, err
+		}
+		pol.Path[path] = &PolicyPath{Capabilities: capabilities, PathOptions: options[path]}
+	}
+	for path := range options {
+		if _, ok := paths[path]; !ok {
+			return nil, fmt.Errorf("options are defined for path %q which is not in any rule", path)
+		}
+	}
+	return pol, nil
+}
+
+// hclPath is a path block as it is decoded from HCL.
+type hclPath struct {
+	Policy             string           `hcl:"policy"`
+	Capabilities       []string         `hcl:"capabilities"`
+	AllowedParameters  map[string][]any `hcl:"allowed_parameters"`
+	DeniedParameters   map[string][]any `hcl:"denied_parameters"`
+	RequiredParameters []string         `hcl:"required_parameters"`
+	MinWrappingTTL     any              `hcl:"min_wrapping_ttl"`
+	MaxWrappingTTL     any              `hcl:"max_wrapping_ttl"`
+}
+
+var hclPathKeys = []string{
+	"policy",
+	"capabilities",
+	"allowed_parameters",
+	"denied_parameters",
+	"required_parameters",
+	"min_wrapping_ttl",
+	"max_wrapping_ttl",
+}
+
+// legacyPolicies maps the deprecated "policy" key of a path to capabilities.
+var legacyPolicies = map[string][]string{
+	"deny":  {"deny"},
+	"read":  {"read", "list"},
+	"write": {"create", "read", "update", "delete", "list"},
+	"sudo":  {"create", "read", "update", "delete", "list", "sudo"},
+}
+
+// ParsePolicy parses a policy given as HCL or JSON. Paths defined more than once
+// are merged the same way as in PolicyFromRules. Settings that cannot be rendered
+// back out, such as control groups, are rejected.
+func ParsePolicy(raw string) (*Policy, error) {
+	root, err := hcl.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, errors.New("failed to parse policy: does not contain a root object")
+	}
+	if err := checkHCLKeys(list, []string{"name", "path"}); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	pol := &Policy{Path: make(map[string]*PolicyPath)}
+	for _, item := range list.Filter("path").Items {
+		if len(item.Keys) == 0 {
+			return nil, errors.New("failed to parse policy: path block without a path")
+		}
+		path, ok := item.Keys[0].Token.Value().(string)
+		if !ok {
+			return nil, errors.New("failed to parse policy: path must be a string")
+		}
+		path = strings.TrimPrefix(path, "/")
+		if err := validatePolicyPath(path); err != nil {
+			return nil, fmt.Errorf("failed to parse policy: %w", err)
+		}
+		if err := checkHCLKeys(item.Val, hclPathKeys); err != nil {
+			return nil, fmt.Errorf("failed to parse policy: path %q: %w", path, err)
+		}
+		var decoded hclPath
+		if err := hcl.DecodeObject(&decoded, item.Val); err != nil {
+			return nil, fmt.Errorf("failed to parse policy: path %q: %w", path, err)
+		}
+		parsed, err := decoded.toPolicyPath()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse policy: path %q: %w", path, err)
+		}
+		if err := pol.addPath(path, parsed); err != nil {
+			return nil, fmt.Errorf("failed to parse policy: %w", err)
+		}
+	}
+	return pol, nil
+}
+
+func (h *hclPath) toPolicyPath() (*PolicyPath, error) {
+	capabilities := h.Capabilities
+	if h.Policy != "" {
+		legacy, ok := legacyPolicies[h.Policy]
+		if !ok {
+			return nil, fmt.Errorf("invalid policy %q", h.Policy)
+		}
+		capabilities = append(capabilities, legacy...)
+	}
+	for _, c := range capabilities {
+		if !contains(Capabilities, c) {
+			return nil, fmt.Errorf("invalid capability %q", c)
+		}
+	}
+	capabilities = normalizeCapabilities(capabilities)
+	if contains(capabilities, denyCapability) {
+		capabilities = []string{denyCapability}
+	}
+	out := &PolicyPath{Capabilities: capabilities}
+	minTTL, err := hclTTL(h.MinWrappingTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid min_wrapping_ttl: %w", err)
+	}
+	maxTTL, err := hclTTL(h.MaxWrappingTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max_wrapping_ttl: %w", err)
+	}
+	opts := &PathOptions{
+		AllowedParameters:  h.AllowedParameters,
+		DeniedParameters:   h.DeniedParameters,
+		RequiredParameters: h.RequiredParameters,
+		MinWrappingTTL:     minTTL,
+		MaxWrappingTTL:     maxTTL,
+	}
+	if !opts.isEmpty() {
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		out.PathOptions = opts
+	}
+	return out, nil
+}
+
+// hclTTL returns a wrapping TTL decoded from HCL, which may be either a string
+// or a number of seconds, as a string.
+func hclTTL(ttl any) (string, error) {
+	switch ttl := ttl.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return ttl, nil
+	case int:
+		return strconv.Itoa(ttl), nil
+	default:
+		return "", fmt.Errorf("unexpected type %T", ttl)
+	}
+}
+
+// Merge adds the paths of the other policy to this one. Paths defined in both are
+// merged the same way as in PolicyFromRules.
+func (p *Policy) Merge(other *Policy) error {
+	for path, rules := range other.Path {
+		copied := *rules
+		copied.Capabilities = append([]string(nil), rules.Capabilities...)
+		if err := p.addPath(path, &copied); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Underlay adds the paths of a policy of lower precedence to this one. Capabilities
+// granted on paths defined in both are combined, but a deny only applies when it does
+// not conflict with this policy: a path this policy grants capabilities on is not
+// denied by the other, while one it denies stays denied. Path options are only taken
+// from the other policy for paths this policy defines none for.
+func (p *Policy) Underlay(other *Policy) {
+	for path, rules := range other.Path {
+		copied := *rules
+		copied.Capabilities = append([]string(nil), rules.Capabilities...)
+		existing, ok := p.Path[path]
+		if !ok {
+			p.Path[path] = &copied
+			continue
+		}
+		if !contains(existing.Capabilities, denyCapability) && !contains(copied.Capabilities, denyCapability) {
+			existing.Capabilities = mergeCapabilities(existing.Capabilities, copied.Capabilities)
+		}
+		if existing.PathOptions == nil {
+			existing.PathOptions = copied.PathOptions
+		}
+	}
+}
+
+func (p *Policy) addPath(path string, rules *PolicyPath) error {
+	existing, ok := p.Path[path]
+	if !ok {
+		p.Path[path] = rules
+		return nil
+	}
+	if existing.PathOptions != nil && rules.PathOptions != nil {
+		return fmt.Errorf("path %q is defined more than once with parameter or wrapping constraints", path)
+	}
+	existing.Capabilities = mergeCapabilities(existing.Capabilities, rules.Capabilities)
+	if existing.PathOptions == nil {
+		existing.PathOptions = rules.PathOptions
+	}
+	return nil
+}
+
+// mergeCapabilities combines the capabilities granted on a path, where deny
+// overrides all others.
+func mergeCapabilities(a, b []string) []string {
+	merged := normalizeCapabilities(append(append([]string(nil), a...), b...))
+	if contains(merged, denyCapability) {
+		return []string{denyCapability}
+	}
+	return merged
+}
+
+func checkHCLKeys(node ast.Node, valid []string) error {
+	var list *ast.ObjectList
+	switch node := node.(type) {
+	case *ast.ObjectList:
+		list = node
+	case *ast.ObjectType:
+		list = node.List
+	default:
+		return errors.New("expected an object")
+	}
+	for _, item := range list.Items {
+		if len(item.Keys) == 0 {
+			continue
+		}
+		key, _ := item.Keys[0].Token.Value().(string)
+		if !contains(valid, key) {
+			return fmt.Errorf("unsupported key %q on line %d", key, item.Keys[0].Pos().Line)
+		}
+	}
+	return nil
+}
+
+// FormatPolicy renders a policy given as HCL or JSON in the given format. With
+// PolicyFormatRaw, or no format, the policy is returned unchanged.
+func FormatPolicy(raw string, format PolicyFormat) (string, error) {
+	if format == "" || format == PolicyFormatRaw {
+		return raw, nil
+	}
+	pol, err := ParsePolicy(raw)
+	if err != nil {
+		return "", err
+	}
+	return pol.Format(format)
+}
+
+// Format renders the policy in the given format. Policies built from rules have
+// no raw form, so PolicyFormatRaw renders them as JSON.
+func (p *Policy) Format(format PolicyFormat) (string, error) {
+	if format == PolicyFormatHCL {
+		return p.HCL(), nil
+	}
+	return p.JSON()
+}
+
+// JSON renders the policy as indented JSON.
+func (p *Policy) JSON() (string, error) {
+	out, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal policy: %w", err)
+	}
+	return string(out), nil
+}
+
+// HCL renders the policy as canonical HCL. Paths, capabilities and parameter
+// names are sorted so equivalent policies always render the same.
+func (p *Policy) HCL() string {
+	paths := make([]string, 0, len(p.Path))
+	for path := range p.Path {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	for i, path := range paths {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		rules := p.Path[path]
+		fmt.Fprintf(&b, "path %s {\n", hclValue(path))
+		fmt.Fprintf(&b, "  capabilities = %s\n", hclValue(normalizeCapabilities(rules.Capabilities)))
+		if opts := rules.PathOptions; opts != nil {
+			writeHCLParameters(&b, "allowed_parameters", opts.AllowedParameters)
+			writeHCLParameters(&b, "denied_parameters", opts.DeniedParameters)
+			if len(opts.RequiredParameters) > 0 {
+				required := append([]string(nil), opts.RequiredParameters...)
+				sort.Strings(required)
+				fmt.Fprintf(&b, "  required_parameters = %s\n", hclValue(required))
+			}
+			if opts.MinWrappingTTL != "" {
+				fmt.Fprintf(&b, "  min_wrapping_ttl = %s\n", hclValue(opts.MinWrappingTTL))
+			}
+			if opts.MaxWrappingTTL != "" {
+				fmt.Fprintf(&b, "  max_wrapping_ttl = %s\n", hclValue(opts.MaxWrappingTTL))
+			}
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+func writeHCLParameters(b *strings.Builder, key string, params map[string][]any) {
+	if len(params) == 0 {
+		return
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(b, "  %s = {\n", key)
+	for _, name := range names {
+		values := params[name]
+		if values == nil {
+			values = []any{}
+		}
+		fmt.Fprintf(b, "    %s = %s\n", hclValue(name), hclValue(values))
+	}
+	b.WriteString("  }\n")
+}
+
+// hclValue renders a string, number, boolean or list of them as an HCL literal.
+// The JSON encoding of a scalar is also valid HCL.
+func hclValue(v any) string {
+	switch v := v.(type) {
+	case []string:
+		parts := make([]string, len(v))
+		for i, s := range v {
+			parts[i] = hclValue(s)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case []any:
+		parts := make([]string, len(v))
+		for i, s := range v {
+			parts[i] = hclValue(s)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return strconv.Quote(fmt.Sprint(v))
+	}
+	return strings.TrimSpace(buf.String())
+}
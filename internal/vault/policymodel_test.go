@@ -0,0 +1,221 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func TestParsePolicyCanonicalHCL(t *testing.T) {
+	raw := `
+# Application secrets
+path "secret/data/app/*" {
+  capabilities = ["update", "read", "create"]
+  required_parameters = ["foo"]
+  allowed_parameters = {
+    "foo" = ["bar", "baz"]
+    "*" = []
+    "retries" = [1, true]
+  }
+  max_wrapping_ttl = 90
+}
+
+path "/auth/token/lookup-self" {
+  policy = "read"
+}
+
+path "secret/data/app/*" {
+  capabilities = ["read", "delete"]
+}
+`
+	expected := `path "auth/token/lookup-self" {
+  capabilities = ["list", "read"]
+}
+
+path "secret/data/app/*" {
+  capabilities = ["create", "delete", "read", "update"]
+  allowed_parameters = {
+    "*" = []
+    "foo" = ["bar", "baz"]
+    "retries" = [1, true]
+  }
+  required_parameters = ["foo"]
+  max_wrapping_ttl = "90"
+}
+`
+	pol, err := ParsePolicy(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := pol.HCL()
+	if out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+	reparsed, err := ParsePolicy(out)
+	if err != nil {
+		t.Fatalf("Expected canonical HCL to parse, got %s", err)
+	}
+	if roundTrip := reparsed.HCL(); roundTrip != out {
+		t.Errorf("Expected round trip to render %s, got %s", out, roundTrip)
+	}
+}
+
+func TestParsePolicyJSONRoundTrip(t *testing.T) {
+	rules := []rbacv1.PolicyRule{
+		{Resources: []string{"secret/data/app"}, Verbs: []string{"read", "create"}},
+		{Resources: []string{"secret/data/other"}, Verbs: []string{"deny"}},
+	}
+	options := map[string]*PathOptions{
+		"secret/data/app": {DeniedParameters: map[string][]any{"admin": {}}, MinWrappingTTL: "1s"},
+	}
+	pol, err := PolicyFromRules(rules, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := pol.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := ParsePolicy(js)
+	if err != nil {
+		t.Fatalf("Expected JSON policy to parse, got %s", err)
+	}
+	fromHCL, err := ParsePolicy(pol.HCL())
+	if err != nil {
+		t.Fatalf("Expected HCL policy to parse, got %s", err)
+	}
+	if fromJSON.HCL() != pol.HCL() || fromHCL.HCL() != pol.HCL() {
+		t.Errorf("Expected JSON and HCL to round trip to %s, got %s and %s", pol.HCL(), fromJSON.HCL(), fromHCL.HCL())
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	tt := []struct {
+		name   string
+		policy string
+	}{
+		{name: "syntax", policy: `path "secret/*" {`},
+		{name: "unknown top-level key", policy: `role "foo" {}`},
+		{name: "unsupported path key", policy: `path "secret/*" { control_group = {} }`},
+		{name: "unknown capability", policy: `path "secret/*" { capabilities = ["write"] }`},
+		{name: "unknown legacy policy", policy: `path "secret/*" { policy = "admin" }`},
+		{name: "invalid path", policy: `path "secret/*/app" { capabilities = ["read"] }`},
+		{name: "invalid ttl", policy: `path "secret/*" { capabilities = ["read"] min_wrapping_ttl = "soon" }`},
+		{
+			name: "duplicate options",
+			policy: `
+path "secret/*" { required_parameters = ["a"] }
+path "secret/*" { required_parameters = ["b"] }`,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ParsePolicy(tc.policy); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestPolicyFormat(t *testing.T) {
+	for _, format := range []PolicyFormat{PolicyFormatRaw, PolicyFormatHCL, PolicyFormatJSON} {
+		if err := format.Validate(); err != nil {
+			t.Errorf("Expected format %q to be valid, got %s", format, err)
+		}
+	}
+	if err := PolicyFormat("yaml").Validate(); err == nil {
+		t.Error("Expected error for unknown format, got nil")
+	}
+}
+
+func TestPolicyMerge(t *testing.T) {
+	pol, err := PolicyFromRules([]rbacv1.PolicyRule{
+		{Resources: []string{"secret/data/app"}, Verbs: []string{"read"}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ParsePolicy(`
+path "secret/data/app" { capabilities = ["update"] }
+path "secret/data/shared" { capabilities = ["read"] }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pol.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	expected := `path "secret/data/app" {
+  capabilities = ["read", "update"]
+}
+
+path "secret/data/shared" {
+  capabilities = ["read"]
+}
+`
+	if out := pol.HCL(); out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+	if caps := other.Path["secret/data/app"].Capabilities; len(caps) != 1 {
+		t.Errorf("Expected the merged policy to be left unmodified, got %v", caps)
+	}
+}
+
+func TestPolicyUnderlay(t *testing.T) {
+	pol, err := ParsePolicy(`
+path "secret/data/app" {
+  capabilities = ["read"]
+  max_wrapping_ttl = "1h"
+}
+path "secret/data/team" { capabilities = ["read"] }
+path "secret/data/root" { capabilities = ["deny"] }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ParsePolicy(`
+path "secret/data/app" {
+  capabilities = ["update"]
+  max_wrapping_ttl = "24h"
+}
+path "secret/data/admin" { capabilities = ["deny"] }
+path "secret/data/team" { capabilities = ["deny"] }
+path "secret/data/root" { capabilities = ["read"] }
+path "secret/data/shared" {
+  capabilities = ["read"]
+  required_parameters = ["version"]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pol.Underlay(other)
+	expected := `path "secret/data/admin" {
+  capabilities = ["deny"]
+}
+
+path "secret/data/app" {
+  capabilities = ["read", "update"]
+  max_wrapping_ttl = "1h"
+}
+
+path "secret/data/root" {
+  capabilities = ["deny"]
+}
+
+path "secret/data/shared" {
+  capabilities = ["read"]
+  required_parameters = ["version"]
+}
+
+path "secret/data/team" {
+  capabilities = ["read"]
+}
+`
+	if out := pol.HCL(); out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"fmt"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// RoleDefaultsConfig is the configuration file format for the auth role parameter
+// defaults applied by the controller and the maximums it enforces.
+type RoleDefaultsConfig struct {
+	// Defaults are the parameters of every role, overridden by the namespace,
+	// the referenced ConfigMap and the annotations of the object in that order.
+	Defaults map[string]string `json:"defaults,omitempty"`
+	// Maximums are upper bounds for duration and integer parameters of every role.
+	Maximums map[string]string `json:"maximums,omitempty"`
+	// Clamp lowers parameters exceeding a maximum to the maximum instead of
+	// rejecting the role.
+	Clamp bool `json:"clamp,omitempty"`
+	// Namespaces are the defaults and maximums for roles of objects in the given
+	// Kubernetes namespaces. They take precedence over the cluster-wide defaults,
+	// while the stricter of both maximums applies.
+	Namespaces map[string]*RoleNamespaceDefaults `json:"namespaces,omitempty"`
+}
+
+// RoleNamespaceDefaults are the auth role parameter defaults and maximums for a
+// Kubernetes namespace.
+type RoleNamespaceDefaults struct {
+	Defaults map[string]string `json:"defaults,omitempty"`
+	Maximums map[string]string `json:"maximums,omitempty"`
+}
+
+// LoadRoleDefaultsConfig reads the role defaults configuration at the given path.
+func LoadRoleDefaultsConfig(path string) (*RoleDefaultsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read role defaults config: %w", err)
+	}
+	var config RoleDefaultsConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse role defaults config: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validate checks the role defaults configuration for errors.
+func (c *RoleDefaultsConfig) Validate() error {
+	if err := validateRoleDefaults(c.Defaults, c.Maximums); err != nil {
+		return err
+	}
+	for ns, defaults := range c.Namespaces {
+		if defaults == nil {
+			continue
+		}
+		if err := validateRoleDefaults(defaults.Defaults, defaults.Maximums); err != nil {
+			return fmt.Errorf("namespace %q: %w", ns, err)
+		}
+	}
+	return nil
+}
+
+func validateRoleDefaults(defaults, maximums map[string]string) error {
+	for name, value := range defaults {
+		if _, err := ParseRoleParameter(name, value); err != nil {
+			return fmt.Errorf("invalid default: %w", err)
+		}
+	}
+	for name, value := range maximums {
+		if _, err := parseMaximum(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultsFor returns the default parameters for roles of objects in the given
+// namespace, converted to the types Vault expects.
+func (c *RoleDefaultsConfig) DefaultsFor(namespace string) (map[string]any, error) {
+	out := make(map[string]any)
+	if c == nil {
+		return out, nil
+	}
+	layers := []map[string]string{c.Defaults}
+	if ns := c.Namespaces[namespace]; ns != nil {
+		layers = append(layers, ns.Defaults)
+	}
+	for _, layer := range layers {
+		for name, value := range layer {
+			param, err := ParseRoleParameter(name, value)
+			if err != nil {
+				return nil, err
+			}
+			out[name] = param
+		}
+	}
+	return out, nil
+}
+
+// unlimitedWhenZero are the parameters Vault treats as unlimited, or as the system
+// default, when unset or zero. A zero token_period instead makes tokens non-periodic.
+var unlimitedWhenZero = []string{
+	"token_ttl",
+	"token_max_ttl",
+	"token_explicit_max_ttl",
+	"token_num_uses",
+}
+
+// Enforce applies the maximums for the given namespace to the parameters. A
+// parameter that is unset or zero, which Vault treats as unlimited or the system
+// default, is set to its maximum, while other parameters, like token_period, are
+// only bound when set. Parameters exceeding their maximum are lowered when clamping
+// is enabled and rejected otherwise.
+func (c *RoleDefaultsConfig) Enforce(namespace string, params map[string]any) error {
+	if c == nil {
+		return nil
+	}
+	maximums, err := c.maximumsFor(namespace)
+	if err != nil {
+		return err
+	}
+	for name, max := range maximums {
+		value, _ := params[name].(int)
+		switch {
+		case value == 0 && contains(unlimitedWhenZero, name):
+			params[name] = max
+		case value == 0:
+			// Only a value that is set is bound by the maximum
+		case value > max && c.Clamp:
+			params[name] = max
+		case value > max:
+			return fmt.Errorf("parameter %q exceeds the maximum of %d", name, max)
+		}
+	}
+	return nil
+}
+
+// maximumsFor returns the stricter of the cluster-wide and namespace maximums.
+func (c *RoleDefaultsConfig) maximumsFor(namespace string) (map[string]int, error) {
+	layers := []map[string]string{c.Maximums}
+	if ns := c.Namespaces[namespace]; ns != nil {
+		layers = append(layers, ns.Maximums)
+	}
+	out := make(map[string]int)
+	for _, layer := range layers {
+		for name, value := range layer {
+			max, err := parseMaximum(name, value)
+			if err != nil {
+				return nil, err
+			}
+			if current, ok := out[name]; !ok || max < current {
+				out[name] = max
+			}
+		}
+	}
+	return out, nil
+}
+
+// parseMaximum parses the maximum for a duration or integer parameter.
+func parseMaximum(name, value string) (int, error) {
+	if param, ok := roleParameters[name]; !ok || (param.typ != RoleParameterDuration && param.typ != RoleParameterInt) {
+		return 0, fmt.Errorf("maximums can only be set for duration and integer parameters, got %q", name)
+	}
+	max, err := ParseRoleParameter(name, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid maximum: %w", err)
+	}
+	if max.(int) <= 0 {
+		return 0, fmt.Errorf("maximum for %q must be positive", name)
+	}
+	return max.(int), nil
+}
@@ -0,0 +1,102 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRoleDefaultsConfig(t *testing.T) {
+	tt := []struct {
+		name      string
+		config    string
+		shouldErr bool
+	}{
+		{
+			name: "valid",
+			config: `
+defaults:
+  token_ttl: 1h
+  token_bound_cidrs: 10.0.0.0/8
+maximums:
+  token_max_ttl: 24h
+clamp: true
+namespaces:
+  payments:
+    defaults:
+      token_type: batch
+    maximums:
+      token_max_ttl: 12h
+      token_num_uses: "10"
+`,
+		},
+		{name: "unknown field", config: "default:\n  token_ttl: 1h\n", shouldErr: true},
+		{name: "unknown parameter", config: "defaults:\n  token_tll: 1h\n", shouldErr: true},
+		{name: "controller parameter", config: "defaults:\n  policies: root\n", shouldErr: true},
+		{name: "invalid default", config: "defaults:\n  token_ttl: soon\n", shouldErr: true},
+		{name: "maximum of a list", config: "maximums:\n  token_bound_cidrs: 10.0.0.0/8\n", shouldErr: true},
+		{name: "zero maximum", config: "maximums:\n  token_ttl: 0s\n", shouldErr: true},
+		{name: "invalid namespace maximum", config: "namespaces:\n  payments:\n    maximums:\n      token_type: batch\n", shouldErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "defaults.yaml")
+			if err := os.WriteFile(path, []byte(tc.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadRoleDefaultsConfig(path)
+			if tc.shouldErr && err == nil {
+				t.Fatal("Expected error, got nil")
+			}
+			if !tc.shouldErr && err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestRoleDefaultsEnforce(t *testing.T) {
+	var config *RoleDefaultsConfig
+	params := map[string]any{"token_max_ttl": 3600}
+	if err := config.Enforce("default", params); err != nil || params["token_max_ttl"] != 3600 {
+		t.Errorf("Expected a nil config to leave the parameters unchanged, got %v, %v", params, err)
+	}
+
+	config = &RoleDefaultsConfig{
+		Maximums:   map[string]string{"token_max_ttl": "24h", "token_num_uses": "10"},
+		Namespaces: map[string]*RoleNamespaceDefaults{"payments": {Maximums: map[string]string{"token_max_ttl": "48h"}}},
+	}
+	params = map[string]any{"token_num_uses": 0}
+	if err := config.Enforce("payments", params); err != nil {
+		t.Fatal(err)
+	}
+	if params["token_max_ttl"] != 86400 || params["token_num_uses"] != 10 {
+		t.Errorf("Expected the stricter maximums to be set, got %v", params)
+	}
+	if err := config.Enforce("payments", map[string]any{"token_num_uses": 11}); err == nil {
+		t.Error("Expected error for a parameter exceeding the maximum, got nil")
+	}
+
+	config = &RoleDefaultsConfig{Maximums: map[string]string{"token_period": "1h"}}
+	params = map[string]any{}
+	if err := config.Enforce("default", params); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := params["token_period"]; ok {
+		t.Errorf("Expected an unset token period to stay unset, got %v", params)
+	}
+	if err := config.Enforce("default", map[string]any{"token_period": 7200}); err == nil {
+		t.Error("Expected error for a token period exceeding the maximum, got nil")
+	}
+	config.Clamp = true
+	params = map[string]any{"token_period": 7200}
+	if err := config.Enforce("default", params); err != nil || params["token_period"] != 3600 {
+		t.Errorf("Expected the token period to be clamped, got %v, %v", params, err)
+	}
+}
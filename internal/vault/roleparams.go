@@ -0,0 +1,122 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/util"
+)
+
+// RoleParameterType is the type an auth role parameter is converted to before it
+// is written to Vault.
+type RoleParameterType string
+
+const (
+	// RoleParameterString is a parameter passed through as a string.
+	RoleParameterString RoleParameterType = "string"
+	// RoleParameterDuration is a duration string or a number of seconds, written
+	// as a number of seconds.
+	RoleParameterDuration RoleParameterType = "duration"
+	// RoleParameterInt is a parameter written as an integer.
+	RoleParameterInt RoleParameterType = "int"
+	// RoleParameterBool is a parameter written as a boolean.
+	RoleParameterBool RoleParameterType = "bool"
+	// RoleParameterList is a comma-separated or JSON list written as a list of strings.
+	RoleParameterList RoleParameterType = "list"
+)
+
+// roleParameter describes an auth role parameter that may be set on resources.
+type roleParameter struct {
+	typ RoleParameterType
+	// values restricts a string parameter to the given values.
+	values []string
+}
+
+// roleParameters are the auth role parameters that may be set through ConfigMaps
+// and annotations. See the API documentation for details:
+// https://developer.hashicorp.com/vault/api-docs/auth/kubernetes#create-role
+var roleParameters = map[string]roleParameter{
+	"audience":                {typ: RoleParameterList},
+	"alias_name_source":       {typ: RoleParameterString, values: []string{"serviceaccount_uid", "serviceaccount_name"}},
+	"token_ttl":               {typ: RoleParameterDuration},
+	"token_max_ttl":           {typ: RoleParameterDuration},
+	"token_explicit_max_ttl":  {typ: RoleParameterDuration},
+	"token_period":            {typ: RoleParameterDuration},
+	"token_bound_cidrs":       {typ: RoleParameterList},
+	"token_no_default_policy": {typ: RoleParameterBool},
+	"token_num_uses":          {typ: RoleParameterInt},
+	"token_type":              {typ: RoleParameterString, values: []string{"default", "service", "batch", "default-service", "default-batch"}},
+	"user_claim":              {typ: RoleParameterString},
+}
+
+// controllerParameters are the auth role parameters computed by the controller
+// from the resource itself, which may never be overridden.
+var controllerParameters = []string{
+	"policies",
+	"token_policies",
+	"bound_service_account_names",
+	"bound_service_account_namespaces",
+	NamespaceSelectorParameter,
+	BoundServiceAccountsParameter,
+	"role_type",
+	"bound_subject",
+	"bound_claims",
+	"bound_claims_type",
+	"bound_audiences",
+}
+
+// ParseRoleParameter converts the raw value of the named auth role parameter to
+// the type Vault expects. Parameters that are unknown or owned by the controller
+// are rejected.
+func ParseRoleParameter(name, value string) (any, error) {
+	if contains(controllerParameters, name) {
+		return nil, fmt.Errorf("parameter %q is managed by the controller", name)
+	}
+	param, ok := roleParameters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown role parameter %q", name)
+	}
+	value = strings.TrimSpace(value)
+	switch param.typ {
+	case RoleParameterDuration:
+		ttl, err := parseTTL(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for %q: %w", name, err)
+		}
+		return int(ttl.Seconds()), nil
+	case RoleParameterInt:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer for %q: %w", name, err)
+		}
+		return i, nil
+	case RoleParameterBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid boolean for %q: %w", name, err)
+		}
+		return b, nil
+	case RoleParameterList:
+		if strings.HasPrefix(value, "[") {
+			var list []string
+			if err := json.Unmarshal([]byte(value), &list); err != nil {
+				return nil, fmt.Errorf("invalid list for %q: %w", name, err)
+			}
+			return list, nil
+		}
+		return util.SplitList(value), nil
+	default:
+		if len(param.values) > 0 && !contains(param.values, value) {
+			return nil, fmt.Errorf("invalid value %q for %q, must be one of %s", value, name, strings.Join(param.values, ", "))
+		}
+		return value, nil
+	}
+}
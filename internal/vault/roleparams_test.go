@@ -0,0 +1,55 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRoleParameter(t *testing.T) {
+	tt := []struct {
+		name      string
+		value     string
+		want      any
+		shouldErr bool
+	}{
+		{name: "token_ttl", value: "1h", want: 3600},
+		{name: "token_max_ttl", value: "90", want: 90},
+		{name: "token_num_uses", value: " 5 ", want: 5},
+		{name: "token_no_default_policy", value: "true", want: true},
+		{name: "token_bound_cidrs", value: "10.0.0.0/8, 192.168.0.0/16", want: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+		{name: "audience", value: `["vault", "https://vault.example.com"]`, want: []string{"vault", "https://vault.example.com"}},
+		{name: "token_type", value: "batch", want: "batch"},
+		{name: "user_claim", value: "name", want: "name"},
+		{name: "token_ttl", value: "soon", shouldErr: true},
+		{name: "token_num_uses", value: "many", shouldErr: true},
+		{name: "token_no_default_policy", value: "yes please", shouldErr: true},
+		{name: "audience", value: `["vault"`, shouldErr: true},
+		{name: "token_type", value: "session", shouldErr: true},
+		{name: "token_tll", value: "1h", shouldErr: true},
+		{name: "policies", value: "root", shouldErr: true},
+		{name: "bound_service_account_names", value: "*", shouldErr: true},
+		{name: NamespaceSelectorParameter, value: "{}", shouldErr: true},
+	}
+	for _, tc := range tt {
+		got, err := ParseRoleParameter(tc.name, tc.value)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Expected error for %s=%q, got %v", tc.name, tc.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error for %s=%q, got %s", tc.name, tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Expected %#v for %s=%q, got %#v", tc.want, tc.name, tc.value, got)
+		}
+	}
+}
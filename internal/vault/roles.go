@@ -8,9 +8,14 @@ package vault
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"path"
+	"strings"
 
+	vaultapi "github.com/hashicorp/vault/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
@@ -19,16 +24,46 @@ import (
 
 type RoleManager interface {
 	RoleName(client.Object) string
+	AuthMounts(client.Object) []string
+	Location(context.Context, client.Object) (Location, error)
 	WriteRole(ctx context.Context, obj client.Object, params map[string]any) error
 	DeleteRole(ctx context.Context, obj client.Object) error
 }
 
-func NewRoleManager(authMount string) RoleManager {
-	return &roleManager{authMount: authMount}
+// RoleManagerOptions are the options for configuring a RoleManager.
+type RoleManagerOptions struct {
+	// AuthMounts are the auth mounts roles are written to when an object
+	// does not specify its own.
+	AuthMounts []string
+	// JWTAuthMounts are the auth mounts that use the JWT auth method. Roles
+	// written to these mounts are translated to JWT roles.
+	JWTAuthMounts []string
+	// JWTBoundAudiences are the audiences bound to JWT roles when an object
+	// does not specify its own.
+	JWTBoundAudiences []string
+	// JWTUserClaim is the user claim used for JWT roles when an object does
+	// not specify its own. Defaults to "sub".
+	JWTUserClaim string
+	// Connections selects the Vault connection roles are written to. If nil,
+	// the client from NewClient is used.
+	Connections ConnectionSelector
+	// Namespaces maps objects to the Vault namespace their roles are written
+	// to. If nil, roles are written to the namespace of the client.
+	Namespaces NamespaceMapper
+	// Tombstones stores the last definition of roles before they are deleted.
+	// If nil, deleted roles are not kept.
+	Tombstones TombstoneStore
+	// Recorder reports tombstones that could not be stored. If nil, they are
+	// only logged.
+	Recorder record.EventRecorder
+}
+
+func NewRoleManager(opts *RoleManagerOptions) RoleManager {
+	return &roleManager{opts: opts}
 }
 
 type roleManager struct {
-	authMount string
+	opts *RoleManagerOptions
 }
 
 func (r *roleManager) RoleName(obj client.Object) string {
@@ -40,22 +75,374 @@ func (r *roleManager) RoleName(obj client.Object) string {
 	return util.DefaultResourceFormat(obj.GetNamespace(), obj.GetName())
 }
 
+func (r *roleManager) AuthMounts(obj client.Object) []string {
+	if annotations := obj.GetAnnotations(); annotations != nil {
+		if mounts, ok := annotations[api.VaultAuthMountsAnnotation]; ok {
+			return util.SplitList(mounts)
+		}
+	}
+	return r.opts.AuthMounts
+}
+
 func (r *roleManager) WriteRole(ctx context.Context, obj client.Object, params map[string]any) error {
-	path := path.Join("auth", r.authMount, "role", r.RoleName(obj))
-	cli, err := NewClient()
+	mounts := r.AuthMounts(obj)
+	if len(mounts) == 0 {
+		return errors.New("no auth mounts configured for object")
+	}
+	loc, err := r.Location(ctx, obj)
+	if err != nil {
+		return err
+	}
+	cli, err := clientAt(ctx, r.opts.Connections, loc)
 	if err != nil {
-		return fmt.Errorf("failed to get vault client: %w", err)
+		return err
+	}
+	for _, mount := range mounts {
+		roles, err := r.mountRoles(mount, obj, params)
+		if err != nil {
+			return fmt.Errorf("invalid role for auth mount %q: %w", mount, err)
+		}
+		for _, role := range roles {
+			if _, err := cli.Logical().WriteWithContext(ctx, rolePath(mount, role.name), role.params); err != nil {
+				return fmt.Errorf("failed to write role to auth mount %q: %w", mount, err)
+			}
+		}
+		// Remove the roles previously written to the mount under other names
+		for _, name := range r.roleNames(obj) {
+			if containsRole(roles, name) {
+				continue
+			}
+			if _, err := cli.Logical().DeleteWithContext(ctx, rolePath(mount, name)); err != nil {
+				return fmt.Errorf("failed to delete role from auth mount %q: %w", mount, err)
+			}
+		}
+	}
+	// Remove the role from any mounts it was previously written to
+	for _, mount := range managedAuthMounts(obj) {
+		if contains(mounts, mount) {
+			continue
+		}
+		for _, name := range r.roleNames(obj) {
+			if _, err := cli.Logical().DeleteWithContext(ctx, rolePath(mount, name)); err != nil {
+				return fmt.Errorf("failed to delete role from auth mount %q: %w", mount, err)
+			}
+		}
+	}
+	// Remove the role from the location it was previously written to
+	if previous, ok := recordedLocation(obj); ok && previous != loc {
+		cli, err := clientAt(ctx, r.opts.Connections, previous)
+		if err != nil {
+			return err
+		}
+		for _, mount := range managedAuthMounts(obj) {
+			for _, name := range r.roleNames(obj) {
+				if _, err := cli.Logical().DeleteWithContext(ctx, rolePath(mount, name)); err != nil {
+					return fmt.Errorf("failed to delete role from auth mount %q of previous vault namespace: %w", mount, err)
+				}
+			}
+		}
 	}
-	_, err = cli.Logical().WriteWithContext(ctx, path, params)
-	return err
+	return nil
+}
+
+// Location returns the location the role of the object is currently mapped to.
+func (r *roleManager) Location(ctx context.Context, obj client.Object) (Location, error) {
+	return resolveLocation(ctx, r.opts.Connections, r.opts.Namespaces, obj)
 }
 
 func (r *roleManager) DeleteRole(ctx context.Context, obj client.Object) error {
-	path := path.Join("auth", r.authMount, "role", r.RoleName(obj))
-	cli, err := NewClient()
+	loc, err := lastLocation(ctx, r.opts.Connections, r.opts.Namespaces, obj)
+	if err != nil {
+		return err
+	}
+	cli, err := clientAt(ctx, r.opts.Connections, loc)
 	if err != nil {
-		return fmt.Errorf("failed to get vault client: %w", err)
+		return err
+	}
+	mounts := r.AuthMounts(obj)
+	for _, mount := range managedAuthMounts(obj) {
+		if !contains(mounts, mount) {
+			mounts = append(mounts, mount)
+		}
+	}
+	if r.opts.Tombstones != nil {
+		if err := r.saveTombstone(ctx, cli, loc, obj, mounts); err != nil {
+			return err
+		}
+	}
+	for _, mount := range mounts {
+		for _, name := range r.roleNames(obj) {
+			if _, err := cli.Logical().DeleteWithContext(ctx, rolePath(mount, name)); err != nil {
+				return fmt.Errorf("failed to delete role from auth mount %q: %w", mount, err)
+			}
+		}
+	}
+	return nil
+}
+
+// saveTombstone stores the current definition of the role on the given mounts, if any.
+func (r *roleManager) saveTombstone(ctx context.Context, cli *vaultapi.Client, loc Location, obj client.Object, mounts []string) error {
+	tombstone := &Tombstone{
+		ObjectReference: NewObjectReference(obj),
+		RoleName:        r.RoleName(obj),
+		Roles:           make(map[string]map[string]any),
+		Location:        &loc,
+		DeletedAt:       metav1.Now(),
+	}
+	var found bool
+	for _, mount := range mounts {
+		for _, name := range r.roleNames(obj) {
+			secret, err := cli.Logical().ReadWithContext(ctx, rolePath(mount, name))
+			if err != nil {
+				return fmt.Errorf("failed to read role from auth mount %q: %w", mount, err)
+			}
+			if secret == nil || secret.Data == nil {
+				continue
+			}
+			found = true
+			if name == tombstone.RoleName {
+				tombstone.Roles[mount] = secret.Data
+				continue
+			}
+			if tombstone.NamespacedRoles == nil {
+				tombstone.NamespacedRoles = make(map[string]map[string]map[string]any)
+			}
+			if tombstone.NamespacedRoles[name] == nil {
+				tombstone.NamespacedRoles[name] = make(map[string]map[string]any)
+			}
+			tombstone.NamespacedRoles[name][mount] = secret.Data
+		}
+	}
+	if found {
+		saveTombstone(ctx, r.opts.Tombstones, r.opts.Recorder, obj, tombstone)
+	}
+	return nil
+}
+
+// mountParameters translates the Kubernetes auth role parameters to those for the
+// auth method of the given mount.
+func (r *roleManager) mountParameters(mount string, params map[string]any) (map[string]any, error) {
+	if contains(r.opts.JWTAuthMounts, mount) {
+		if _, ok := params[NamespaceSelectorParameter]; ok {
+			return nil, errors.New("namespace selectors cannot be bound on JWT roles")
+		}
+		return toJWTRoleParameters(params, r.opts.JWTBoundAudiences, r.opts.JWTUserClaim)
+	}
+	out := make(map[string]any, len(params))
+	for k, v := range params {
+		if !contains(jwtOnlyParameters, k) && k != BoundServiceAccountsParameter {
+			out[k] = v
+		}
+	}
+	// Kubernetes auth roles only validate a single audience
+	if audiences, ok := params["audience"].([]string); ok {
+		switch len(audiences) {
+		case 0:
+			delete(out, "audience")
+		case 1:
+			out["audience"] = audiences[0]
+		default:
+			return nil, errors.New("kubernetes auth roles only support a single audience")
+		}
+	}
+	return out, nil
+}
+
+// role is an auth role written to a mount.
+type role struct {
+	name   string
+	params map[string]any
+}
+
+func containsRole(roles []role, name string) bool {
+	for _, role := range roles {
+		if role.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mountRoles returns the roles written to the given mount for the object. Kubernetes
+// auth roles bind every name in every namespace, so the service accounts of a
+// BoundServiceAccountsParameter are bound by a role per namespace, named by
+// NamespacedRoleName. JWT roles bind them by their subjects in a single role.
+func (r *roleManager) mountRoles(mount string, obj client.Object, params map[string]any) ([]role, error) {
+	pairs, _ := params[BoundServiceAccountsParameter].([]string)
+	if len(pairs) == 0 || contains(r.opts.JWTAuthMounts, mount) {
+		mountParams, err := r.mountParameters(mount, params)
+		if err != nil {
+			return nil, err
+		}
+		return []role{{name: r.RoleName(obj), params: mountParams}}, nil
+	}
+	if _, ok := params[NamespaceSelectorParameter]; ok {
+		return nil, errors.New("namespace selectors cannot be bound with different service accounts per namespace")
+	}
+	var roles []role
+	for _, namespace := range RoleNamespaces(params) {
+		nsParams := make(map[string]any, len(params))
+		for k, v := range params {
+			nsParams[k] = v
+		}
+		delete(nsParams, BoundServiceAccountsParameter)
+		var names []string
+		for _, pair := range pairs {
+			if ns, name, _ := strings.Cut(pair, ":"); ns == namespace {
+				names = append(names, name)
+			}
+		}
+		nsParams["bound_service_account_names"] = names
+		nsParams["bound_service_account_namespaces"] = []string{namespace}
+		mountParams, err := r.mountParameters(mount, nsParams)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role{name: NamespacedRoleName(r.RoleName(obj), namespace), params: mountParams})
+	}
+	return roles, nil
+}
+
+// roleNames returns the names of every role written for the object, including the
+// roles per namespace recorded on it.
+func (r *roleManager) roleNames(obj client.Object) []string {
+	names := []string{r.RoleName(obj)}
+	for _, namespace := range managedRoleNamespaces(obj) {
+		names = append(names, NamespacedRoleName(r.RoleName(obj), namespace))
+	}
+	return names
+}
+
+// RoleNamespaces returns the namespaces the Kubernetes auth role of the parameters is
+// split into a role per namespace for, or nil if it is written as a single role.
+func RoleNamespaces(params map[string]any) []string {
+	pairs, _ := params[BoundServiceAccountsParameter].([]string)
+	var namespaces []string
+	for _, pair := range pairs {
+		if ns, _, _ := strings.Cut(pair, ":"); !contains(namespaces, ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
+
+// NamespacedRoleName returns the name of the Kubernetes auth role binding the service
+// accounts of a role in the given namespace. Kubernetes names never contain an
+// underscore, so the names cannot collide across roles and namespaces.
+func NamespacedRoleName(name, namespace string) string {
+	return name + "__" + namespace
+}
+
+func rolePath(mount, name string) string {
+	return path.Join("auth", mount, "role", name)
+}
+
+// JWTRoleType is the role type used for roles written to JWT auth mounts.
+const JWTRoleType = "jwt"
+
+// NamespaceSelectorParameter is the Kubernetes auth role parameter binding service
+// accounts in all namespaces matching a label selector.
+const NamespaceSelectorParameter = "bound_service_account_namespace_selector"
+
+// BoundServiceAccountsParameter lists the service accounts bound by a role as
+// namespace:name pairs, when the names differ by namespace and cannot be bound by
+// bound_service_account_names and bound_service_account_namespaces. It is not a Vault
+// parameter and is translated for the auth method of each mount.
+const BoundServiceAccountsParameter = "bound_service_accounts"
+
+// kubernetesOnlyParameters are Kubernetes auth role parameters that have no
+// equivalent on JWT roles.
+var kubernetesOnlyParameters = []string{
+	"bound_service_account_names",
+	"bound_service_account_namespaces",
+	NamespaceSelectorParameter,
+	BoundServiceAccountsParameter,
+	"audience",
+	"alias_name_source",
+}
+
+// jwtOnlyParameters are JWT role parameters that have no equivalent on Kubernetes
+// auth roles.
+var jwtOnlyParameters = []string{
+	"user_claim",
+}
+
+// toJWTRoleParameters translates Kubernetes auth role parameters to a JWT role
+// binding the subjects of the same service accounts. Roles without any service
+// accounts are rejected, as the JWT role would not constrain who may log in.
+func toJWTRoleParameters(params map[string]any, audiences []string, userClaim string) (map[string]any, error) {
+	out := map[string]any{
+		"role_type":  JWTRoleType,
+		"user_claim": "sub",
+	}
+	if userClaim != "" {
+		out["user_claim"] = userClaim
+	}
+	for k, v := range params {
+		if !contains(kubernetesOnlyParameters, k) {
+			out[k] = v
+		}
+	}
+	pairs, _ := params[BoundServiceAccountsParameter].([]string)
+	if len(pairs) == 0 {
+		names, _ := params["bound_service_account_names"].([]string)
+		namespaces, _ := params["bound_service_account_namespaces"].([]string)
+		for _, ns := range namespaces {
+			for _, name := range names {
+				pairs = append(pairs, ns+":"+name)
+			}
+		}
+	}
+	var subjects []string
+	var glob bool
+	for _, pair := range pairs {
+		subjects = append(subjects, "system:serviceaccount:"+pair)
+		glob = glob || strings.Contains(pair, "*")
+	}
+	if len(subjects) == 0 {
+		return nil, errors.New("jwt roles must bind at least one service account")
+	}
+	switch {
+	case glob:
+		// Wildcard names can only be matched by glob bound claims
+		out["bound_claims_type"] = "glob"
+		out["bound_claims"] = map[string]any{"sub": subjects}
+	case len(subjects) == 1:
+		out["bound_subject"] = subjects[0]
+	default:
+		out["bound_claims"] = map[string]any{"sub": subjects}
+	}
+	if audience, ok := params["audience"].([]string); ok && len(audience) > 0 {
+		out["bound_audiences"] = audience
+	} else if len(audiences) > 0 {
+		out["bound_audiences"] = audiences
+	}
+	return out, nil
+}
+
+// managedAuthMounts returns the auth mounts the controller last recorded writing
+// the role for the object to.
+func managedAuthMounts(obj client.Object) []string {
+	if annotations := obj.GetAnnotations(); annotations != nil {
+		return util.SplitList(annotations[api.ManagedAuthMountsAnnotation])
+	}
+	return nil
+}
+
+// managedRoleNamespaces returns the namespaces the controller last recorded writing a
+// role per namespace for the object in.
+func managedRoleNamespaces(obj client.Object) []string {
+	if annotations := obj.GetAnnotations(); annotations != nil {
+		return util.SplitList(annotations[api.ManagedRoleNamespacesAnnotation])
+	}
+	return nil
+}
+
+func contains[T comparable](s []T, e T) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
 	}
-	_, err = cli.Logical().DeleteWithContext(ctx, path)
-	return err
+	return false
 }
@@ -8,6 +8,7 @@ package vault
 
 import (
 	"context"
+	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -26,7 +27,11 @@ var _ = Describe("Vault Roles", func() {
 		object = &corev1.ServiceAccount{}
 		object.SetName("serviceaccount")
 		object.SetNamespace("default")
-		roles = NewRoleManager("kubernetes")
+		roles = NewRoleManager(&RoleManagerOptions{
+			AuthMounts:        []string{"kubernetes"},
+			JWTAuthMounts:     []string{"jwt"},
+			JWTBoundAudiences: []string{"vault"},
+		})
 		Expect(roles).ToNot(BeNil())
 	})
 
@@ -51,6 +56,127 @@ var _ = Describe("Vault Roles", func() {
 
 	})
 
+	Describe("resolving auth mounts", func() {
+
+		When("the object has the auth mounts annotation", func() {
+			BeforeEach(func() {
+				object.SetAnnotations(map[string]string{
+					api.VaultAuthMountsAnnotation: "kubernetes, kubernetes-secondary",
+				})
+			})
+			It("should return the annotation value", func() {
+				Expect(roles.AuthMounts(object)).To(Equal([]string{"kubernetes", "kubernetes-secondary"}))
+			})
+		})
+
+		When("the object does not have an annotation", func() {
+			It("should return the configured mounts", func() {
+				Expect(roles.AuthMounts(object)).To(Equal([]string{"kubernetes"}))
+			})
+		})
+
+	})
+
+	Describe("translating roles for JWT auth mounts", func() {
+
+		When("the role binds multiple service accounts", func() {
+			It("should bind the subjects as claims", func() {
+				params, err := toJWTRoleParameters(map[string]any{
+					"bound_service_account_names":      []string{"foo", "bar"},
+					"bound_service_account_namespaces": []string{"default"},
+					"policies":                         []string{"test-policy"},
+				}, []string{"vault"}, "")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(params).ToNot(HaveKey("bound_subject"))
+				Expect(params["bound_claims"]).To(Equal(map[string]any{
+					"sub": []string{"system:serviceaccount:default:foo", "system:serviceaccount:default:bar"},
+				}))
+				Expect(params).ToNot(HaveKey("bound_service_account_names"))
+				Expect(params).ToNot(HaveKey("bound_service_account_namespaces"))
+			})
+		})
+
+		When("the role binds all service accounts in a namespace", func() {
+			It("should bind the subjects as glob claims", func() {
+				params, err := toJWTRoleParameters(map[string]any{
+					"bound_service_account_names":      []string{"*"},
+					"bound_service_account_namespaces": []string{"default"},
+				}, []string{"vault"}, "")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(params).ToNot(HaveKey("bound_subject"))
+				Expect(params["bound_claims_type"]).To(Equal("glob"))
+				Expect(params["bound_claims"]).To(Equal(map[string]any{
+					"sub": []string{"system:serviceaccount:default:*"},
+				}))
+			})
+		})
+
+		When("the role binds different service accounts per namespace", func() {
+			It("should bind the exact subjects as claims", func() {
+				params, err := toJWTRoleParameters(map[string]any{
+					BoundServiceAccountsParameter: []string{"default:foo", "other:bar"},
+				}, []string{"vault"}, "")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(params).ToNot(HaveKey(BoundServiceAccountsParameter))
+				Expect(params).ToNot(HaveKey("bound_claims_type"))
+				Expect(params["bound_claims"]).To(Equal(map[string]any{
+					"sub": []string{"system:serviceaccount:default:foo", "system:serviceaccount:other:bar"},
+				}))
+			})
+		})
+
+		When("the role binds no service accounts", func() {
+			It("should be rejected", func() {
+				_, err := toJWTRoleParameters(map[string]any{
+					"bound_service_account_names": []string{"foo"},
+				}, nil, "")
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		When("the role binds a namespace selector", func() {
+			It("should be rejected", func() {
+				manager := &roleManager{opts: &RoleManagerOptions{JWTAuthMounts: []string{"jwt"}}}
+				_, err := manager.mountParameters("jwt", map[string]any{
+					"bound_service_account_names": []string{"foo"},
+					NamespaceSelectorParameter:    `{"matchLabels":{"team":"payments"}}`,
+				})
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		When("a kubernetes role specifies multiple audiences", func() {
+			It("should be rejected", func() {
+				manager := &roleManager{opts: &RoleManagerOptions{}}
+				_, err := manager.mountParameters("kubernetes", map[string]any{
+					"audience": []string{"vault", "other"},
+				})
+				Expect(err).To(HaveOccurred())
+				params, err := manager.mountParameters("kubernetes", map[string]any{
+					"audience": []string{"vault"},
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(params["audience"]).To(Equal("vault"))
+			})
+		})
+
+		When("the role specifies its own audience and user claim", func() {
+			It("should override the defaults", func() {
+				params, err := toJWTRoleParameters(map[string]any{
+					"bound_service_account_names":      []string{"foo"},
+					"bound_service_account_namespaces": []string{"default"},
+					"audience":                         []string{"https://vault.example.com"},
+					"user_claim":                       "name",
+				}, []string{"vault"}, "sub")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(params["bound_audiences"]).To(Equal([]string{"https://vault.example.com"}))
+				Expect(params["user_claim"]).To(Equal("name"))
+				Expect(params).ToNot(HaveKey("audience"))
+			})
+		})
+
+	})
+
 	Describe("writing connection roles", func() {
 
 		When("the role is valid", func() {
@@ -77,6 +203,171 @@ var _ = Describe("Vault Roles", func() {
 			})
 		})
 
+		When("the object targets multiple auth mounts", func() {
+			BeforeEach(func() {
+				object.SetAnnotations(map[string]string{
+					api.VaultAuthMountsAnnotation: "kubernetes,kubernetes-secondary",
+				})
+				Expect(roles.WriteRole(context.Background(), object, map[string]any{
+					"bound_service_account_names":      []string{"default"},
+					"bound_service_account_namespaces": []string{"serviceaccount"},
+					"policies":                         []string{"test-policy"},
+				})).To(Succeed())
+			})
+			AfterEach(func() {
+				Expect(roles.DeleteRole(context.Background(), object)).To(Succeed())
+			})
+			It("should write the role to each mount", func() {
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				for _, mount := range []string{"kubernetes", "kubernetes-secondary"} {
+					role, err := cli.Logical().Read("auth/" + mount + "/role/default-serviceaccount")
+					Expect(err).To(BeNil())
+					Expect(role).ToNot(BeNil())
+				}
+			})
+		})
+
+		When("a mount is removed from the object", func() {
+			BeforeEach(func() {
+				object.SetAnnotations(map[string]string{
+					api.VaultAuthMountsAnnotation: "kubernetes,kubernetes-secondary",
+				})
+				Expect(roles.WriteRole(context.Background(), object, map[string]any{
+					"bound_service_account_names":      []string{"default"},
+					"bound_service_account_namespaces": []string{"serviceaccount"},
+					"policies":                         []string{"test-policy"},
+				})).To(Succeed())
+				object.SetAnnotations(map[string]string{
+					api.VaultAuthMountsAnnotation:   "kubernetes",
+					api.ManagedAuthMountsAnnotation: "kubernetes,kubernetes-secondary",
+				})
+				Expect(roles.WriteRole(context.Background(), object, map[string]any{
+					"bound_service_account_names":      []string{"default"},
+					"bound_service_account_namespaces": []string{"serviceaccount"},
+					"policies":                         []string{"test-policy"},
+				})).To(Succeed())
+			})
+			AfterEach(func() {
+				Expect(roles.DeleteRole(context.Background(), object)).To(Succeed())
+			})
+			It("should keep the role on the remaining mount", func() {
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				role, err := cli.Logical().Read("auth/kubernetes/role/default-serviceaccount")
+				Expect(err).To(BeNil())
+				Expect(role).ToNot(BeNil())
+			})
+			It("should delete the role from the removed mount", func() {
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				role, err := cli.Logical().Read("auth/kubernetes-secondary/role/default-serviceaccount")
+				Expect(err).To(BeNil())
+				Expect(role).To(BeNil())
+			})
+		})
+
+		When("the object targets a JWT auth mount", func() {
+			BeforeEach(func() {
+				object.SetAnnotations(map[string]string{
+					api.VaultAuthMountsAnnotation: "kubernetes,jwt",
+				})
+				Expect(roles.WriteRole(context.Background(), object, map[string]any{
+					"bound_service_account_names":      []string{"serviceaccount"},
+					"bound_service_account_namespaces": []string{"default"},
+					"policies":                         []string{"test-policy"},
+					"alias_name_source":                "serviceaccount_name",
+				})).To(Succeed())
+			})
+			AfterEach(func() {
+				Expect(roles.DeleteRole(context.Background(), object)).To(Succeed())
+			})
+			It("should write a kubernetes role to the kubernetes mount", func() {
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				role, err := cli.Logical().Read("auth/kubernetes/role/default-serviceaccount")
+				Expect(err).To(BeNil())
+				Expect(role).ToNot(BeNil())
+				Expect(role.Data["bound_service_account_names"]).To(Equal([]interface{}{"serviceaccount"}))
+			})
+			It("should write a jwt role to the jwt mount", func() {
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				role, err := cli.Logical().Read("auth/jwt/role/default-serviceaccount")
+				Expect(err).To(BeNil())
+				Expect(role).ToNot(BeNil())
+				Expect(role.Data["role_type"]).To(Equal(JWTRoleType))
+				Expect(role.Data["bound_subject"]).To(Equal("system:serviceaccount:default:serviceaccount"))
+				Expect(role.Data["bound_audiences"]).To(Equal([]interface{}{"vault"}))
+				Expect(role.Data["user_claim"]).To(Equal("sub"))
+				Expect(role.Data["policies"]).To(Equal([]interface{}{"test-policy"}))
+			})
+		})
+
+		When("the role binds different service accounts per namespace", func() {
+			BeforeEach(func() {
+				object.SetAnnotations(map[string]string{
+					api.VaultAuthMountsAnnotation: "kubernetes,jwt",
+				})
+				Expect(roles.WriteRole(context.Background(), object, map[string]any{
+					BoundServiceAccountsParameter: []string{"default:foo", "other:bar"},
+					"policies":                    []string{"test-policy"},
+				})).To(Succeed())
+				object.SetAnnotations(map[string]string{
+					api.VaultAuthMountsAnnotation:       "kubernetes,jwt",
+					api.ManagedAuthMountsAnnotation:     "kubernetes,jwt",
+					api.ManagedRoleNamespacesAnnotation: "default,other",
+				})
+			})
+			AfterEach(func() {
+				Expect(roles.DeleteRole(context.Background(), object)).To(Succeed())
+			})
+			It("should write a kubernetes role per namespace", func() {
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				role, err := cli.Logical().Read("auth/kubernetes/role/default-serviceaccount")
+				Expect(err).To(BeNil())
+				Expect(role).To(BeNil())
+				role, err = cli.Logical().Read("auth/kubernetes/role/default-serviceaccount__default")
+				Expect(err).To(BeNil())
+				Expect(role).ToNot(BeNil())
+				Expect(role.Data["bound_service_account_names"]).To(Equal([]interface{}{"foo"}))
+				Expect(role.Data["bound_service_account_namespaces"]).To(Equal([]interface{}{"default"}))
+				role, err = cli.Logical().Read("auth/kubernetes/role/default-serviceaccount__other")
+				Expect(err).To(BeNil())
+				Expect(role).ToNot(BeNil())
+				Expect(role.Data["bound_service_account_names"]).To(Equal([]interface{}{"bar"}))
+				Expect(role.Data["bound_service_account_namespaces"]).To(Equal([]interface{}{"other"}))
+			})
+			It("should write a single jwt role", func() {
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				role, err := cli.Logical().Read("auth/jwt/role/default-serviceaccount")
+				Expect(err).To(BeNil())
+				Expect(role).ToNot(BeNil())
+				Expect(role.Data["bound_claims"]).To(Equal(map[string]interface{}{
+					"sub": []interface{}{"system:serviceaccount:default:foo", "system:serviceaccount:other:bar"},
+				}))
+			})
+			It("should delete the roles per namespace once they are bound by a single role", func() {
+				Expect(roles.WriteRole(context.Background(), object, map[string]any{
+					"bound_service_account_names":      []string{"foo"},
+					"bound_service_account_namespaces": []string{"default", "other"},
+					"policies":                         []string{"test-policy"},
+				})).To(Succeed())
+				cli, err := NewClient()
+				Expect(err).To(BeNil())
+				for _, name := range []string{"default-serviceaccount__default", "default-serviceaccount__other"} {
+					role, err := cli.Logical().Read("auth/kubernetes/role/" + name)
+					Expect(err).To(BeNil())
+					Expect(role).To(BeNil())
+				}
+				role, err := cli.Logical().Read("auth/kubernetes/role/default-serviceaccount")
+				Expect(err).To(BeNil())
+				Expect(role).ToNot(BeNil())
+			})
+		})
+
 		When("the role is invalid", func() {
 			var err error
 			BeforeEach(func() {
@@ -121,3 +412,9 @@ var _ = Describe("Vault Roles", func() {
 
 	})
 })
+
+func TestNamespacedRoleName(t *testing.T) {
+	if a, b := NamespacedRoleName("a-b", "c"), NamespacedRoleName("a", "b-c"); a == b {
+		t.Errorf("Expected the roles of different namespaces to have different names, got %q for both", a)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PolicyTemplateData is the data available to policy templates. All values are
+// escaped as the content of an HCL or JSON string, so they can only be interpolated
+// into the quoted strings of a policy.
+type PolicyTemplateData struct {
+	// Namespace is the Kubernetes namespace of the object.
+	Namespace string
+	// Name is the name of the object.
+	Name string
+	// Labels are the labels of the object.
+	Labels map[string]string
+	// Annotations are the annotations of the object.
+	Annotations map[string]string
+}
+
+// policyTemplateFuncs are the only functions available to policy templates in
+// addition to the text/template builtins. They have no access to the environment
+// or the filesystem of the controller.
+var policyTemplateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"default": func(def string, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+// RenderPolicyTemplate renders the policy as a Go template with the metadata of the
+// given object as PolicyTemplateData. Referencing a missing field is an error, use
+// index to look up labels or annotations that may not be set. Vault's own identity
+// templating must be escaped, e.g. {{ "{{identity.entity.id}}" }}. The metadata is
+// escaped, so objects cannot add paths or capabilities to the policy through their
+// labels or annotations.
+func RenderPolicyTemplate(policy string, obj client.Object) (string, error) {
+	t, err := template.New("policy").Option("missingkey=error").Funcs(policyTemplateFuncs).Parse(policy)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse policy template: %w", err)
+	}
+	data := &PolicyTemplateData{
+		Namespace:   escapeString(obj.GetNamespace()),
+		Name:        escapeString(obj.GetName()),
+		Labels:      escapeStrings(obj.GetLabels()),
+		Annotations: escapeStrings(obj.GetAnnotations()),
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render policy template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// escapeString escapes the value as the content of an HCL or JSON string. Braces are
+// escaped as well, so the value can neither start an HCL interpolation nor a block
+// when it is interpolated outside of a string.
+func escapeString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '"':
+			b.WriteString(`\"`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '{' || r == '}' || unicode.IsControl(r):
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// escapeStrings returns a copy of the map with every value escaped by escapeString.
+func escapeStrings(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = escapeString(v)
+	}
+	return out
+}
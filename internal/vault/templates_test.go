@@ -0,0 +1,92 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRenderPolicyTemplate(t *testing.T) {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "tenant-a",
+		Name:        "app",
+		Labels:      map[string]string{"app.kubernetes.io/name": "Frontend"},
+		Annotations: map[string]string{"team": "web", "injected": "web\" { capabilities = [\"sudo\"] }\npath \"sys/*"},
+	}}
+	tt := []struct {
+		name      string
+		tmpl      string
+		want      string
+		shouldErr bool
+	}{
+		{name: "static", tmpl: `path "secret/*" {}`, want: `path "secret/*" {}`},
+		{name: "metadata", tmpl: `secret/data/{{ .Namespace }}/{{ .Name }}/*`, want: "secret/data/tenant-a/app/*"},
+		{
+			name: "labels and functions",
+			tmpl: `secret/data/{{ index .Labels "app.kubernetes.io/name" | lower }}/{{ .Annotations.team }}`,
+			want: "secret/data/frontend/web",
+		},
+		{name: "default", tmpl: `{{ index .Labels "tier" | default "backend" }}`, want: "backend"},
+		{name: "escaped identity template", tmpl: `{{ "{{identity.entity.id}}" }}`, want: "{{identity.entity.id}}"},
+		{name: "missing key", tmpl: `{{ .Annotations.missing }}`, shouldErr: true},
+		{name: "unknown function", tmpl: `{{ env "HOME" }}`, shouldErr: true},
+		{name: "unescaped identity template", tmpl: `{{identity.entity.id}}`, shouldErr: true},
+		{
+			name: "escaped values",
+			tmpl: `path "secret/data/{{ .Annotations.injected }}" {}`,
+			want: `path "secret/data/web\" \u007b capabilities = [\"sudo\"] \u007d\npath \"sys/*" {}`,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := RenderPolicyTemplate(tc.tmpl, sa)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("Expected error, got %q", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if out != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, out)
+			}
+		})
+	}
+}
+
+func TestRenderPolicyTemplateInjection(t *testing.T) {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "tenant-a",
+		Name:      "app",
+		Labels:    map[string]string{"team": "web\" {\n  capabilities = [\"sudo\"]\n}\npath \"sys/*"},
+	}}
+	out, err := RenderPolicyTemplate(`path "secret/data/{{ .Labels.team }}" { capabilities = ["read"] }`, sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := ParsePolicy(out)
+	if err != nil {
+		t.Fatalf("Expected the rendered policy to parse, got %s", err)
+	}
+	if len(policy.Path) != 1 {
+		t.Fatalf("Expected only the path of the template, got %v", policy.Path)
+	}
+	for path, rule := range policy.Path {
+		if path != "secret/data/web\" {\n  capabilities = [\"sudo\"]\n}\npath \"sys/*" {
+			t.Errorf("Expected the label to be part of the path, got %q", path)
+		}
+		if !reflect.DeepEqual(rule.Capabilities, []string{"read"}) {
+			t.Errorf("Expected the capabilities of the template, got %v", rule.Capabilities)
+		}
+	}
+}
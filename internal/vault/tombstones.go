@@ -0,0 +1,532 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+)
+
+// TombstonesConfigMap is the name of the ConfigMap in the controller namespace holding
+// tombstones when they are stored in Kubernetes.
+const TombstonesConfigMap = "vault-rbac-controller-tombstones"
+
+// ObjectReference identifies a Kubernetes object by the metadata the names and
+// locations of its Vault objects are derived from, so they can be recomputed after
+// the object is gone.
+type ObjectReference struct {
+	Kind        string            `json:"kind"`
+	Namespace   string            `json:"namespace"`
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// referenceAnnotations are the annotations kept in an ObjectReference, from which the
+// names, locations and deletion protection of the Vault objects are derived.
+var referenceAnnotations = []string{
+	api.VaultPolicyNameAnnotation,
+	api.VaultRoleNameAnnotation,
+	api.VaultAuthMountsAnnotation,
+	api.VaultConnectionAnnotation,
+	api.VaultDeletionProtectionAnnotation,
+	api.ManagedPolicyAnnotation,
+	api.ManagedAuthMountsAnnotation,
+	api.ManagedRoleNamespacesAnnotation,
+	api.ManagedVaultNamespaceAnnotation,
+	api.ManagedConnectionAnnotation,
+}
+
+// NewObjectReference returns a reference to the object, keeping only the
+// referenceAnnotations. Policies defined in annotations are left out, so references
+// stay small enough to keep many of them in a ConfigMap.
+func NewObjectReference(obj client.Object) ObjectReference {
+	ref := ObjectReference{
+		Namespace:   obj.GetNamespace(),
+		Name:        obj.GetName(),
+		Annotations: make(map[string]string),
+	}
+	switch obj.(type) {
+	case *corev1.ServiceAccount:
+		ref.Kind = "ServiceAccount"
+	case *rbacv1.RoleBinding:
+		ref.Kind = "RoleBinding"
+	case *rbacv1.Role:
+		ref.Kind = "Role"
+	default:
+		ref.Kind = obj.GetObjectKind().GroupVersionKind().Kind
+	}
+	annotations := obj.GetAnnotations()
+	for _, k := range referenceAnnotations {
+		if v, ok := annotations[k]; ok {
+			ref.Annotations[k] = v
+		}
+	}
+	return ref
+}
+
+// ParseObjectReference parses a reference of the form <kind>/<namespace>/<name>.
+func ParseObjectReference(s string) (ObjectReference, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return ObjectReference{}, fmt.Errorf("invalid object reference %q, must be <kind>/<namespace>/<name>", s)
+	}
+	ref := ObjectReference{Namespace: parts[1], Name: parts[2]}
+	for _, kind := range []string{"ServiceAccount", "RoleBinding", "Role"} {
+		if strings.EqualFold(parts[0], kind) {
+			ref.Kind = kind
+		}
+	}
+	if ref.Kind == "" {
+		return ObjectReference{}, fmt.Errorf("unknown kind %q", parts[0])
+	}
+	return ref, nil
+}
+
+// Object returns an object of the referenced kind with the recorded metadata.
+func (r ObjectReference) Object() (client.Object, error) {
+	var obj client.Object
+	switch r.Kind {
+	case "ServiceAccount":
+		obj = &corev1.ServiceAccount{}
+	case "RoleBinding":
+		obj = &rbacv1.RoleBinding{}
+	case "Role":
+		obj = &rbacv1.Role{}
+	default:
+		return nil, fmt.Errorf("unknown kind %q", r.Kind)
+	}
+	obj.SetNamespace(r.Namespace)
+	obj.SetName(r.Name)
+	obj.SetAnnotations(r.Annotations)
+	return obj, nil
+}
+
+// Key returns a key for the referenced object that is valid in ConfigMaps and KV paths.
+func (r ObjectReference) Key() string {
+	return strings.ToLower(r.Kind) + "." + r.Namespace + "." + r.Name
+}
+
+// String returns the reference in the form accepted by ParseObjectReference.
+func (r ObjectReference) String() string {
+	return strings.ToLower(r.Kind) + "/" + r.Namespace + "/" + r.Name
+}
+
+// Tombstone is the last definition of a policy or auth role deleted from Vault.
+type Tombstone struct {
+	// ObjectReference is the Kubernetes object the policy or role belonged to.
+	ObjectReference `json:",inline"`
+	// PolicyName and Policy are the name and rules of a deleted policy.
+	PolicyName string `json:"policyName,omitempty"`
+	Policy     string `json:"policy,omitempty"`
+	// RoleName and Roles are the name and the parameters, by auth mount, of a
+	// deleted auth role.
+	RoleName string                    `json:"roleName,omitempty"`
+	Roles    map[string]map[string]any `json:"roles,omitempty"`
+	// NamespacedRoles are the parameters, by role name and auth mount, of the roles
+	// written per namespace alongside the role.
+	NamespacedRoles map[string]map[string]map[string]any `json:"namespacedRoles,omitempty"`
+	// Location is where in Vault the policy or role was deleted from. It is missing
+	// from tombstones saved before it was recorded.
+	Location *Location `json:"location,omitempty"`
+	// DeletedAt is when the policy or role was deleted.
+	DeletedAt metav1.Time `json:"deletedAt"`
+}
+
+// Key returns the key of the tombstone, which is unique per object and type of
+// Vault object.
+func (t *Tombstone) Key() string {
+	if t.RoleName != "" {
+		return tombstoneKey(t.ObjectReference, "role")
+	}
+	return tombstoneKey(t.ObjectReference, "policy")
+}
+
+func tombstoneKey(ref ObjectReference, typ string) string {
+	return ref.Key() + "." + typ
+}
+
+// TombstoneStore stores the last definition of policies and roles before they are
+// deleted, so they can be restored.
+type TombstoneStore interface {
+	// Save stores the tombstone, replacing the previous one of the same Vault object.
+	Save(ctx context.Context, tombstone *Tombstone) error
+	// Load returns the tombstones of the policy and role of the referenced object.
+	Load(ctx context.Context, ref ObjectReference) ([]*Tombstone, error)
+	// List returns all stored tombstones.
+	List(ctx context.Context) ([]*Tombstone, error)
+}
+
+// NewTombstoneStore returns the tombstone store for the given location, which is
+// either "configmap", for a ConfigMap in the given namespace, or
+// "kv:[<connection>@]<mount>/<path>", for secrets under a path of a KV version 2 mount.
+// The mount is reached through the named Vault connection, or the client configured
+// from the environment if none is given. An empty location returns nil. The ConfigMap
+// only keeps tombstones for the given retention, or forever if zero, and drops the
+// oldest ones once it would outgrow the size limit of a ConfigMap.
+func NewTombstoneStore(location string, cli client.Client, namespace string, retention time.Duration, connections ConnectionSelector) (TombstoneStore, error) {
+	switch {
+	case location == "":
+		return nil, nil
+	case location == "configmap":
+		if namespace == "" {
+			return nil, errors.New("a controller namespace is required to store tombstones in a configmap")
+		}
+		return &configMapTombstoneStore{client: cli, namespace: namespace, retention: retention}, nil
+	case strings.HasPrefix(location, "kv:"):
+		kvPath := strings.TrimPrefix(location, "kv:")
+		connection, kvPath, ok := strings.Cut(kvPath, "@")
+		if !ok {
+			connection, kvPath = "", connection
+		}
+		mount, prefix, _ := strings.Cut(strings.Trim(kvPath, "/"), "/")
+		if mount == "" || (ok && connection == "") {
+			return nil, fmt.Errorf("invalid tombstone location %q, must be kv:[<connection>@]<mount>/<path>", location)
+		}
+		if connection != "" && connections == nil {
+			return nil, fmt.Errorf("tombstone location %q selects vault connection %q, but no connections are configured", location, connection)
+		}
+		return &kvTombstoneStore{connections: connections, connection: connection, mount: mount, prefix: prefix}, nil
+	default:
+		return nil, fmt.Errorf("invalid tombstone location %q, must be configmap or kv:[<connection>@]<mount>/<path>", location)
+	}
+}
+
+// RestoreTombstone re-creates the policy or role of the tombstone in the Vault
+// connection and namespace of the object it belonged to.
+func RestoreTombstone(ctx context.Context, connections ConnectionSelector, namespaces NamespaceMapper, tombstone *Tombstone) error {
+	loc, err := tombstone.location(ctx, connections, namespaces)
+	if err != nil {
+		return err
+	}
+	cli, err := clientAt(ctx, connections, loc)
+	if err != nil {
+		return err
+	}
+	if tombstone.PolicyName != "" {
+		if err := cli.Sys().PutPolicyWithContext(ctx, tombstone.PolicyName, tombstone.Policy); err != nil {
+			return fmt.Errorf("failed to restore policy %q: %w", tombstone.PolicyName, err)
+		}
+	}
+	for mount, params := range tombstone.Roles {
+		if _, err := cli.Logical().WriteWithContext(ctx, rolePath(mount, tombstone.RoleName), restorableRoleParameters(params)); err != nil {
+			return fmt.Errorf("failed to restore role %q to auth mount %q: %w", tombstone.RoleName, mount, err)
+		}
+	}
+	for name, roles := range tombstone.NamespacedRoles {
+		for mount, params := range roles {
+			if _, err := cli.Logical().WriteWithContext(ctx, rolePath(mount, name), restorableRoleParameters(params)); err != nil {
+				return fmt.Errorf("failed to restore role %q to auth mount %q: %w", name, mount, err)
+			}
+		}
+	}
+	return nil
+}
+
+// location returns where the policy or role of the tombstone was deleted from, falling
+// back to the location of the object for tombstones that did not record it.
+func (t *Tombstone) location(ctx context.Context, connections ConnectionSelector, namespaces NamespaceMapper) (Location, error) {
+	if t.Location != nil {
+		return *t.Location, nil
+	}
+	obj, err := t.Object()
+	if err != nil {
+		return Location{}, err
+	}
+	return lastLocation(ctx, connections, namespaces, obj)
+}
+
+// saveTombstone stores the tombstone of the object. Failing to store it does not block
+// the deletion of the Vault object, so the failure is logged and reported as an event
+// on the object instead.
+func saveTombstone(ctx context.Context, store TombstoneStore, recorder record.EventRecorder, obj client.Object, tombstone *Tombstone) {
+	if err := store.Save(ctx, tombstone); err != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "unable to save tombstone, deleting without it", "key", tombstone.Key())
+		if recorder != nil {
+			recorder.Event(obj, corev1.EventTypeWarning, api.EventReasonTombstoneFailed,
+				fmt.Sprintf("Deleted from Vault without a tombstone: %s", err))
+		}
+	}
+}
+
+// deprecatedRoleParameters are the aliases of token parameters returned when reading
+// roles, which Vault rejects when written alongside the parameters they alias.
+var deprecatedRoleParameters = map[string]string{
+	"policies":    "token_policies",
+	"ttl":         "token_ttl",
+	"max_ttl":     "token_max_ttl",
+	"period":      "token_period",
+	"num_uses":    "token_num_uses",
+	"bound_cidrs": "token_bound_cidrs",
+}
+
+// restorableRoleParameters returns the parameters of a role as read from Vault
+// without the deprecated aliases of parameters that are present.
+func restorableRoleParameters(params map[string]any) map[string]any {
+	out := make(map[string]any, len(params))
+	for k, v := range params {
+		if alias, ok := deprecatedRoleParameters[k]; ok {
+			if _, ok := params[alias]; ok {
+				continue
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// maxTombstonesSize is the size the data of the tombstones ConfigMap is kept under,
+// leaving room for its metadata within the 1MiB limit of Kubernetes objects.
+const maxTombstonesSize = 900 * 1024
+
+// configMapTombstoneStore stores tombstones as JSON in a ConfigMap.
+type configMapTombstoneStore struct {
+	client    client.Client
+	namespace string
+	retention time.Duration
+}
+
+func (s *configMapTombstoneStore) Save(ctx context.Context, tombstone *Tombstone) error {
+	data, err := json.Marshal(tombstone)
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var cm corev1.ConfigMap
+		err := s.client.Get(ctx, client.ObjectKey{Namespace: s.namespace, Name: TombstonesConfigMap}, &cm)
+		create := apierrors.IsNotFound(err)
+		if create {
+			cm = corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: TombstonesConfigMap}}
+		} else if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[tombstone.Key()] = string(data)
+		s.prune(ctx, cm.Data, time.Now())
+		if _, ok := cm.Data[tombstone.Key()]; !ok {
+			return fmt.Errorf("tombstone %q exceeds the size limit of the tombstones configmap", tombstone.Key())
+		}
+		if create {
+			return s.client.Create(ctx, &cm)
+		}
+		return s.client.Update(ctx, &cm)
+	})
+}
+
+// prune drops the tombstones older than the retention, and then the oldest ones until
+// the data fits in maxTombstonesSize.
+func (s *configMapTombstoneStore) prune(ctx context.Context, data map[string]string, now time.Time) {
+	type entry struct {
+		key       string
+		deletedAt time.Time
+	}
+	var (
+		entries []entry
+		size    int
+	)
+	for key, raw := range data {
+		var deletedAt time.Time
+		// Invalid tombstones are dropped first
+		if tombstone, err := decodeTombstone(raw); err == nil {
+			deletedAt = tombstone.DeletedAt.Time
+		}
+		if s.retention > 0 && deletedAt.Before(now.Add(-s.retention)) {
+			delete(data, key)
+			continue
+		}
+		entries = append(entries, entry{key: key, deletedAt: deletedAt})
+		size += len(key) + len(raw)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].deletedAt.Before(entries[j].deletedAt) })
+	for _, e := range entries {
+		if size <= maxTombstonesSize {
+			break
+		}
+		ctrl.LoggerFrom(ctx).Info("dropping oldest tombstone to stay within the configmap size limit", "key", e.key)
+		size -= len(e.key) + len(data[e.key])
+		delete(data, e.key)
+	}
+}
+
+func (s *configMapTombstoneStore) Load(ctx context.Context, ref ObjectReference) ([]*Tombstone, error) {
+	data, err := s.data(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []*Tombstone
+	for _, typ := range []string{"role", "policy"} {
+		raw, ok := data[tombstoneKey(ref, typ)]
+		if !ok {
+			continue
+		}
+		tombstone, err := decodeTombstone(raw)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tombstone)
+	}
+	return out, nil
+}
+
+func (s *configMapTombstoneStore) List(ctx context.Context) ([]*Tombstone, error) {
+	data, err := s.data(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]*Tombstone, 0, len(keys))
+	for _, key := range keys {
+		tombstone, err := decodeTombstone(data[key])
+		if err != nil {
+			return nil, fmt.Errorf("tombstone %q: %w", key, err)
+		}
+		out = append(out, tombstone)
+	}
+	return out, nil
+}
+
+func (s *configMapTombstoneStore) data(ctx context.Context) (map[string]string, error) {
+	var cm corev1.ConfigMap
+	if err := s.client.Get(ctx, client.ObjectKey{Namespace: s.namespace, Name: TombstonesConfigMap}, &cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get tombstones configmap: %w", err)
+	}
+	return cm.Data, nil
+}
+
+// kvTombstoneStore stores tombstones as secrets of a KV version 2 mount reached
+// through a Vault connection.
+type kvTombstoneStore struct {
+	connections ConnectionSelector
+	// connection is the name of the connection, empty for the client configured
+	// from the environment.
+	connection string
+	mount      string
+	prefix     string
+}
+
+func (s *kvTombstoneStore) client(ctx context.Context) (*vaultapi.Client, error) {
+	return clientAt(ctx, s.connections, Location{Connection: s.connection})
+}
+
+// kvTombstoneField is the field of the secret holding the tombstone as JSON.
+const kvTombstoneField = "tombstone"
+
+func (s *kvTombstoneStore) Save(ctx context.Context, tombstone *Tombstone) error {
+	cli, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(tombstone)
+	if err != nil {
+		return err
+	}
+	if _, err := cli.KVv2(s.mount).Put(ctx, path.Join(s.prefix, tombstone.Key()), map[string]any{kvTombstoneField: string(data)}); err != nil {
+		return fmt.Errorf("failed to write tombstone: %w", err)
+	}
+	return nil
+}
+
+func (s *kvTombstoneStore) Load(ctx context.Context, ref ObjectReference) ([]*Tombstone, error) {
+	cli, err := s.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []*Tombstone
+	for _, typ := range []string{"role", "policy"} {
+		tombstone, err := s.get(ctx, cli, tombstoneKey(ref, typ))
+		if errors.Is(err, vaultapi.ErrSecretNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tombstone)
+	}
+	return out, nil
+}
+
+func (s *kvTombstoneStore) List(ctx context.Context) ([]*Tombstone, error) {
+	cli, err := s.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := cli.Logical().ListWithContext(ctx, path.Join(s.mount, "metadata", s.prefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tombstones: %w", err)
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	keys, _ := secret.Data["keys"].([]any)
+	var out []*Tombstone
+	for _, key := range keys {
+		name, _ := key.(string)
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		tombstone, err := s.get(ctx, cli, name)
+		if errors.Is(err, vaultapi.ErrSecretNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tombstone)
+	}
+	return out, nil
+}
+
+func (s *kvTombstoneStore) get(ctx context.Context, cli *vaultapi.Client, key string) (*Tombstone, error) {
+	secret, err := cli.KVv2(s.mount).Get(ctx, path.Join(s.prefix, key))
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := secret.Data[kvTombstoneField].(string)
+	if !ok {
+		// The latest version was deleted
+		return nil, vaultapi.ErrSecretNotFound
+	}
+	tombstone, err := decodeTombstone(raw)
+	if err != nil {
+		return nil, fmt.Errorf("tombstone %q: %w", key, err)
+	}
+	return tombstone, nil
+}
+
+func decodeTombstone(raw string) (*Tombstone, error) {
+	var tombstone Tombstone
+	if err := json.Unmarshal([]byte(raw), &tombstone); err != nil {
+		return nil, fmt.Errorf("invalid tombstone: %w", err)
+	}
+	return &tombstone, nil
+}
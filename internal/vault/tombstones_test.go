@@ -0,0 +1,378 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/api"
+)
+
+var _ = Describe("Vault Tombstones", func() {
+	var store TombstoneStore
+	var policies PolicyManager
+	var roles RoleManager
+	var object client.Object
+
+	const policy = "path \"secret/*\" { capabilities = [\"read\"] }"
+
+	deleteAndRestore := func() {
+		ctx := context.Background()
+		Expect(policies.WritePolicy(ctx, object, policy)).To(Succeed())
+		Expect(roles.WriteRole(ctx, object, map[string]any{
+			"bound_service_account_names":      []string{"serviceaccount"},
+			"bound_service_account_namespaces": []string{"default"},
+			"policies":                         []string{"tombstone-serviceaccount"},
+			"token_ttl":                        3600,
+		})).To(Succeed())
+		Expect(roles.DeleteRole(ctx, object)).To(Succeed())
+		Expect(policies.DeletePolicy(ctx, object)).To(Succeed())
+
+		tombstones, err := store.Load(ctx, NewObjectReference(object))
+		Expect(err).To(BeNil())
+		Expect(tombstones).To(HaveLen(2))
+		for _, tombstone := range tombstones {
+			Expect(RestoreTombstone(ctx, nil, nil, tombstone)).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		object = &corev1.ServiceAccount{}
+		object.SetName("serviceaccount")
+		object.SetNamespace("tombstone")
+		object.SetAnnotations(map[string]string{
+			api.VaultAuthMountsAnnotation: "kubernetes,jwt",
+			"unrelated":                   "annotation",
+		})
+	})
+
+	AfterEach(func() {
+		Expect(NewRoleManager(&RoleManagerOptions{}).DeleteRole(context.Background(), object)).To(Succeed())
+		Expect(NewPolicyManager(&PolicyManagerOptions{}).DeletePolicy(context.Background(), object)).To(Succeed())
+	})
+
+	itRestores := func() {
+		It("should restore the policy", func() {
+			cli, err := NewClient()
+			Expect(err).To(BeNil())
+			restored, err := cli.Sys().GetPolicy("tombstone-serviceaccount")
+			Expect(err).To(BeNil())
+			Expect(restored).To(Equal(policy))
+		})
+		It("should restore the role on every mount", func() {
+			cli, err := NewClient()
+			Expect(err).To(BeNil())
+			role, err := cli.Logical().Read("auth/kubernetes/role/tombstone-serviceaccount")
+			Expect(err).To(BeNil())
+			Expect(role).ToNot(BeNil())
+			Expect(role.Data["bound_service_account_names"]).To(Equal([]interface{}{"serviceaccount"}))
+			Expect(role.Data["token_policies"]).To(Equal([]interface{}{"tombstone-serviceaccount"}))
+			role, err = cli.Logical().Read("auth/jwt/role/tombstone-serviceaccount")
+			Expect(err).To(BeNil())
+			Expect(role).ToNot(BeNil())
+			Expect(role.Data["bound_subject"]).To(Equal("system:serviceaccount:default:serviceaccount"))
+		})
+		It("should list the tombstones", func() {
+			tombstones, err := store.List(context.Background())
+			Expect(err).To(BeNil())
+			Expect(tombstones).To(HaveLen(2))
+			Expect(tombstones[0].Kind).To(Equal("ServiceAccount"))
+			Expect(tombstones[0].Annotations).ToNot(HaveKey("unrelated"))
+		})
+	}
+
+	When("tombstones are stored in a configmap", func() {
+		BeforeEach(func() {
+			var err error
+			store, err = NewTombstoneStore("configmap", fake.NewClientBuilder().Build(), "vault-rbac-controller", 0, nil)
+			Expect(err).To(BeNil())
+			policies = NewPolicyManager(&PolicyManagerOptions{Tombstones: store})
+			roles = NewRoleManager(&RoleManagerOptions{JWTAuthMounts: []string{"jwt"}, JWTBoundAudiences: []string{"vault"}, Tombstones: store})
+			deleteAndRestore()
+		})
+		itRestores()
+	})
+
+	When("nothing was deleted", func() {
+		It("should not store a tombstone", func() {
+			var err error
+			store, err = NewTombstoneStore("configmap", fake.NewClientBuilder().Build(), "vault-rbac-controller", 0, nil)
+			Expect(err).To(BeNil())
+			Expect(NewPolicyManager(&PolicyManagerOptions{Tombstones: store}).DeletePolicy(context.Background(), object)).To(Succeed())
+			Expect(NewRoleManager(&RoleManagerOptions{Tombstones: store}).DeleteRole(context.Background(), object)).To(Succeed())
+			tombstones, err := store.List(context.Background())
+			Expect(err).To(BeNil())
+			Expect(tombstones).To(BeEmpty())
+		})
+	})
+
+	Describe("parsing tombstone locations", func() {
+		It("should reject invalid locations", func() {
+			_, err := NewTombstoneStore("configmap", nil, "", 0, nil)
+			Expect(err).ToNot(BeNil())
+			_, err = NewTombstoneStore("kv:", nil, "", 0, nil)
+			Expect(err).ToNot(BeNil())
+			_, err = NewTombstoneStore("s3", nil, "", 0, nil)
+			Expect(err).ToNot(BeNil())
+		})
+		It("should accept kv paths", func() {
+			store, err := NewTombstoneStore("kv:secret/vault-rbac-controller/tombstones", nil, "", 0, nil)
+			Expect(err).To(BeNil())
+			Expect(store).To(Equal(&kvTombstoneStore{mount: "secret", prefix: "vault-rbac-controller/tombstones"}))
+		})
+		It("should only accept kv paths of configured connections", func() {
+			_, err := NewTombstoneStore("kv:primary@secret/tombstones", nil, "", 0, nil)
+			Expect(err).ToNot(BeNil())
+			_, err = NewTombstoneStore("kv:@secret/tombstones", nil, "", 0, nil)
+			Expect(err).ToNot(BeNil())
+			connections := NewConnectionSelector(nil, &ConnectionsConfig{})
+			store, err := NewTombstoneStore("kv:primary@secret/tombstones", nil, "", 0, connections)
+			Expect(err).To(BeNil())
+			Expect(store).To(Equal(&kvTombstoneStore{connections: connections, connection: "primary", mount: "secret", prefix: "tombstones"}))
+		})
+		It("should parse object references", func() {
+			ref, err := ParseObjectReference("serviceaccount/default/app")
+			Expect(err).To(BeNil())
+			Expect(ref.Kind).To(Equal("ServiceAccount"))
+			Expect(ref.String()).To(Equal("serviceaccount/default/app"))
+			_, err = ParseObjectReference("pod/default/app")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+})
+
+// failingTombstoneStore fails to save every tombstone.
+type failingTombstoneStore struct{ TombstoneStore }
+
+func (failingTombstoneStore) Save(context.Context, *Tombstone) error {
+	return errors.New("tombstones configmap is full")
+}
+
+func TestTombstonesOfDeletedNamespace(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		headers = make(map[string]string)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		headers[r.Method+" "+r.URL.Path] = r.Header.Get("X-Vault-Namespace")
+		if r.Method == http.MethodGet && r.URL.Path == "/v1/sys/policies/acl/team-a-app" {
+			fmt.Fprint(w, `{"data": {"name": "team-a-app", "policy": "path \"secret/*\" { capabilities = [\"read\"] }"}}`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	newClient := NewClient
+	defer func() { NewClient = newClient }()
+	NewClient = func() (*vaultapi.Client, error) {
+		cfg := vaultapi.DefaultConfig()
+		cfg.Address = srv.URL
+		cli, err := vaultapi.NewClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cli.SetToken("test")
+		return cli, nil
+	}
+
+	ctx := context.Background()
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Annotations: map[string]string{
+		api.VaultNamespaceAnnotation: "annotated",
+	}}}
+	cli := fake.NewClientBuilder().WithObjects(ns).Build()
+	mapper, err := NewNamespaceMapper(cli, "tenants/{{ .Namespace }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app"}}
+
+	// A tombstone that cannot be saved does not block the deletion
+	recorder := record.NewFakeRecorder(1)
+	policies := NewPolicyManager(&PolicyManagerOptions{Namespaces: mapper, Tombstones: failingTombstoneStore{}, Recorder: recorder})
+	if err := policies.DeletePolicy(ctx, obj); err != nil {
+		t.Fatalf("Expected the policy to be deleted without a tombstone, got %s", err)
+	}
+	if _, ok := headers["DELETE /v1/sys/policies/acl/team-a-app"]; !ok {
+		t.Error("Expected the policy to be deleted")
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning TombstoneFailed") {
+			t.Errorf("Unexpected event %q", event)
+		}
+	default:
+		t.Error("Expected an event reporting the missing tombstone")
+	}
+
+	// Tombstones are restored to where they were deleted from, even once the namespace is gone
+	store, err := NewTombstoneStore("configmap", cli, "vault-rbac-controller", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies = NewPolicyManager(&PolicyManagerOptions{Namespaces: mapper, Tombstones: store})
+	if err := policies.DeletePolicy(ctx, obj); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Delete(ctx, ns); err != nil {
+		t.Fatal(err)
+	}
+	tombstones, err := store.Load(ctx, NewObjectReference(obj))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombstones) != 1 || tombstones[0].Location == nil || tombstones[0].Location.Namespace != "annotated" {
+		t.Fatalf("Expected a tombstone recording its location, got %v", tombstones)
+	}
+	if err := RestoreTombstone(ctx, nil, mapper, tombstones[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := headers["PUT /v1/sys/policies/acl/team-a-app"]; got != "annotated" {
+		t.Errorf("Expected the policy to be restored to namespace %q, got %q", "annotated", got)
+	}
+}
+
+func TestTombstoneRetention(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	large := strings.Repeat("#", maxTombstonesSize/3)
+	tombstone := func(name string, deletedAt time.Time, policy string) *Tombstone {
+		return &Tombstone{
+			ObjectReference: ObjectReference{Kind: "Role", Namespace: "default", Name: name},
+			PolicyName:      "default-" + name,
+			Policy:          policy,
+			DeletedAt:       metav1.NewTime(deletedAt),
+		}
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "vault-rbac-controller", Name: TombstonesConfigMap},
+		Data:       map[string]string{"invalid": "{"},
+	}
+	for _, t := range []*Tombstone{
+		tombstone("expired", now.Add(-48*time.Hour), ""),
+		tombstone("oldest", now.Add(-3*time.Hour), large),
+		tombstone("older", now.Add(-2*time.Hour), large),
+		tombstone("old", now.Add(-time.Hour), ""),
+	} {
+		data, err := json.Marshal(t)
+		if err != nil {
+			panic(err)
+		}
+		cm.Data[t.Key()] = string(data)
+	}
+	store, err := NewTombstoneStore("configmap", fake.NewClientBuilder().WithObjects(cm).Build(), "vault-rbac-controller", 24*time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(ctx, tombstone("new", now, large)); err != nil {
+		t.Fatal(err)
+	}
+	tombstones, err := store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tombstone := range tombstones {
+		names = append(names, tombstone.Name)
+	}
+	sort.Strings(names)
+	if expected := []string{"new", "old", "older"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v to be kept, got %v", expected, names)
+	}
+
+	if err := store.Save(ctx, tombstone("huge", now, strings.Repeat("#", maxTombstonesSize))); err == nil {
+		t.Error("Expected error for a tombstone exceeding the size limit, got nil")
+	}
+}
+
+func TestObjectReference(t *testing.T) {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app", Annotations: map[string]string{
+		api.VaultInlinePolicyAnnotation:     strings.Repeat("#", 64*1024),
+		api.VaultPolicyNameAnnotation:       "custom",
+		api.ManagedVaultNamespaceAnnotation: "tenants/default",
+		"example.com/unrelated":             "true",
+	}}}
+	ref := NewObjectReference(sa)
+	expected := map[string]string{
+		api.VaultPolicyNameAnnotation:       "custom",
+		api.ManagedVaultNamespaceAnnotation: "tenants/default",
+	}
+	if !reflect.DeepEqual(ref.Annotations, expected) {
+		t.Errorf("Expected annotations %v, got %v", expected, ref.Annotations)
+	}
+	obj, err := ref.Object()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := NewPolicyManager(&PolicyManagerOptions{}).PolicyName(obj); name != "custom" {
+		t.Errorf("Expected the referenced object to keep its policy name, got %q", name)
+	}
+}
+
+func TestKVTombstonesThroughConnection(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests = make(map[string]string)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests[r.Method+" "+r.URL.Path] = r.Header.Get("X-Vault-Namespace")
+		fmt.Fprint(w, `{"data": {"version": 1}}`)
+	}))
+	defer srv.Close()
+	tokenFile := filepath.Join(t.TempDir(), "vault-token")
+	if err := os.WriteFile(tokenFile, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	connections := NewConnectionSelector(fake.NewClientBuilder().Build(), &ConnectionsConfig{
+		Connections: []*Connection{{Name: "primary", Address: srv.URL, Namespace: "admin", Auth: ConnectionAuth{TokenFile: tokenFile}}},
+	})
+	store, err := NewTombstoneStore("kv:primary@secret/tombstones", nil, "", 0, connections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstone := &Tombstone{
+		ObjectReference: ObjectReference{Kind: "ServiceAccount", Namespace: "default", Name: "app"},
+		PolicyName:      "default-app",
+	}
+	if err := store.Save(context.Background(), tombstone); err != nil {
+		t.Fatal(err)
+	}
+	namespace, ok := requests["PUT /v1/secret/data/tombstones/serviceaccount.default.app.policy"]
+	if !ok {
+		t.Fatalf("Expected the tombstone to be written through the connection, got %v", requests)
+	}
+	if namespace != "admin" {
+		t.Errorf("Expected the tombstone to be written to the namespace of the connection, got %q", namespace)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	. "github.com/onsi/gomega"
 
 	"github.com/hashicorp/go-hclog"
+	jwtauth "github.com/hashicorp/vault-plugin-auth-jwt"
 	k8sauth "github.com/hashicorp/vault-plugin-auth-kubernetes"
 	"github.com/hashicorp/vault/api"
 	vaulthttp "github.com/hashicorp/vault/http"
@@ -52,6 +53,7 @@ func setupTestVault(t testingi.T) *vault.TestCluster {
 	cluster := vault.NewTestCluster(t, &vault.CoreConfig{
 		CredentialBackends: map[string]logical.Factory{
 			"kubernetes": k8sauth.Factory,
+			"jwt":        jwtauth.Factory,
 		},
 	}, &vault.TestClusterOptions{
 		NumCores:    1,
@@ -68,6 +70,16 @@ func setupTestVault(t testingi.T) *vault.TestCluster {
 	}); err != nil {
 		t.Fatal(err)
 	}
+	if err := cluster.Cores[0].Client.Sys().EnableAuthWithOptions("kubernetes-secondary", &api.EnableAuthOptions{
+		Type: "kubernetes",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Cores[0].Client.Sys().EnableAuthWithOptions("jwt", &api.EnableAuthOptions{
+		Type: "jwt",
+	}); err != nil {
+		t.Fatal(err)
+	}
 
 	return cluster
 }
@@ -0,0 +1,52 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"fmt"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// Capabilities is the list of all capabilities recognized by Vault policies.
+var Capabilities = []string{"create", "read", "update", "patch", "delete", "list", "sudo", "deny"}
+
+// VerbTranslations maps Kubernetes RBAC verbs to the Vault capabilities they grant.
+var VerbTranslations = map[string][]string{
+	"get":              {"read"},
+	"list":             {"list"},
+	"watch":            {"read", "list"},
+	"create":           {"create"},
+	"update":           {"update"},
+	"patch":            {"patch"},
+	"delete":           {"delete"},
+	"deletecollection": {"delete", "list"},
+	rbacv1.VerbAll:     {"create", "read", "update", "patch", "delete", "list"},
+}
+
+// TranslateVerbs returns a copy of the rules with Kubernetes verbs replaced by the
+// Vault capabilities they map to in VerbTranslations. Verbs that are already Vault
+// capabilities are kept as-is, any other verb is rejected.
+func TranslateVerbs(rules []rbacv1.PolicyRule) ([]rbacv1.PolicyRule, error) {
+	out := make([]rbacv1.PolicyRule, len(rules))
+	for i, rule := range rules {
+		var capabilities []string
+		for _, verb := range rule.Verbs {
+			if translated, ok := VerbTranslations[verb]; ok {
+				capabilities = append(capabilities, translated...)
+				continue
+			}
+			if !contains(Capabilities, verb) {
+				return nil, fmt.Errorf("unknown verb %q in rule for %v", verb, rule.Resources)
+			}
+			capabilities = append(capabilities, verb)
+		}
+		out[i] = *rule.DeepCopy()
+		out[i].Verbs = normalizeCapabilities(capabilities)
+	}
+	return out, nil
+}
@@ -0,0 +1,50 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package vault
+
+import (
+	"reflect"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func TestTranslateVerbs(t *testing.T) {
+	tt := []struct {
+		verbs     []string
+		want      []string
+		shouldErr bool
+	}{
+		{verbs: []string{"get"}, want: []string{"read"}},
+		{verbs: []string{"get", "watch"}, want: []string{"list", "read"}},
+		{verbs: []string{"deletecollection", "patch"}, want: []string{"delete", "list", "patch"}},
+		{verbs: []string{"*"}, want: []string{"create", "delete", "list", "patch", "read", "update"}},
+		{verbs: []string{"get", "sudo"}, want: []string{"read", "sudo"}},
+		{verbs: []string{"deny"}, want: []string{"deny"}},
+		{verbs: []string{"get", "escalate"}, shouldErr: true},
+	}
+	for _, tc := range tt {
+		rules := []rbacv1.PolicyRule{{Resources: []string{"secret/*"}, Verbs: tc.verbs}}
+		out, err := TranslateVerbs(rules)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Expected error for verbs %v, got nil", tc.verbs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error for verbs %v, got %s", tc.verbs, err)
+			continue
+		}
+		if !reflect.DeepEqual(out[0].Verbs, tc.want) {
+			t.Errorf("Expected verbs %v to translate to %v, got %v", tc.verbs, tc.want, out[0].Verbs)
+		}
+		if !reflect.DeepEqual(rules[0].Verbs, tc.verbs) {
+			t.Errorf("Expected the original rules to be left unmodified, got %v", rules[0].Verbs)
+		}
+	}
+}
@@ -7,22 +7,26 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/tinyzimmer/vault-rbac-controller/internal/reconcilers"
+	"github.com/tinyzimmer/vault-rbac-controller/internal/util"
 	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
 )
 
@@ -44,10 +48,30 @@ func main() {
 		enableLeaderElection    bool
 		probeAddr               string
 		useFinalizers           bool
+		uninstall               bool
+		translateVerbs          bool
+		rolePolicyFormat        string
+		saPolicyFormat          string
 		authMount               string
+		jwtAuthMounts           string
+		jwtBoundAudiences       string
+		jwtUserClaim            string
+		vaultNamespaceTemplate  string
+		vaultConnectionsFile    string
+		roleDefaultsFile        string
+		controllerNamespace     string
+		deletionGracePeriod     time.Duration
+		tombstones              string
+		tombstoneRetention      time.Duration
+		namespaceCleanup        bool
+		sharedPolicyNamespace   string
+		attachablePolicies      string
+		aggregateRoles          bool
 		namespaces              string
 		excludeNamespaces       string
 		includeSystemNamespaces bool
+		configureAuthMount      bool
+		authMountOpts           reconcilers.AuthMountOptions
 	)
 
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
@@ -56,15 +80,77 @@ func main() {
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.BoolVar(&useFinalizers, "use-finalizers", false,
-		"Ensure finalizers on resources to attempt to clean up on deletion.")
-	flag.StringVar(&authMount, "auth-mount", "kubernetes", "The auth mount for the kubernetes auth method.")
+		"Ensure finalizers on resources to attempt to clean up on deletion. "+
+			"When disabled, finalizers added while it was enabled are removed.")
+	flag.BoolVar(&uninstall, "uninstall", false,
+		"Remove the finalizer from every resource in the cluster instead of reconciling, so the controller can be "+
+			"removed without blocking deletions. Vault policies and roles are left in place.")
+	flag.BoolVar(&translateVerbs, "translate-verbs", false,
+		"Translate Kubernetes verbs in Role rules to Vault capabilities and reject unknown verbs.")
+	flag.StringVar(&rolePolicyFormat, "role-policy-format", string(vault.PolicyFormatJSON),
+		"The format policies generated from Roles are written in. One of hcl or json.")
+	flag.StringVar(&saPolicyFormat, "serviceaccount-policy-format", string(vault.PolicyFormatRaw),
+		"The format ServiceAccount policies are written in. One of raw, hcl or json. "+
+			"With hcl or json, policies are validated and rewritten in a canonical form.")
+	flag.StringVar(&authMount, "auth-mount", "kubernetes",
+		"The auth mount for the kubernetes auth method. Multiple mounts may be given as a comma-separated list.")
+	flag.StringVar(&jwtAuthMounts, "jwt-auth-mounts", "",
+		"Comma-separated list of auth mounts using the JWT auth method. Roles written to these mounts are created as JWT roles.")
+	flag.StringVar(&jwtBoundAudiences, "jwt-bound-audiences", "",
+		"Comma-separated list of audiences bound to JWT roles that do not specify their own.")
+	flag.StringVar(&jwtUserClaim, "jwt-user-claim", "sub", "The user claim for JWT roles that do not specify their own.")
+	flag.StringVar(&vaultNamespaceTemplate, "vault-namespace-template", "",
+		"A template for the Vault Enterprise namespace objects are written to, e.g. \"tenants/{{ .Namespace }}\". "+
+			"Namespaces annotated with vault.hashicorp.com/namespace override it. If empty, objects in namespaces without the annotation are written to the namespace of the Vault client.")
+	flag.StringVar(&vaultConnectionsFile, "vault-connections", "",
+		"Path to a file defining named Vault connections that namespaces and objects may select. "+
+			"If empty, all objects use the Vault client configured from the environment.")
+	flag.StringVar(&roleDefaultsFile, "role-defaults", "",
+		"Path to a file defining auth role parameter defaults and maximums, cluster-wide and per namespace. "+
+			"If empty, roles only use the parameters of their resources.")
+	flag.StringVar(&controllerNamespace, "controller-namespace", os.Getenv("POD_NAMESPACE"),
+		"The namespace the controller keeps its own state in. Defaults to the POD_NAMESPACE environment variable.")
+	flag.DurationVar(&deletionGracePeriod, "deletion-grace-period", 0,
+		"How long the Vault policies and roles of deleted resources are kept before being deleted, so they survive "+
+			"the resource being recreated. Requires finalizers and a controller namespace. If zero, they are deleted immediately.")
+	flag.StringVar(&tombstones, "tombstones", "",
+		"Where the last definition of deleted Vault policies and roles is kept, so they can be re-created with the restore "+
+			"command. Either \"configmap\", for a ConfigMap in the controller namespace, or \"kv:[<connection>@]<mount>/<path>\" for a KV "+
+			"version 2 path reached through the named Vault connection, or the client configured from the environment if none is given. "+
+			"If empty, deleted policies and roles are not kept.")
+	flag.DurationVar(&tombstoneRetention, "tombstone-retention", 30*24*time.Hour,
+		"How long tombstones are kept in the ConfigMap. The oldest are dropped earlier once the ConfigMap is full. "+
+			"If zero, they are only dropped once it is full.")
+	flag.BoolVar(&namespaceCleanup, "namespace-cleanup", false,
+		"Record the resources of each namespace that Vault policies and roles are written for, and delete them all, roles first, "+
+			"once the namespace is deleted. Works with or without finalizers. Requires a controller namespace.")
+	flag.StringVar(&sharedPolicyNamespace, "shared-policy-namespace", "",
+		"The namespace holding ConfigMaps of shared policy templates that resources may reference by name. "+
+			"If empty, shared policies are disabled.")
+	flag.StringVar(&attachablePolicies, "attachable-policies", "",
+		"Comma-separated list of existing Vault policies, or glob patterns of them, that resources may attach to their roles.")
+	flag.BoolVar(&aggregateRoles, "aggregate-roles", false,
+		"Write a single role per ServiceAccount bound to the policies of every Role bound to it, instead of a role per RoleBinding.")
 	flag.StringVar(&namespaces, "namespaces", "", "The namespaces to watch for roles. If empty, all namespaces are watched.")
 	flag.StringVar(&excludeNamespaces, "exclude-namespaces", "", "The namespaces to exclude from watching. If empty, no namespaces are excluded.")
 	flag.BoolVar(&includeSystemNamespaces, "include-system-namespaces", false, "Include system namespaces in the watched namespaces.")
+	flag.BoolVar(&configureAuthMount, "configure-auth-mount", false,
+		"Enable the auth mounts if missing and keep their configuration in sync with the current cluster, in every Vault connection and namespace the watched namespaces map to. JWT auth mounts are skipped.")
+	flag.StringVar(&authMountOpts.KubernetesHost, "auth-mount-kubernetes-host", "",
+		"The Kubernetes API address to configure on the auth mount. Defaults to the address the controller uses.")
+	flag.StringVar(&authMountOpts.Issuer, "auth-mount-issuer", "", "The service account token issuer to configure on the auth mount.")
+	flag.BoolVar(&authMountOpts.UseTokenReviewerJWT, "auth-mount-token-reviewer", false,
+		"Configure the controller's own token as the token reviewer JWT on the auth mount.")
+	flag.DurationVar(&authMountOpts.SyncInterval, "auth-mount-sync-interval", reconcilers.DefaultAuthMountSyncInterval,
+		"The interval at which the auth mount configuration is synced to Vault.")
 	opts := zap.Options{
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
+	restore := len(os.Args) > 1 && os.Args[1] == restoreCommand
+	if restore {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
@@ -80,6 +166,34 @@ func main() {
 		excludedNamespaces = nil
 	}
 
+	var vaultConnections *vault.ConnectionsConfig
+	if vaultConnectionsFile != "" {
+		var err error
+		vaultConnections, err = vault.LoadConnectionsConfig(vaultConnectionsFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load vault connections")
+			os.Exit(1)
+		}
+	}
+
+	var roleDefaults *vault.RoleDefaultsConfig
+	if roleDefaultsFile != "" {
+		var err error
+		roleDefaults, err = vault.LoadRoleDefaultsConfig(roleDefaultsFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load role defaults")
+			os.Exit(1)
+		}
+	}
+
+	if restore {
+		if err := restoreTombstones(controllerNamespace, tombstones, vaultNamespaceTemplate, vaultConnections, flag.Args()); err != nil {
+			setupLog.Error(err, "unable to restore vault objects")
+			os.Exit(1)
+		}
+		return
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -87,18 +201,46 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "87065891.rbac.vault.hashicorp.com",
+		// Secrets are only watched by their metadata and read directly, so their
+		// contents are never cached
+		ClientDisableCacheFor: []client.Object{&corev1.Secret{}},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to create manager")
 		os.Exit(1)
 	}
 
+	// In uninstall mode the manager is stopped once the finalizers are removed
+	ctx, stop := context.WithCancel(ctrl.SetupSignalHandler())
+	defer stop()
+
 	if err = reconcilers.SetupWithManager(mgr, &reconcilers.Options{
-		AuthMount:               authMount,
-		UseFinalizers:           useFinalizers,
-		Namespaces:              ctrlNamespaces,
-		ExcludeNamespaces:       excludedNamespaces,
-		IncludeSystemNamespaces: includeSystemNamespaces,
+		AuthMounts:                 util.SplitList(authMount),
+		JWTAuthMounts:              util.SplitList(jwtAuthMounts),
+		JWTBoundAudiences:          util.SplitList(jwtBoundAudiences),
+		JWTUserClaim:               jwtUserClaim,
+		VaultNamespaceTemplate:     vaultNamespaceTemplate,
+		VaultConnections:           vaultConnections,
+		UseFinalizers:              useFinalizers,
+		Uninstall:                  uninstall,
+		Stop:                       stop,
+		TranslateVerbs:             translateVerbs,
+		RolePolicyFormat:           vault.PolicyFormat(rolePolicyFormat),
+		ServiceAccountPolicyFormat: vault.PolicyFormat(saPolicyFormat),
+		SharedPolicyNamespace:      sharedPolicyNamespace,
+		AttachablePolicies:         util.SplitList(attachablePolicies),
+		AggregateRoles:             aggregateRoles,
+		RoleDefaults:               roleDefaults,
+		ControllerNamespace:        controllerNamespace,
+		DeletionGracePeriod:        deletionGracePeriod,
+		Tombstones:                 tombstones,
+		TombstoneRetention:         tombstoneRetention,
+		NamespaceCleanup:           namespaceCleanup,
+		Namespaces:                 ctrlNamespaces,
+		ExcludeNamespaces:          excludedNamespaces,
+		IncludeSystemNamespaces:    includeSystemNamespaces,
+		ConfigureAuthMount:         configureAuthMount,
+		AuthMountOptions:           authMountOpts,
 	}); err != nil {
 		setupLog.Error(err, "unable to create controllers")
 		os.Exit(1)
@@ -114,21 +256,8 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Add health check for vault communication on healthz
-	if err := mgr.AddHealthzCheck("vault", func(_ *http.Request) error {
-		cli, err := vault.NewClient()
-		if err != nil {
-			return err
-		}
-		_, err = cli.Sys().Health()
-		return err
-	}); err != nil {
-		setupLog.Error(err, "unable to set up vault health check")
-		os.Exit(1)
-	}
-
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
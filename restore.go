@@ -0,0 +1,119 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+// restoreCommand is the first argument that runs the restore command instead of the
+// controller.
+const restoreCommand = "restore"
+
+// restoreTombstones sets up the clients of the restore command and runs it.
+func restoreTombstones(controllerNamespace, location, namespaceTemplate string, connectionsConfig *vault.ConnectionsConfig, args []string) error {
+	cli, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	var connections vault.ConnectionSelector
+	if connectionsConfig != nil {
+		connections = vault.NewConnectionSelector(cli, connectionsConfig)
+	}
+	store, err := vault.NewTombstoneStore(location, cli, controllerNamespace, 0, connections)
+	if err != nil {
+		return err
+	}
+	namespaces, err := vault.NewNamespaceMapper(cli, namespaceTemplate)
+	if err != nil {
+		return err
+	}
+	return runRestore(ctrl.SetupSignalHandler(), os.Stdout, store, connections, namespaces, args)
+}
+
+// runRestore re-creates the deleted Vault policies and roles of the objects given as
+// <kind>/<namespace>/<name> from their tombstones. Without arguments, the stored
+// tombstones are listed instead.
+func runRestore(ctx context.Context, out io.Writer, store vault.TombstoneStore, connections vault.ConnectionSelector, namespaces vault.NamespaceMapper, args []string) error {
+	if store == nil {
+		return errors.New("a tombstone location must be configured with --tombstones")
+	}
+	if len(args) == 0 {
+		tombstones, err := store.List(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "OBJECT\tVAULT OBJECT\tDELETED")
+		for _, tombstone := range tombstones {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", tombstone.ObjectReference, describeTombstone(tombstone), tombstone.DeletedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	}
+	for _, arg := range args {
+		ref, err := vault.ParseObjectReference(arg)
+		if err != nil {
+			return err
+		}
+		tombstones, err := store.Load(ctx, ref)
+		if err != nil {
+			return err
+		}
+		if len(tombstones) == 0 {
+			return fmt.Errorf("no tombstones found for %s", ref)
+		}
+		// Roles are restored last so they never reference a missing policy
+		sort.SliceStable(tombstones, func(i, j int) bool { return tombstones[i].RoleName == "" && tombstones[j].RoleName != "" })
+		for _, tombstone := range tombstones {
+			if err := vault.RestoreTombstone(ctx, connections, namespaces, tombstone); err != nil {
+				return fmt.Errorf("%s: %w", ref, err)
+			}
+			fmt.Fprintf(out, "restored %s of %s\n", describeTombstone(tombstone), ref)
+		}
+	}
+	return nil
+}
+
+func describeTombstone(tombstone *vault.Tombstone) string {
+	if tombstone.RoleName == "" {
+		return "policy " + tombstone.PolicyName
+	}
+	roles := map[string]map[string]map[string]any{tombstone.RoleName: tombstone.Roles}
+	for name, params := range tombstone.NamespacedRoles {
+		roles[name] = params
+	}
+	names := make([]string, 0, len(roles))
+	for name, params := range roles {
+		if len(params) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	described := make([]string, 0, len(names))
+	for _, name := range names {
+		mounts := make([]string, 0, len(roles[name]))
+		for mount := range roles[name] {
+			mounts = append(mounts, mount)
+		}
+		sort.Strings(mounts)
+		described = append(described, fmt.Sprintf("role %s (%s)", name, strings.Join(mounts, ", ")))
+	}
+	return strings.Join(described, ", ")
+}
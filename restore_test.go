@@ -0,0 +1,120 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/tinyzimmer/vault-rbac-controller/internal/vault"
+)
+
+func TestRunRestore(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Vault-Namespace"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	newClient := vault.NewClient
+	defer func() { vault.NewClient = newClient }()
+	vault.NewClient = func() (*vaultapi.Client, error) {
+		cfg := vaultapi.DefaultConfig()
+		cfg.Address = srv.URL
+		cli, err := vaultapi.NewClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cli.SetToken("test")
+		return cli, nil
+	}
+
+	ctx := context.Background()
+	cli := fake.NewClientBuilder().WithScheme(scheme).Build()
+	store, err := vault.NewTombstoneStore("configmap", cli, "vault-rbac-controller", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := vault.ObjectReference{Kind: "ServiceAccount", Namespace: "default", Name: "app"}
+	loc := &vault.Location{Namespace: "tenants/default"}
+	for _, tombstone := range []*vault.Tombstone{
+		{
+			ObjectReference: ref,
+			RoleName:        "default-app",
+			Roles:           map[string]map[string]any{"kubernetes": {"token_policies": []string{"default-app"}}},
+			Location:        loc,
+			DeletedAt:       metav1.Now(),
+		},
+		{
+			ObjectReference: ref,
+			PolicyName:      "default-app",
+			Policy:          `path "secret/*" { capabilities = ["read"] }`,
+			Location:        loc,
+			DeletedAt:       metav1.Now(),
+		},
+	} {
+		if err := store.Save(ctx, tombstone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	namespaces, err := vault.NewNamespaceMapper(cli, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runRestore(ctx, &out, store, nil, namespaces, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"serviceaccount/default/app", "policy default-app", "role default-app (kubernetes)"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected the listed tombstones to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+	if len(requests) != 0 {
+		t.Errorf("Expected listing tombstones not to write to Vault, got %v", requests)
+	}
+
+	out.Reset()
+	if err := runRestore(ctx, &out, store, nil, namespaces, []string{"serviceaccount/default/app"}); err != nil {
+		t.Fatal(err)
+	}
+	// The policy is restored before the role referencing it
+	expected := []string{
+		"PUT /v1/sys/policies/acl/default-app tenants/default",
+		"PUT /v1/auth/kubernetes/role/default-app tenants/default",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected requests %v, got %v", expected, requests)
+	}
+	if !strings.Contains(out.String(), "restored policy default-app of serviceaccount/default/app") {
+		t.Errorf("Expected the restored policy to be reported, got:\n%s", out.String())
+	}
+
+	for _, args := range [][]string{{"serviceaccount/default/missing"}, {"pod/default/app"}} {
+		if err := runRestore(ctx, &out, store, nil, namespaces, args); err == nil {
+			t.Errorf("Expected error restoring %v, got nil", args)
+		}
+	}
+	if err := runRestore(ctx, &out, nil, nil, namespaces, nil); err == nil {
+		t.Error("Expected error without a tombstone store, got nil")
+	}
+}